@@ -2,67 +2,686 @@ package elastic_exporter
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tidwall/gjson"
 	"iss.digital/mt/elastic_exporter/config"
 )
 
+// aggregationsHandled counts the aggregation results handled, by aggregation type. It's exposed along with the
+// exporter's own metrics.
+var aggregationsHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "elastic_exporter",
+	Name:      "aggregation_handled_total",
+	Help:      "Number of aggregation results handled, by aggregation type.",
+}, []string{"type"})
+
+// quantileLabel is the label holding the quantile of percentiles samples.
+const quantileLabel = "quantile"
+
+// aggregationMismatches counts the aggregations found in responses without being expected, or expected but missing.
+var aggregationMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "elastic_exporter",
+	Name:      "aggregation_mismatches_total",
+	Help:      "Number of aggregations unexpected in or missing from responses, by kind (unexpected or missing).",
+}, []string{"kind"})
+
+// aggregationHandlerTypes is the number of aggregation types with a handler, kept up to date by
+// RegisterAggregationHandler.
+var aggregationHandlerTypes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "elastic_exporter",
+	Name:      "aggregation_handler_types",
+	Help:      "Number of aggregation types with a handler.",
+})
+
+func init() {
+	prometheus.MustRegister(aggregationsHandled, aggregationMismatches, aggregationHandlerTypes)
+	aggregationHandlerTypes.Set(float64(len(aggregationHandlers)))
+}
+
+// AggregationHandler extracts metric data from an aggregation result. An error doesn't necessarily invalidate the
+// returned data, e.g. a malformed bucket is skipped while the others are still exported.
 type AggregationHandler interface {
-	Handle(result gjson.Result, metricsData []metricData) []metricData
-}
-
-func NewForType(aggType config.AggregationType, name string) (AggregationHandler, error) {
-	var handler AggregationHandler
-	switch aggType {
-	case config.AggregationTypeTerms:
-		handler = &TermsAggregationHandler{name: name}
-	case config.AggregationTypeStats:
-		handler = &StatsAggregationHandler{}
-	case config.AggregationTypeMax:
-	case config.AggregationTypeMin:
-	case config.AggregationTypeSum:
-	case config.AggregationTypeAvg:
-	case config.AggregationTypeCardinality:
-		handler = &SingleValueAggregationHandler{}
-	default:
-		return nil, fmt.Errorf("handler for %s not implemented", string(aggType))
+	Handle(result gjson.Result, metricsData []metricData) ([]metricData, error)
+}
+
+// BucketAggregationHandler is an AggregationHandler for aggregations with buckets, which sub-aggregations are run on.
+type BucketAggregationHandler interface {
+	AggregationHandler
+	// Buckets returns the buckets of an aggregation result, each with the labels identifying it.
+	Buckets(result gjson.Result) []bucket
+}
+
+// bucket is a bucket of an aggregation result, holding the results of its sub-aggregations.
+type bucket struct {
+	labels []*labelPair
+	result gjson.Result
+}
+
+// newSingleValueAggregationHandler returns the handler of single-value aggregations.
+func newSingleValueAggregationHandler(agg *config.AggregationConfig) AggregationHandler {
+	return &SingleValueAggregationHandler{asStringLabel: agg.AsStringLabel}
+}
+
+// AggregationHandlerFactory creates the handler of an aggregation.
+type AggregationHandlerFactory func(agg *config.AggregationConfig) AggregationHandler
+
+// aggregationHandlersMu guards aggregationHandlers.
+var aggregationHandlersMu sync.RWMutex
+
+// aggregationHandlers holds the constructors of the handlers of each supported aggregation type.
+var aggregationHandlers = map[config.AggregationType]AggregationHandlerFactory{
+	config.AggregationTypeTerms: func(agg *config.AggregationConfig) AggregationHandler {
+		return &TermsAggregationHandler{name: agg.Name, expectedKeys: agg.ExpectedKeys, mapKey: agg.MapKey}
+	},
+	config.AggregationTypeStats: func(agg *config.AggregationConfig) AggregationHandler {
+		return &StatsAggregationHandler{label: agg.StatLabel}
+	},
+	config.AggregationTypeExtendedStats: func(agg *config.AggregationConfig) AggregationHandler {
+		return &ExtendedStatsAggregationHandler{label: agg.StatLabel}
+	},
+	config.AggregationTypeMax:         newSingleValueAggregationHandler,
+	config.AggregationTypeMin:         newSingleValueAggregationHandler,
+	config.AggregationTypeSum:         newSingleValueAggregationHandler,
+	config.AggregationTypeAvg:         newSingleValueAggregationHandler,
+	config.AggregationTypeCardinality: newSingleValueAggregationHandler,
+	config.AggregationTypeValueCount:  newSingleValueAggregationHandler,
+	config.AggregationTypeDerivative: func(agg *config.AggregationConfig) AggregationHandler {
+		// The derivative of the first bucket is null (or missing altogether), there's nothing to derive it from.
+		return &SingleValueAggregationHandler{asStringLabel: agg.AsStringLabel, skipNull: true}
+	},
+	config.AggregationTypeBucketScript: func(agg *config.AggregationConfig) AggregationHandler {
+		return &SingleValueAggregationHandler{asStringLabel: agg.AsStringLabel, skipNull: true}
+	},
+	config.AggregationTypeTopHits: func(agg *config.AggregationConfig) AggregationHandler {
+		return newTopHitsAggregationHandler(agg)
+	},
+	config.AggregationTypePercentiles: func(agg *config.AggregationConfig) AggregationHandler {
+		return &PercentilesAggregationHandler{}
+	},
+	config.AggregationTypeComposite: func(agg *config.AggregationConfig) AggregationHandler {
+		sources := make([]string, 0, len(agg.Sources))
+		for _, s := range agg.Sources {
+			sources = append(sources, s.Name)
+		}
+		return &CompositeAggregationHandler{sources: sources}
+	},
+	config.AggregationTypeHistogram: func(agg *config.AggregationConfig) AggregationHandler {
+		return &HistogramAggregationHandler{name: agg.Name}
+	},
+	config.AggregationTypeFilters: func(agg *config.AggregationConfig) AggregationHandler {
+		return &FiltersAggregationHandler{name: agg.Name, otherBucket: agg.OtherBucket}
+	},
+	config.AggregationTypeMissing: func(agg *config.AggregationConfig) AggregationHandler {
+		return &MissingAggregationHandler{name: agg.Name}
+	},
+	config.AggregationTypeSignificantTerms: func(agg *config.AggregationConfig) AggregationHandler {
+		return &SignificantTermsAggregationHandler{name: agg.Name, value: agg.SignificantValue}
+	},
+	config.AggregationTypePercentileRanks: func(agg *config.AggregationConfig) AggregationHandler {
+		return &PercentileRanksAggregationHandler{}
+	},
+	config.AggregationTypeRange: func(agg *config.AggregationConfig) AggregationHandler {
+		return &RangeAggregationHandler{name: agg.Name}
+	},
+	config.AggregationTypeDateHistogram: func(agg *config.AggregationConfig) AggregationHandler {
+		return &DateHistogramAggregationHandler{name: agg.Name, latest: agg.Buckets() == config.DateBucketsLatest}
+	},
+	config.AggregationTypeSuggest: func(agg *config.AggregationConfig) AggregationHandler {
+		return &SuggestHandler{name: agg.Name, value: agg.SuggestValue}
+	},
+}
+
+// RegisterAggregationHandler registers the factory of the handlers of aggregations of the given type, replacing the
+// current one (if any). Targets created afterwards use it.
+func RegisterAggregationHandler(aggType config.AggregationType, factory AggregationHandlerFactory) {
+	aggregationHandlersMu.Lock()
+	defer aggregationHandlersMu.Unlock()
+
+	aggregationHandlers[aggType] = factory
+	aggregationHandlerTypes.Set(float64(len(aggregationHandlers)))
+}
+
+func NewForType(agg *config.AggregationConfig) (AggregationHandler, error) {
+	if agg.AllFields {
+		return &AllFieldsAggregationHandler{}, nil
 	}
 
-	return handler, nil
+	aggregationHandlersMu.RLock()
+	newHandler, found := aggregationHandlers[agg.Type()]
+	aggregationHandlersMu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("handler for %s not implemented", string(agg.Type()))
+	}
+	return newHandler(agg), nil
 }
 
 type TermsAggregationHandler struct {
-	name string
+	name         string
+	expectedKeys []string
+	mapKey       func(string) string // maps bucket keys to label values
 }
 
-func (t TermsAggregationHandler) Handle(result gjson.Result, metricsData []metricData) []metricData {
+func (t TermsAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	var err error
+	// Position of the data by label value, as several keys may map to the same label value (e.g. daily indices of the
+	// same data stream) and have their doc counts summed up.
+	positions := make(map[string]int)
 	buckets := result.Get("buckets")
 	for _, data := range buckets.Array() {
 		key := data.Get("key")
-		value := data.Get("doc_count").Float()
+		docCount := data.Get("doc_count")
+		if docCount.Type != gjson.Number {
+			// Skip the bucket rather than export a made up 0.
+			err = fmt.Errorf("non-numeric doc_count %s for key %q of aggregation %s", docCount.Raw, key.String(), t.name)
+			continue
+		}
+
+		label := t.mapKey(key.String())
+		if i, found := positions[label]; found {
+			metricsData[i].value += docCount.Float()
+			continue
+		}
+		positions[label] = len(metricsData)
+		metricsData = append(metricsData, newLabeledMetricData(docCount.Float(), t.name, label))
+	}
+
+	// Zero-fill expected keys without a bucket, so that their series don't disappear.
+	if len(t.expectedKeys) > 0 {
+		keys := termsKeys(result, t.mapKey)
+		for _, key := range t.expectedKeys {
+			if !keys[key] {
+				metricsData = append(metricsData, newLabeledMetricData(0, t.name, key))
+			}
+		}
+	}
+
+	return metricsData, err
+}
+
+// Buckets implements BucketAggregationHandler, labeling each bucket with its (mapped) key.
+func (t TermsAggregationHandler) Buckets(result gjson.Result) []bucket {
+	buckets := result.Get("buckets").Array()
+	res := make([]bucket, 0, len(buckets))
+	for _, b := range buckets {
+		res = append(res, bucket{
+			labels: []*labelPair{{key: t.name, value: t.mapKey(b.Get("key").String())}},
+			result: b,
+		})
+	}
+	return res
+}
+
+// CompositeAggregationHandler exports the doc count of composite aggregation buckets, labeled with the value of each
+// source.
+type CompositeAggregationHandler struct {
+	sources []string
+}
 
-		metricsData = append(metricsData, newLabeledMetricData(value, t.name, key.String()))
+func (c CompositeAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	var err error
+	for _, bucket := range result.Get("buckets").Array() {
+		docCount := bucket.Get("doc_count")
+		if docCount.Type != gjson.Number {
+			err = fmt.Errorf("non-numeric doc_count %s for key %s", docCount.Raw, bucket.Get("key").Raw)
+			continue
+		}
+		labels := make([]*labelPair, 0, len(c.sources))
+		for _, s := range c.sources {
+			labels = append(labels, &labelPair{key: s, value: bucket.Get("key." + s).String()})
+		}
+		metricsData = append(metricsData, metricData{labels: labels, value: docCount.Float()})
 	}
+	return metricsData, err
+}
+
+// Buckets implements BucketAggregationHandler, labeling each bucket with the value of each source.
+func (c CompositeAggregationHandler) Buckets(result gjson.Result) []bucket {
+	buckets := result.Get("buckets").Array()
+	res := make([]bucket, 0, len(buckets))
+	for _, b := range buckets {
+		labels := make([]*labelPair, 0, len(c.sources))
+		for _, s := range c.sources {
+			labels = append(labels, &labelPair{key: s, value: b.Get("key." + s).String()})
+		}
+		res = append(res, bucket{labels: labels, result: b})
+	}
+	return res
+}
+
+// HistogramAggregationHandler exports the doc count of histogram aggregation buckets, labeled with the bucket key (its
+// lower bound) formatted without trailing zeros.
+type HistogramAggregationHandler struct {
+	name string
+}
+
+func (h HistogramAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	var err error
+	for _, b := range h.Buckets(result) {
+		docCount := b.result.Get("doc_count")
+		if docCount.Type != gjson.Number {
+			err = fmt.Errorf("non-numeric doc_count %s for key %s of aggregation %s", docCount.Raw, b.labels[0].value, h.name)
+			continue
+		}
+		metricsData = append(metricsData, metricData{labels: b.labels, value: docCount.Float()})
+	}
+	return metricsData, err
+}
+
+// Buckets implements BucketAggregationHandler.
+func (h HistogramAggregationHandler) Buckets(result gjson.Result) []bucket {
+	buckets := result.Get("buckets").Array()
+	res := make([]bucket, 0, len(buckets))
+	for _, b := range buckets {
+		key := strconv.FormatFloat(b.Get("key").Float(), 'f', -1, 64)
+		res = append(res, bucket{labels: []*labelPair{{key: h.name, value: key}}, result: b})
+	}
+	return res
+}
+
+// FiltersAggregationHandler exports the doc count of filters aggregation buckets, labeled with the filter name. For
+// anonymous filters, whose buckets come as an array, the label is the filter's position; the other bucket (if any) comes
+// last, labeled `_other_`.
+type FiltersAggregationHandler struct {
+	name        string
+	otherBucket bool
+}
+
+func (f FiltersAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	var err error
+	for _, b := range f.Buckets(result) {
+		docCount := b.result.Get("doc_count")
+		if docCount.Type != gjson.Number {
+			err = fmt.Errorf("non-numeric doc_count %s for filter %q of aggregation %s", docCount.Raw, b.labels[0].value, f.name)
+			continue
+		}
+		metricsData = append(metricsData, metricData{labels: b.labels, value: docCount.Float()})
+	}
+	return metricsData, err
+}
 
-	return metricsData
+// Buckets implements BucketAggregationHandler, for both keyed (`buckets` is an object by filter name) and anonymous
+// (`buckets` is an array) filters.
+func (f FiltersAggregationHandler) Buckets(result gjson.Result) []bucket {
+	buckets := result.Get("buckets")
+	var res []bucket
+	if buckets.IsArray() {
+		array := buckets.Array()
+		for i, b := range array {
+			label := strconv.Itoa(i)
+			if f.otherBucket && i == len(array)-1 {
+				label = config.OtherBucketKey
+			}
+			res = append(res, bucket{labels: []*labelPair{{key: f.name, value: label}}, result: b})
+		}
+		return res
+	}
+	buckets.ForEach(func(key, b gjson.Result) bool {
+		res = append(res, bucket{labels: []*labelPair{{key: f.name, value: key.String()}}, result: b})
+		return true
+	})
+	return res
+}
+
+// MissingAggregationHandler exports the doc count of a missing aggregation, i.e. the number of documents lacking the
+// field. Its single bucket is the result itself, so sub-aggregations add no labels.
+type MissingAggregationHandler struct {
+	name string
+}
+
+func (m MissingAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	docCount := result.Get("doc_count")
+	if docCount.Type != gjson.Number {
+		return metricsData, fmt.Errorf("non-numeric doc_count %s of aggregation %s", docCount.Raw, m.name)
+	}
+	return append(metricsData, newMetricData(docCount.Float())), nil
+}
+
+// Buckets implements BucketAggregationHandler.
+func (m MissingAggregationHandler) Buckets(result gjson.Result) []bucket {
+	return []bucket{{result: result}}
+}
+
+// SignificantTermsAggregationHandler exports a value of significant_terms aggregation buckets (the score, doc count or
+// background count), labeled with the bucket key.
+type SignificantTermsAggregationHandler struct {
+	name  string
+	value string
+}
+
+func (s SignificantTermsAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	var err error
+	for _, b := range s.Buckets(result) {
+		value := b.result.Get(s.value)
+		if value.Type != gjson.Number {
+			err = fmt.Errorf("non-numeric %s %s for key %q of aggregation %s", s.value, value.Raw, b.labels[0].value, s.name)
+			continue
+		}
+		metricsData = append(metricsData, metricData{labels: b.labels, value: value.Float()})
+	}
+	return metricsData, err
+}
+
+// Buckets implements BucketAggregationHandler, labeling each bucket with its key.
+func (s SignificantTermsAggregationHandler) Buckets(result gjson.Result) []bucket {
+	buckets := result.Get("buckets").Array()
+	res := make([]bucket, 0, len(buckets))
+	for _, b := range buckets {
+		res = append(res, bucket{labels: []*labelPair{{key: s.name, value: b.Get("key").String()}}, result: b})
+	}
+	return res
 }
 
+// RangeAggregationHandler exports the doc count of range aggregation buckets, labeled with the bucket key.
+type RangeAggregationHandler struct {
+	name string
+}
+
+func (r RangeAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	var err error
+	for _, b := range r.Buckets(result) {
+		docCount := b.result.Get("doc_count")
+		if docCount.Type != gjson.Number {
+			err = fmt.Errorf("non-numeric doc_count %s for key %q of aggregation %s", docCount.Raw, b.labels[0].value, r.name)
+			continue
+		}
+		metricsData = append(metricsData, metricData{labels: b.labels, value: docCount.Float()})
+	}
+	return metricsData, err
+}
+
+// Buckets implements BucketAggregationHandler, for both the default response (`buckets` is an array) and the keyed one
+// (`buckets` is an object by key).
+func (r RangeAggregationHandler) Buckets(result gjson.Result) []bucket {
+	var res []bucket
+	result.Get("buckets").ForEach(func(key, b gjson.Result) bool {
+		label := key.String()
+		if !key.Exists() {
+			label = rangeKey(b)
+		}
+		res = append(res, bucket{labels: []*labelPair{{key: r.name, value: label}}, result: b})
+		return true
+	})
+	return res
+}
+
+// rangeKey returns the key of a range bucket, or one composed of its bounds like ElasticSearch does (e.g. `*-100.0`) if
+// it has none.
+func rangeKey(b gjson.Result) string {
+	if key := b.Get("key"); key.Exists() {
+		return key.String()
+	}
+	bound := func(name string) string {
+		if v := b.Get(name); v.Exists() {
+			if f := v.Float(); f == math.Trunc(f) {
+				// Formatted like Java does, e.g. `100.0`.
+				return strconv.FormatFloat(f, 'f', 1, 64)
+			}
+			return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+		}
+		return "*"
+	}
+	return bound("from") + "-" + bound("to")
+}
+
+// DateHistogramAggregationHandler exports the doc count of date_histogram buckets, labeled with the formatted bucket
+// date (`key_as_string`). If latest is set, it only exports the doc count of the latest bucket, unlabeled, since samples
+// are timestamped by the scrape anyway.
+type DateHistogramAggregationHandler struct {
+	name   string
+	latest bool
+}
+
+func (h DateHistogramAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	var err error
+	for _, b := range h.Buckets(result) {
+		docCount := b.result.Get("doc_count")
+		if docCount.Type != gjson.Number {
+			err = fmt.Errorf("non-numeric doc_count %s for key %s of aggregation %s", docCount.Raw, b.result.Get("key").Raw, h.name)
+			continue
+		}
+		metricsData = append(metricsData, metricData{labels: b.labels, value: docCount.Float()})
+	}
+	return metricsData, err
+}
+
+// Buckets implements BucketAggregationHandler. ElasticSearch returns the buckets in ascending date order.
+func (h DateHistogramAggregationHandler) Buckets(result gjson.Result) []bucket {
+	buckets := result.Get("buckets").Array()
+	if h.latest {
+		if len(buckets) == 0 {
+			return nil
+		}
+		return []bucket{{result: buckets[len(buckets)-1]}}
+	}
+	res := make([]bucket, 0, len(buckets))
+	for _, b := range buckets {
+		date := b.Get("key_as_string")
+		if !date.Exists() {
+			// Fall back to the epoch millis key.
+			date = b.Get("key")
+		}
+		res = append(res, bucket{labels: []*labelPair{{key: h.name, value: date.String()}}, result: b})
+	}
+	return res
+}
+
+// termsKeys returns the set of bucket keys of a terms aggregation result, as mapped by mapKey.
+func termsKeys(result gjson.Result, mapKey func(string) string) map[string]bool {
+	buckets := result.Get("buckets").Array()
+	keys := make(map[string]bool, len(buckets))
+	for _, data := range buckets {
+		keys[mapKey(data.Get("key").String())] = true
+	}
+	return keys
+}
+
+// SingleValueAggregationHandler exports the `value` of an aggregation, optionally labeled with its formatted
+// `value_as_string` (e.g. a date).
 type SingleValueAggregationHandler struct {
+	asStringLabel string
+	skipNull      bool // skip null values rather than export them as 0
+}
+
+func (m SingleValueAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	value := result.Get("value")
+	if m.skipNull && value.Type != gjson.Number {
+		return metricsData, nil
+	}
+	if m.asStringLabel != "" {
+		// Fall back to the raw value if the aggregation has no format.
+		formatted := result.Get("value_as_string")
+		if !formatted.Exists() {
+			formatted = value
+		}
+		return append(metricsData, newLabeledMetricData(value.Float(), m.asStringLabel, formatted.String())), nil
+	}
+
+	return append(metricsData, newMetricData(value.Float())), nil
 }
 
-func (m SingleValueAggregationHandler) Handle(result gjson.Result, metricsData []metricData) []metricData {
-	value := result.Get("value").Float()
+// TopHitsAggregationHandler exports a numeric `_source` field of the top hit as value, and string fields of the same
+// hit as labels.
+type TopHitsAggregationHandler struct {
+	field       string
+	labelFields []string
+	labelNames  []string
+}
 
-	return append(metricsData, newMetricData(value))
+func newTopHitsAggregationHandler(agg *config.AggregationConfig) *TopHitsAggregationHandler {
+	labelNames := make([]string, 0, len(agg.LabelFields))
+	for _, f := range agg.LabelFields {
+		labelNames = append(labelNames, agg.FieldLabel(f))
+	}
+	return &TopHitsAggregationHandler{
+		field:       agg.Field,
+		labelFields: agg.LabelFields,
+		labelNames:  labelNames,
+	}
 }
 
+func (t TopHitsAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	source := result.Get("hits.hits.0._source")
+	if !source.Exists() {
+		// No hits, nothing to export.
+		return metricsData, nil
+	}
+	field := source.Get(t.field)
+	if !field.Exists() {
+		return metricsData, nil
+	}
+	value, ok := sourceValue(field)
+	if !ok {
+		// Rather than export a made up 0.
+		return metricsData, fmt.Errorf("non-numeric value %s of field %s in top hit", field.Raw, t.field)
+	}
+
+	labels := make([]*labelPair, 0, len(t.labelFields))
+	for i, f := range t.labelFields {
+		labels = append(labels, &labelPair{key: t.labelNames[i], value: source.Get(f).String()})
+	}
+	return append(metricsData, metricData{labels: labels, value: value}), nil
+}
+
+// sourceValue returns the numeric value of a `_source` field, false if it's not a number.
+func sourceValue(field gjson.Result) (float64, bool) {
+	switch field.Type {
+	case gjson.Number:
+		return field.Float(), true
+	case gjson.String:
+		// Numbers are often indexed as strings, e.g. by loggers.
+		value, err := strconv.ParseFloat(field.String(), 64)
+		return value, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// PercentilesAggregationHandler exports each percentile as a sample labeled with its quantile (e.g. `0.99` for the 99th
+// percentile). It handles both the default keyed response (`values` is an object by percentile) and the non-keyed one
+// (`values` is an array of `key`/`value` objects).
+type PercentilesAggregationHandler struct {
+}
+
+func (p PercentilesAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	forEachKeyedValue(result.Get("values"), func(key, value float64) {
+		quantile := strconv.FormatFloat(key/100, 'g', -1, 64)
+		metricsData = append(metricsData, newLabeledMetricData(value, quantileLabel, quantile))
+	})
+	return metricsData, nil
+}
+
+// PercentileRanksAggregationHandler exports the percentile rank of each value, labeled with the value. Like percentiles,
+// it handles both keyed and non-keyed responses.
+type PercentileRanksAggregationHandler struct {
+}
+
+func (p PercentileRanksAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	forEachKeyedValue(result.Get("values"), func(key, value float64) {
+		metricsData = append(metricsData, newLabeledMetricData(value, "value", strconv.FormatFloat(key, 'f', -1, 64)))
+	})
+	return metricsData, nil
+}
+
+// forEachKeyedValue calls f for each numeric key and value of the `values` of a percentiles or percentile_ranks result,
+// either keyed (an object by key) or not (an array of `key`/`value` objects). Null (or NaN) values, as returned if there
+// are no documents to calculate them from, are skipped.
+func forEachKeyedValue(values gjson.Result, f func(key, value float64)) {
+	add := func(key, value gjson.Result) {
+		k, err := strconv.ParseFloat(key.String(), 64)
+		if err != nil || value.Type != gjson.Number || math.IsNaN(value.Float()) {
+			return
+		}
+		f(k, value.Float())
+	}
+
+	if values.IsArray() {
+		for _, v := range values.Array() {
+			add(v.Get("key"), v.Get("value"))
+		}
+		return
+	}
+	values.ForEach(func(key, value gjson.Result) bool {
+		add(key, value)
+		return true
+	})
+}
+
+// SuggestHandler exports the options of a suggester, labeled with the suggested text. It gets the suggester's entries
+// from the `suggest` section of the response rather than an aggregation result.
+type SuggestHandler struct {
+	name  string
+	value string
+}
+
+func (s SuggestHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	var err error
+	for _, entry := range result.Array() {
+		for _, option := range entry.Get("options").Array() {
+			text := option.Get("text").String()
+			// Rather than 0, e.g. for a misspelled value field or a suggester without it.
+			value := option.Get(s.value)
+			if !value.Exists() {
+				err = fmt.Errorf("missing %s for option %q of suggester %s", s.value, text, s.name)
+				continue
+			}
+			if value.Type != gjson.Number {
+				err = fmt.Errorf("non-numeric %s %s for option %q of suggester %s", s.value, value.Raw, text, s.name)
+				continue
+			}
+			metricsData = append(metricsData, newLabeledMetricData(value.Float(), s.name, text))
+		}
+	}
+	return metricsData, err
+}
+
+// AllFieldsAggregationHandler exports every numeric field of a metric aggregation result, labeled with the field name.
+// Unlike the type specific handlers it doesn't need to know the fields in advance, so it picks up any ElasticSearch adds.
+type AllFieldsAggregationHandler struct {
+}
+
+func (a AllFieldsAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	result.ForEach(func(key, value gjson.Result) bool {
+		if value.Type == gjson.Number {
+			metricsData = append(metricsData, newLabeledMetricData(value.Float(), "field", key.String()))
+		}
+		return true
+	})
+	return metricsData, nil
+}
+
+// StatsAggregationHandler exports the stats of a stats aggregation, labeled with the stat name. The label defaults to
+// the aggregation name, like the keys of bucket aggregations, so that the stats of different aggregations don't collide.
 type StatsAggregationHandler struct {
+	label string // label to export the stat name as
+}
+
+func (s StatsAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	metricsData = append(metricsData, newLabeledMetricData(result.Get("count").Float(), s.label, "count"))
+	metricsData = append(metricsData, newLabeledMetricData(result.Get("min").Float(), s.label, "min"))
+	metricsData = append(metricsData, newLabeledMetricData(result.Get("max").Float(), s.label, "max"))
+	metricsData = append(metricsData, newLabeledMetricData(result.Get("avg").Float(), s.label, "avg"))
+
+	return append(metricsData, newLabeledMetricData(result.Get("sum").Float(), s.label, "sum")), nil
 }
 
-func (s StatsAggregationHandler) Handle(result gjson.Result, metricsData []metricData) []metricData {
-	metricsData = append(metricsData, newLabeledMetricData(result.Get("count").Float(), "stat", "count"))
-	metricsData = append(metricsData, newLabeledMetricData(result.Get("min").Float(), "stat", "min"))
-	metricsData = append(metricsData, newLabeledMetricData(result.Get("max").Float(), "stat", "max"))
-	metricsData = append(metricsData, newLabeledMetricData(result.Get("avg").Float(), "stat", "avg"))
+// extendedStats are the fields of an extended_stats aggregation result exported by ExtendedStatsAggregationHandler.
+var extendedStats = []string{"count", "min", "max", "avg", "sum", "sum_of_squares", "variance", "std_deviation"}
+
+// ExtendedStatsAggregationHandler exports the stats of an extended_stats aggregation, labeled with the stat name. Stats
+// missing from the result (or null, as min and max are without documents) are omitted.
+type ExtendedStatsAggregationHandler struct {
+	label string // label to export the stat name as
+}
 
-	return append(metricsData, newLabeledMetricData(result.Get("sum").Float(), "stat", "sum"))
+func (s ExtendedStatsAggregationHandler) Handle(result gjson.Result, metricsData []metricData) ([]metricData, error) {
+	for _, stat := range extendedStats {
+		if value := result.Get(stat); value.Type == gjson.Number {
+			metricsData = append(metricsData, newLabeledMetricData(value.Float(), s.label, stat))
+		}
+	}
+	return metricsData, nil
 }
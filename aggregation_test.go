@@ -0,0 +1,555 @@
+package elastic_exporter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v2"
+	"iss.digital/mt/elastic_exporter/config"
+)
+
+// handleAggregation runs the handler of the aggregation defined by text on the given result. It returns the data as
+// label sets followed by the value, e.g. `{host="a"} 1`.
+func handleAggregation(t *testing.T, text, result string) ([]string, error) {
+	t.Helper()
+	var agg config.AggregationConfig
+	if err := yaml.Unmarshal([]byte(text), &agg); err != nil {
+		t.Fatalf("invalid aggregation config: %s", err)
+	}
+	handler, err := NewForType(&agg)
+	if err != nil {
+		t.Fatalf("NewForType: %s", err)
+	}
+	data, err := handler.Handle(gjson.Parse(result), nil)
+	lines := make([]string, 0, len(data))
+	for _, d := range data {
+		lines = append(lines, d.labelString()+" "+formatFloat(d.value))
+	}
+	return lines, err
+}
+
+func TestAggregationHandledCount(t *testing.T) {
+	types := []string{"terms", "avg", "max"}
+	before := make(map[string]float64, len(types))
+	for _, typ := range types {
+		before[typ] = testutil.ToFloat64(aggregationsHandled.WithLabelValues(typ))
+	}
+
+	runCollector(t, `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: host
+        type: terms
+        field: host
+        aggregations:
+          - name: latency
+            type: avg
+            field: latency
+      - name: max_latency
+        type: max
+        field: latency
+metrics:
+  - metric_name: latency
+    type: gauge
+    help: Average latency by host.
+    query_ref: requests
+    aggregation_ref: latency
+  - metric_name: max_latency
+    type: gauge
+    help: Maximum latency.
+    query_ref: requests
+    aggregation_ref: max_latency
+`, nil, respondJSON(`{
+  "hits": {"total": {"value": 3}},
+  "aggregations": {
+    "host": {"buckets": [
+      {"key": "a", "doc_count": 2, "latency": {"value": 0.5}},
+      {"key": "b", "doc_count": 1, "latency": {"value": 1.5}}
+    ]},
+    "max_latency": {"value": 2}
+  }
+}`))
+
+	// The sub-aggregation is handled once per bucket.
+	for typ, want := range map[string]float64{"terms": 1, "avg": 2, "max": 1} {
+		if got := testutil.ToFloat64(aggregationsHandled.WithLabelValues(typ)) - before[typ]; got != want {
+			t.Errorf("%s aggregations handled: got %v, want %v", typ, got, want)
+		}
+	}
+}
+
+func TestTopHitsAggregationHandler(t *testing.T) {
+	const agg = `
+name: latest
+type: top_hits
+field: temperature
+label_fields: [sensor_id, location.name]
+sort_field: "@timestamp"
+`
+	lines, err := handleAggregation(t, agg, `{"hits": {"total": {"value": 12}, "hits": [
+  {"_id": "1", "_source": {"temperature": 21.5, "sensor_id": "s-42", "location": {"name": "hall"}}}
+]}}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{sensor_id="s-42",location_name="hall"} 21.5`)
+
+	lines, err = handleAggregation(t, agg, `{"hits": {"total": {"value": 0}, "hits": []}}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines)
+
+	// Numbers indexed as strings.
+	lines, err = handleAggregation(t, agg, `{"hits": {"hits": [{"_source": {"temperature": "19.5", "sensor_id": "s-7"}}]}}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{sensor_id="s-7",location_name=""} 19.5`)
+
+	// A hit without the field.
+	lines, err = handleAggregation(t, agg, `{"hits": {"hits": [{"_source": {"sensor_id": "s-7"}}]}}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines)
+
+	// Rather than a made up 0.
+	for _, value := range []string{`"warm"`, `true`, `{"celsius": 20}`} {
+		_, err = handleAggregation(t, agg, `{"hits": {"hits": [{"_source": {"temperature": `+value+`}}]}}`)
+		if err == nil || !strings.Contains(err.Error(), "non-numeric value "+value+" of field temperature") {
+			t.Errorf("got error %v, want a non-numeric value error for %s", err, value)
+		}
+	}
+}
+
+func TestAllFieldsAggregationHandler(t *testing.T) {
+	lines, err := handleAggregation(t, `
+name: latency
+type: stats
+field: latency
+all_fields: true
+`, `{"count": 4, "min": 1, "max": 9, "avg": 4.5, "sum": 18, "p50": 4, "unit": "ms", "nested": {"value": 1}}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines,
+		`{field="count"} 4`,
+		`{field="min"} 1`,
+		`{field="max"} 9`,
+		`{field="avg"} 4.5`,
+		`{field="sum"} 18`,
+		`{field="p50"} 4`)
+}
+
+func TestTermsAggregationHandlerNonNumericDocCount(t *testing.T) {
+	lines, err := handleAggregation(t, "name: host\ntype: terms\nfield: host", `{"buckets": [
+  {"key": "a", "doc_count": "12"},
+  {"key": "b", "doc_count": 5}
+]}`)
+	if err == nil || !strings.Contains(err.Error(), `non-numeric doc_count "12" for key "a"`) {
+		t.Errorf("expected a non-numeric doc_count error, got %v", err)
+	}
+	// Rather than a made up 0 for a.
+	assertLines(t, lines, `{host="b"} 5`)
+}
+
+func TestSingleValueAggregationHandlerAsString(t *testing.T) {
+	const agg = `
+name: last_seen
+type: max
+field: "@timestamp"
+value_as_string_label: date
+`
+	lines, err := handleAggregation(t, agg, `{"value": 1704067200000, "value_as_string": "2024-01-01T00:00:00.000Z"}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{date="2024-01-01T00:00:00.000Z"} 1704067200000`)
+
+	lines, _ = handleAggregation(t, agg, `{"value": 42}`)
+	assertLines(t, lines, `{date="42"} 42`)
+
+	lines, _ = handleAggregation(t, "name: last_seen\ntype: max\nfield: \"@timestamp\"",
+		`{"value": 1704067200000, "value_as_string": "2024-01-01T00:00:00.000Z"}`)
+	assertLines(t, lines, `{} 1704067200000`)
+}
+
+func TestTermsAggregationHandlerKeyRegex(t *testing.T) {
+	lines, err := handleAggregation(t, `
+name: index
+type: terms
+field: _index
+key_regex: '-\d{4}\.\d{2}\.\d{2}$'
+`, `{"buckets": [
+  {"key": "logs-2024.01.01", "doc_count": 3},
+  {"key": "metrics-2024.01.01", "doc_count": 2},
+  {"key": "logs-2024.01.02", "doc_count": 4}
+]}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	// Daily indices of the same data stream add up.
+	assertLines(t, lines, `{index="logs"} 7`, `{index="metrics"} 2`)
+
+	lines, _ = handleAggregation(t, `
+name: index
+type: terms
+field: _index
+key_regex: '^(\w+)-.*$'
+key_replacement: 'stream_${1}'
+`, `{"buckets": [{"key": "logs-2024.01.01", "doc_count": 3}]}`)
+	assertLines(t, lines, `{index="stream_logs"} 3`)
+}
+
+func TestSingleValueAggregationHandlers(t *testing.T) {
+	for _, typ := range []string{"max", "min", "sum", "avg"} {
+		lines, err := handleAggregation(t, "name: latency\ntype: "+typ+"\nfield: latency", `{"value": 42.5}`)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", typ, err)
+		}
+		assertLines(t, lines, `{} 42.5`)
+	}
+}
+
+func TestDateHistogramAggregationHandler(t *testing.T) {
+	const (
+		agg = `
+name: day
+type: date_histogram
+field: "@timestamp"
+calendar_interval: 1d
+`
+		result = `{"buckets": [
+  {"key_as_string": "2024-01-01", "key": 1704067200000, "doc_count": 3},
+  {"key_as_string": "2024-01-02", "key": 1704153600000, "doc_count": 5},
+  {"key": 1704240000000, "doc_count": 2}
+]}`
+	)
+	lines, err := handleAggregation(t, agg, result)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{day="2024-01-01"} 3`, `{day="2024-01-02"} 5`, `{day="1704240000000"} 2`)
+
+	lines, err = handleAggregation(t, agg+"buckets: latest\n", result)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{} 2`)
+
+	lines, _ = handleAggregation(t, agg+"buckets: latest\n", `{"buckets": []}`)
+	assertLines(t, lines)
+}
+
+func TestHistogramAggregationHandler(t *testing.T) {
+	lines, err := handleAggregation(t, `
+name: size
+type: histogram
+field: size
+interval: 0.5
+`, `{"buckets": [
+  {"key": 0.0, "doc_count": 1},
+  {"key": 0.5, "doc_count": 4},
+  {"key": 1.0, "doc_count": 0},
+  {"key": 1.5, "doc_count": 2},
+  {"key": 2000000.0, "doc_count": 3}
+]}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	// Integer keys lose their trailing zeros, and don't switch to exponent notation.
+	assertLines(t, lines, `{size="0"} 1`, `{size="0.5"} 4`, `{size="1"} 0`, `{size="1.5"} 2`, `{size="2000000"} 3`)
+}
+
+func TestFiltersAggregationHandler(t *testing.T) {
+	const agg = `
+name: level
+type: filters
+filters:
+  errors: "level:error"
+  warnings: "level:warning"
+`
+	// Keyed buckets, in response order.
+	lines, err := handleAggregation(t, agg, `{"buckets": {
+  "errors": {"doc_count": 3},
+  "warnings": {"doc_count": 7}
+}}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{level="errors"} 3`, `{level="warnings"} 7`)
+
+	lines, err = handleAggregation(t, agg+"other_bucket: true\n", `{"buckets": {
+  "errors": {"doc_count": 3},
+  "warnings": {"doc_count": 7},
+  "_other_": {"doc_count": 90}
+}}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{level="errors"} 3`, `{level="warnings"} 7`, `{level="_other_"} 90`)
+
+	// Anonymous buckets, the other bucket last.
+	lines, err = handleAggregation(t, agg+"other_bucket: true\n", `{"buckets": [
+  {"doc_count": 3},
+  {"doc_count": 7},
+  {"doc_count": 90}
+]}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{level="0"} 3`, `{level="1"} 7`, `{level="_other_"} 90`)
+
+	lines, err = handleAggregation(t, agg, `{"buckets": [{"doc_count": 3}, {"doc_count": 7}]}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{level="0"} 3`, `{level="1"} 7`)
+}
+
+func TestMissingAggregationHandler(t *testing.T) {
+	const agg = `
+name: no_user
+type: missing
+field: user
+`
+	lines, err := handleAggregation(t, agg, `{"doc_count": 12}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{} 12`)
+
+	lines, err = handleAggregation(t, agg, `{"doc_count": "12"}`)
+	if err == nil || !strings.Contains(err.Error(), `non-numeric doc_count "12" of aggregation no_user`) {
+		t.Errorf("got error %v, want non-numeric doc_count", err)
+	}
+	assertLines(t, lines)
+}
+
+func TestDerivativeAggregationHandler(t *testing.T) {
+	const agg = `
+name: growth
+type: derivative
+buckets_path: _count
+`
+	for _, result := range []string{`{}`, `{"value": null}`} {
+		lines, err := handleAggregation(t, agg, result)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", result, err)
+		}
+		assertLines(t, lines)
+	}
+
+	lines, err := handleAggregation(t, agg, `{"value": -2.5}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{} -2.5`)
+}
+
+func TestSignificantTermsAggregationHandler(t *testing.T) {
+	const (
+		agg = `
+name: error
+type: significant_terms
+field: error
+`
+		result = `{"doc_count": 100, "bg_count": 5000, "buckets": [
+  {"key": "timeout", "doc_count": 40, "score": 1.25, "bg_count": 200},
+  {"key": "refused", "doc_count": 10, "score": 0.5, "bg_count": 150}
+]}`
+	)
+	for _, tc := range []struct {
+		value string
+		want  []string
+	}{
+		{"", []string{`{error="timeout"} 1.25`, `{error="refused"} 0.5`}},
+		{"score", []string{`{error="timeout"} 1.25`, `{error="refused"} 0.5`}},
+		{"doc_count", []string{`{error="timeout"} 40`, `{error="refused"} 10`}},
+		{"bg_count", []string{`{error="timeout"} 200`, `{error="refused"} 150`}},
+	} {
+		text := agg
+		if tc.value != "" {
+			text += "significant_value: " + tc.value + "\n"
+		}
+		lines, err := handleAggregation(t, text, result)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.value, err)
+		}
+		assertLines(t, lines, tc.want...)
+	}
+
+	lines, err := handleAggregation(t, agg, `{"buckets": [{"key": "timeout", "doc_count": 40}, {"key": "refused", "score": 0.5}]}`)
+	if err == nil || !strings.Contains(err.Error(), `for key "timeout" of aggregation error`) {
+		t.Errorf("got error %v, want a non-numeric score error", err)
+	}
+	assertLines(t, lines, `{error="refused"} 0.5`)
+}
+
+func TestPercentilesAggregationHandler(t *testing.T) {
+	const agg = "name: latency\ntype: percentiles\nfield: latency"
+	for _, result := range []string{
+		`{"values": {"50.0": 0.2, "95.0": 0.9, "99.0": 1.5, "99.9": null}}`,
+		`{"values": [{"key": 50.0, "value": 0.2}, {"key": 95.0, "value": 0.9}, {"key": 99.0, "value": 1.5}, {"key": 99.9, "value": "NaN"}]}`,
+	} {
+		lines, err := handleAggregation(t, agg, result)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		assertLines(t, lines, `{quantile="0.5"} 0.2`, `{quantile="0.95"} 0.9`, `{quantile="0.99"} 1.5`)
+	}
+
+	// No documents.
+	lines, _ := handleAggregation(t, agg, `{"values": {"50.0": null, "99.0": null}}`)
+	assertLines(t, lines)
+}
+
+func TestPercentileRanksAggregationHandler(t *testing.T) {
+	const agg = `
+name: latency_ranks
+type: percentile_ranks
+field: latency
+values: [100, 500.5]
+`
+	for _, result := range []string{
+		`{"values": {"100.0": 45.5, "500.5": 90}}`,
+		`{"values": [{"key": 100.0, "value": 45.5}, {"key": 500.5, "value": 90}]}`,
+	} {
+		lines, err := handleAggregation(t, agg, result)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", result, err)
+		}
+		assertLines(t, lines, `{value="100"} 45.5`, `{value="500.5"} 90`)
+	}
+
+	// No documents to rank against.
+	for _, result := range []string{
+		`{"values": {"100.0": null, "500.5": "NaN"}}`,
+		`{"values": [{"key": 100.0, "value": null}, {"key": 500.5, "value": "NaN"}]}`,
+	} {
+		lines, err := handleAggregation(t, agg, result)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", result, err)
+		}
+		assertLines(t, lines)
+	}
+}
+
+func TestRangeAggregationHandler(t *testing.T) {
+	const agg = `
+name: latency
+type: range
+field: latency
+ranges:
+  - to: 100
+  - key: medium
+    from: 100
+    to: 500.5
+  - from: 500.5
+`
+	for _, result := range []string{
+		`{"buckets": [
+  {"key": "*-100.0", "to": 100, "doc_count": 7},
+  {"key": "medium", "from": 100, "to": 500.5, "doc_count": 3},
+  {"key": "500.5-*", "from": 500.5, "doc_count": 1}
+]}`,
+		// Without keys, e.g. from a proxy stripping them.
+		`{"buckets": [
+  {"to": 100, "doc_count": 7},
+  {"key": "medium", "from": 100, "to": 500.5, "doc_count": 3},
+  {"from": 500.5, "doc_count": 1}
+]}`,
+		// Keyed response.
+		`{"buckets": {
+  "*-100.0": {"to": 100, "doc_count": 7},
+  "medium": {"from": 100, "to": 500.5, "doc_count": 3},
+  "500.5-*": {"from": 500.5, "doc_count": 1}
+}}`,
+	} {
+		lines, err := handleAggregation(t, agg, result)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		assertLines(t, lines, `{latency="*-100.0"} 7`, `{latency="medium"} 3`, `{latency="500.5-*"} 1`)
+	}
+}
+
+func TestRegisterAggregationHandler(t *testing.T) {
+	const builtIn = 22
+	if got := testutil.ToFloat64(aggregationHandlerTypes); got != builtIn {
+		t.Errorf("got %g aggregation handler types, want %d built-in ones", got, builtIn)
+	}
+
+	custom := config.AggregationType("custom")
+	maxFactory := aggregationHandlers[config.AggregationTypeMax]
+	t.Cleanup(func() {
+		aggregationHandlersMu.Lock()
+		delete(aggregationHandlers, custom)
+		aggregationHandlers[config.AggregationTypeMax] = maxFactory
+		aggregationHandlersMu.Unlock()
+		aggregationHandlerTypes.Set(builtIn)
+	})
+
+	RegisterAggregationHandler(custom, newSingleValueAggregationHandler)
+	if got := testutil.ToFloat64(aggregationHandlerTypes); got != builtIn+1 {
+		t.Errorf("got %g aggregation handler types after registering a custom one, want %d", got, builtIn+1)
+	}
+	// Replacing a built-in handler doesn't add a type.
+	RegisterAggregationHandler(config.AggregationTypeMax, func(agg *config.AggregationConfig) AggregationHandler {
+		return &AllFieldsAggregationHandler{}
+	})
+	if got := testutil.ToFloat64(aggregationHandlerTypes); got != builtIn+1 {
+		t.Errorf("got %g aggregation handler types after replacing a built-in one, want %d", got, builtIn+1)
+	}
+	lines, _ := handleAggregation(t, "name: latency\ntype: max\nfield: latency", `{"value": 42.5}`)
+	assertLines(t, lines, `{field="value"} 42.5`)
+}
+
+func TestExtendedStatsAggregationHandler(t *testing.T) {
+	const result = `{"count": 4, "min": 1, "max": 9, "avg": 4.5, "sum": 18, "sum_of_squares": 110, "variance": 7.25,
+  "std_deviation": 2.69, "std_deviation_bounds": {"upper": 9.88, "lower": -0.88}}`
+	lines, err := handleAggregation(t, "name: latency\ntype: extended_stats\nfield: latency\nstat_label: stat", result)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines,
+		`{stat="count"} 4`,
+		`{stat="min"} 1`,
+		`{stat="max"} 9`,
+		`{stat="avg"} 4.5`,
+		`{stat="sum"} 18`,
+		`{stat="sum_of_squares"} 110`,
+		`{stat="variance"} 7.25`,
+		`{stat="std_deviation"} 2.69`)
+
+	// Without documents, min, max and friends are null.
+	lines, _ = handleAggregation(t, "name: latency\ntype: extended_stats\nfield: latency",
+		`{"count": 0, "min": null, "max": null, "avg": null, "sum": 0}`)
+	assertLines(t, lines, `{latency="count"} 0`, `{latency="sum"} 0`)
+}
+
+func TestStatsAggregationHandlerLabel(t *testing.T) {
+	const result = `{"count": 2, "min": 1, "max": 3, "avg": 2, "sum": 4}`
+	latency, _ := handleAggregation(t, "name: latency\ntype: stats\nfield: latency", result)
+	size, _ := handleAggregation(t, "name: size\ntype: stats\nfield: size", result)
+	// Distinct label keys, so that the stats of both don't collide.
+	assertLines(t, latency, `{latency="count"} 2`, `{latency="min"} 1`, `{latency="max"} 3`, `{latency="avg"} 2`, `{latency="sum"} 4`)
+	assertLines(t, size, `{size="count"} 2`, `{size="min"} 1`, `{size="max"} 3`, `{size="avg"} 2`, `{size="sum"} 4`)
+
+	lines, _ := handleAggregation(t, "name: latency\ntype: stats\nfield: latency\nstat_label: stat", result)
+	assertLines(t, lines, `{stat="count"} 2`, `{stat="min"} 1`, `{stat="max"} 3`, `{stat="avg"} 2`, `{stat="sum"} 4`)
+}
+
+func TestValueCountAggregationHandler(t *testing.T) {
+	lines, err := handleAggregation(t, "name: users\ntype: value_count\nfield: user_id", `{"value": 7}`)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertLines(t, lines, `{} 7`)
+}
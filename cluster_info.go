@@ -0,0 +1,72 @@
+package elastic_exporter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/tidwall/gjson"
+)
+
+// clusterInfo is the subset of the Info API response used by the exporter.
+type clusterInfo struct {
+	clusterName string
+	version     string
+}
+
+// clusterInfoCache caches the cluster info of a target for a TTL, so that features relying on it don't call the Info
+// API on every scrape. It is safe for concurrent use.
+type clusterInfoCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	info      *clusterInfo
+	fetchedAt time.Time
+}
+
+// newClusterInfoCache returns a clusterInfoCache keeping the cluster info for ttl. A zero ttl disables caching.
+func newClusterInfoCache(ttl time.Duration) *clusterInfoCache {
+	return &clusterInfoCache{ttl: ttl, now: time.Now}
+}
+
+// Get returns the cached cluster info, fetching it with the given client if missing or expired.
+func (c *clusterInfoCache) Get(ctx context.Context, client *elasticsearch.Client) (*clusterInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.info != nil && c.now().Sub(c.fetchedAt) < c.ttl {
+		return c.info, nil
+	}
+
+	res, err := client.Info(client.Info.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("cluster info request failed with status code %d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	c.info = &clusterInfo{
+		clusterName: gjson.GetBytes(body, "cluster_name").String(),
+		version:     gjson.GetBytes(body, "version.number").String(),
+	}
+	c.fetchedAt = c.now()
+	return c.info, nil
+}
+
+// Reset drops the cached cluster info, e.g. when the client is recreated.
+func (c *clusterInfoCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.info = nil
+}
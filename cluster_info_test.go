@@ -0,0 +1,89 @@
+package elastic_exporter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+const infoResponse = `{"cluster_name": "logs", "version": {"number": "7.17.0"}}`
+
+func TestClusterInfoCacheTTL(t *testing.T) {
+	server := newTestServer(t, respondJSON(infoResponse))
+	client := server.esClient(t)
+
+	now := time.Unix(0, 0)
+	c := newClusterInfoCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	get := func() {
+		t.Helper()
+		info, err := c.Get(context.Background(), client)
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		if info.clusterName != "logs" || info.version != "7.17.0" {
+			t.Fatalf("got cluster info %+v", *info)
+		}
+	}
+	assertCalls := func(want int) {
+		t.Helper()
+		if got := len(server.Requests()); got != want {
+			t.Fatalf("got %d Info calls, want %d", got, want)
+		}
+	}
+
+	get()
+	get()
+	assertCalls(1)
+
+	now = now.Add(59 * time.Second)
+	get()
+	assertCalls(1)
+
+	now = now.Add(time.Second)
+	get()
+	get()
+	assertCalls(2)
+
+	c.Reset()
+	get()
+	assertCalls(3)
+}
+
+func TestClusterInfoCacheConcurrent(t *testing.T) {
+	server := newTestServer(t, respondJSON(infoResponse))
+	client := server.esClient(t)
+	c := newClusterInfoCache(time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get(context.Background(), client); err != nil {
+				t.Errorf("Get: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(server.Requests()); got != 1 {
+		t.Errorf("got %d Info calls, want 1", got)
+	}
+}
+
+func TestClusterInfoCacheDisabled(t *testing.T) {
+	server := newTestServer(t, respondJSON(infoResponse))
+	client := server.esClient(t)
+	c := newClusterInfoCache(0)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get(context.Background(), client); err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+	}
+	if got := len(server.Requests()); got != 3 {
+		t.Errorf("got %d Info calls, want 3", got)
+	}
+}
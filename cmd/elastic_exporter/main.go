@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	log "github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
@@ -60,14 +62,47 @@ func main() {
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "OK", http.StatusOK) })
 	http.HandleFunc("/", HomeHandlerFunc(*metricsPath))
 	http.HandleFunc("/config", ConfigHandlerFunc(*metricsPath, exporter))
+	http.HandleFunc("/-/reload", ReloadHandlerFunc(exporter))
 	http.Handle(*metricsPath, ExporterHandlerFor(exporter))
 	// Expose exporter metrics separately, for debugging purposes.
 	http.Handle("/elastic_exporter_metrics", promhttp.Handler())
 
+	// Reload the configuration on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload(exporter)
+		}
+	}()
+
 	log.Infof("Listening on %s", *listenAddress)
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
 
+// ReloadHandlerFunc returns a HTTP handler reloading the exporter's configuration on POST requests.
+func ReloadHandlerFunc(exporter elastic_exporter.Exporter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(exporter); err != nil {
+			http.Error(w, "Failed to reload config: "+err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// reload reloads the exporter's configuration, logging the outcome.
+func reload(exporter elastic_exporter.Exporter) error {
+	if err := exporter.Reload(); err != nil {
+		log.Errorf("Error reloading config, keeping the previous one: %s", err)
+		return err
+	}
+	log.Infof("Reloaded config from %s", *configFile)
+	return nil
+}
+
 // LogFunc is an adapter to allow the use of any function as a promhttp.Logger. If f is a function, LogFunc(f) is a
 // promhttp.Logger that calls f.
 type LogFunc func(args ...interface{})
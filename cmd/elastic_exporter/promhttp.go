@@ -30,6 +30,9 @@ func ExporterHandlerFor(exporter elastic_exporter.Exporter) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		ctx, cancel := contextFor(req, exporter)
 		defer cancel()
+		if noCacheRequested(req) {
+			ctx = elastic_exporter.WithNoCache(ctx)
+		}
 
 		// Go through prometheus.Gatherers to sanitize and sort metrics.
 		gatherer := prometheus.Gatherers{exporter.WithContext(ctx)}
@@ -104,6 +107,25 @@ func contextFor(req *http.Request, exporter elastic_exporter.Exporter) (context.
 	return context.WithTimeout(context.Background(), timeout)
 }
 
+// noCacheRequested returns true if the request asks for fresh metrics via the `nocache` query parameter or its
+// `refresh` alias, e.g. `/metrics?nocache=1` or `/metrics?refresh=true`.
+func noCacheRequested(req *http.Request) bool {
+	for _, param := range []string{"nocache", "refresh"} {
+		v := req.URL.Query().Get(param)
+		if v == "" {
+			continue
+		}
+		bypass, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Errorf("Failed to parse %s (`%s`) query parameter: %s", param, v, err)
+		}
+		if bypass {
+			return true
+		}
+	}
+	return false
+}
+
 var bufPool sync.Pool
 
 func getBuf() *bytes.Buffer {
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNoCacheRequested(t *testing.T) {
+	for query, want := range map[string]bool{
+		"":               false,
+		"?nocache=1":     true,
+		"?nocache=true":  true,
+		"?nocache=0":     false,
+		"?nocache=maybe": false,
+		"?refresh=true":  true,
+		"?refresh=false": false,
+		// Either one is enough.
+		"?nocache=0&refresh=1": true,
+	} {
+		req := httptest.NewRequest("GET", "/metrics"+query, nil)
+		if got := noCacheRequested(req); got != want {
+			t.Errorf("noCacheRequested(%q) = %t, want %t", query, got, want)
+		}
+	}
+}
@@ -8,11 +8,31 @@ import (
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"iss.digital/mt/elastic_exporter/config"
 	"iss.digital/mt/elastic_exporter/errors"
 )
 
+var (
+	// cacheHits counts the collections of caching collectors served from the cache, by collector.
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "elastic_exporter",
+		Name:      "collector_cache_hits_total",
+		Help:      "Number of collections served from the cache of collectors with a min_interval, by collector.",
+	}, []string{"collector"})
+	// cacheMisses counts the collections of caching collectors that ran the queries, by collector.
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "elastic_exporter",
+		Name:      "collector_cache_misses_total",
+		Help:      "Number of collections of collectors with a min_interval that ran the queries, by collector.",
+	}, []string{"collector"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses)
+}
+
 // Collector is a self-contained group of ElasticSearch queries and metric families to collect from a specific instance. It is
 // conceptually similar to a prometheus.Collector.
 type Collector interface {
@@ -24,34 +44,39 @@ type Collector interface {
 type collector struct {
 	config     *config.CollectorConfig
 	queries    []*Query
+	querySem   chan struct{} // limits the number of queries run concurrently, nil if unlimited
 	logContext string
 }
 
 // NewCollector returns a new Collector with the given configuration and database. The metrics it creates will all have
 // the provided const filters applied.
-func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*dto.LabelPair) (Collector, errors.WithContext) {
+func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*dto.LabelPair, gc *config.GlobalConfig) (
+	Collector, errors.WithContext) {
 	logContext = fmt.Sprintf("%s, collector=%q", logContext, cc.Name)
 
 	// Maps each query to the list of metric families it populates.
 	queryMFs := make(map[*config.QueryConfig][]*MetricFamily, len(cc.Metrics))
+	// Queries in order of their first appearance, to keep the emission order stable.
+	queryOrder := make([]*config.QueryConfig, 0, len(cc.Metrics))
 
 	// Instantiate metric families.
 	for _, mc := range cc.Metrics {
-		mf, err := NewMetricFamily(logContext, mc, constLabels)
+		mf, err := NewMetricFamily(logContext, mc, constLabels, gc)
 		if err != nil {
 			return nil, err
 		}
 		mfs, found := queryMFs[mc.Query()]
 		if !found {
 			mfs = make([]*MetricFamily, 0, 2)
+			queryOrder = append(queryOrder, mc.Query())
 		}
 		queryMFs[mc.Query()] = append(mfs, mf)
 	}
 
 	// Instantiate queries.
 	queries := make([]*Query, 0, len(cc.Metrics))
-	for qc, mfs := range queryMFs {
-		q, err := NewQuery(logContext, qc, mfs...)
+	for _, qc := range queryOrder {
+		q, err := NewQuery(logContext, cc.Name, qc, constLabels, gc, queryMFs[qc]...)
 		if err != nil {
 			return nil, err
 		}
@@ -63,9 +88,12 @@ func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*
 		queries:    queries,
 		logContext: logContext,
 	}
+	if cc.MaxQueries > 0 {
+		c.querySem = make(chan struct{}, cc.MaxQueries)
+	}
 	if c.config.MinInterval > 0 {
 		log.V(2).Infof("[%s] Non-zero min_interval (%s), using cached collector.", logContext, c.config.MinInterval)
-		return newCachingCollector(&c), nil
+		return newCachingCollector(&c, gc.MetricChanCap), nil
 	}
 	return &c, nil
 }
@@ -77,6 +105,14 @@ func (c *collector) Collect(ctx context.Context, client *elasticsearch.Client, c
 	for _, q := range c.queries {
 		go func(q *Query) {
 			defer wg.Done()
+			if c.querySem != nil {
+				select {
+				case c.querySem <- struct{}{}:
+					defer func() { <-c.querySem }()
+				case <-ctx.Done():
+					// Out of time waiting for our turn, the query will only report the context error.
+				}
+			}
 			q.Collect(ctx, client, ch)
 		}(q)
 	}
@@ -84,11 +120,35 @@ func (c *collector) Collect(ctx context.Context, client *elasticsearch.Client, c
 	wg.Wait()
 }
 
-// newCachingCollector returns a new Collector wrapping the provided raw Collector.
-func newCachingCollector(rawColl *collector) Collector {
+// countErrors counts a failure of all the collector's queries, for when none of them could run.
+func (c *collector) countErrors() {
+	for _, q := range c.queries {
+		q.errorCount.Inc()
+	}
+}
+
+// noCacheKey is the context key marking a scrape that must bypass collector caches.
+type noCacheKey struct{}
+
+// WithNoCache returns a copy of ctx making caching collectors collect fresh metrics (and refresh their cache) regardless
+// of min_interval.
+func WithNoCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+// noCache returns true if ctx was created by WithNoCache.
+func noCache(ctx context.Context) bool {
+	bypass, _ := ctx.Value(noCacheKey{}).(bool)
+	return bypass
+}
+
+// newCachingCollector returns a new Collector wrapping the provided raw Collector, collecting fresh metrics through a
+// channel of the given capacity.
+func newCachingCollector(rawColl *collector, chanCap int) Collector {
 	cc := &cachingCollector{
 		rawColl:     rawColl,
 		minInterval: time.Duration(rawColl.config.MinInterval),
+		chanCap:     chanCap,
 		cacheSem:    make(chan time.Time, 1),
 	}
 	cc.cacheSem <- time.Time{}
@@ -101,6 +161,8 @@ type cachingCollector struct {
 	rawColl *collector
 	// Convenience copy of rawColl.config.MinInterval.
 	minInterval time.Duration
+	// Capacity of the channel fresh metrics are collected through.
+	chanCap int
 
 	// Used as a non=blocking semaphore protecting the cache. The value in the channel is the time of the cached metrics.
 	cacheSem chan time.Time
@@ -111,7 +173,8 @@ type cachingCollector struct {
 // Collect implements Collector.
 func (cc *cachingCollector) Collect(ctx context.Context, client *elasticsearch.Client, ch chan<- Metric) {
 	if ctx.Err() != nil {
-		ch <- NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err()))
+		cc.rawColl.countErrors()
+		send(ctx, ch, NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err())))
 		return
 	}
 
@@ -119,11 +182,13 @@ func (cc *cachingCollector) Collect(ctx context.Context, client *elasticsearch.C
 	select {
 	case cacheTime := <-cc.cacheSem:
 		// Have the lock.
-		if age := collTime.Sub(cacheTime); age > cc.minInterval {
-			// Cache contents are older than minInterval, collect fresh metrics, cache them and pipe them through.
-			log.V(2).Infof("[%s] Collecting fresh metrics: min_interval=%.3fs cache_age=%.3fs",
-				cc.rawColl.logContext, cc.minInterval.Seconds(), age.Seconds())
-			cacheChan := make(chan Metric, capMetricChan)
+		if age := collTime.Sub(cacheTime); age > cc.minInterval || noCache(ctx) {
+			// Cache contents are older than minInterval (or bypassed), collect fresh metrics, cache them and pipe them
+			// through.
+			log.V(2).Infof("[%s] Collecting fresh metrics: min_interval=%.3fs cache_age=%.3fs nocache=%t",
+				cc.rawColl.logContext, cc.minInterval.Seconds(), age.Seconds(), noCache(ctx))
+			cacheMisses.WithLabelValues(cc.rawColl.config.Name).Inc()
+			cacheChan := make(chan Metric, cc.chanCap)
 			cc.cache = make([]Metric, 0, len(cc.cache))
 			go func() {
 				cc.rawColl.Collect(ctx, client, cacheChan)
@@ -131,22 +196,23 @@ func (cc *cachingCollector) Collect(ctx context.Context, client *elasticsearch.C
 			}()
 			for metric := range cacheChan {
 				cc.cache = append(cc.cache, metric)
-				ch <- metric
+				send(ctx, ch, metric)
 			}
 			cacheTime = collTime
 		} else {
 			log.V(2).Infof("[%s] Returning cached metrics: min_interval=%.3fs cache_age=%.3fs",
 				cc.rawColl.logContext, cc.minInterval.Seconds(), age.Seconds())
+			cacheHits.WithLabelValues(cc.rawColl.config.Name).Inc()
 			for _, metric := range cc.cache {
-				ch <- metric
+				send(ctx, ch, metric)
 			}
 		}
 		// Always replace the value in the semaphore channel.
 		cc.cacheSem <- cacheTime
 
 	case <-ctx.Done():
-		// Context closed, record an error and return
-		// TODO: increment an error counter
-		ch <- NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err()))
+		// Context closed (waiting for a concurrent collection to fill the cache), record an error and return.
+		cc.rawColl.countErrors()
+		send(ctx, ch, NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err())))
 	}
 }
@@ -0,0 +1,155 @@
+package elastic_exporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// cachedCollector returns a caching collector along with a fake ElasticSearch answering with the number of requests
+// received so far as total hits.
+func cachedCollector(t *testing.T, name string) (Collector, *testServer) {
+	t.Helper()
+	var runs int32
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(fmt.Sprintf(`{"hits": {"total": {"value": %d}}}`, atomic.AddInt32(&runs, 1)))(w, r)
+	})
+	c := mustCollector(t, `
+collector_name: `+name+`
+min_interval: 1h
+queries:
+  - query_name: runs
+    query: "*"
+metrics:
+  - metric_name: runs
+    type: gauge
+    help: Query runs.
+    query_ref: runs
+    track_total: true
+`, mustGlobalConfig(t, ""))
+	return c, server
+}
+
+// collectRuns collects c and returns its `runs` samples.
+func collectRuns(ctx context.Context, t *testing.T, c Collector, server *testServer) []string {
+	client := server.esClient(t)
+	return linesOf(formatMetrics(collectMetrics(func(ch chan<- Metric) {
+		c.Collect(ctx, client, ch)
+	})), "runs")
+}
+
+func TestCachingCollectorNoCache(t *testing.T) {
+	c, server := cachedCollector(t, "nocache")
+	ctx := context.Background()
+
+	assertLines(t, collectRuns(ctx, t, c, server), "runs 1")
+	assertLines(t, collectRuns(ctx, t, c, server), "runs 1")
+	// Collected afresh despite min_interval...
+	assertLines(t, collectRuns(WithNoCache(ctx), t, c, server), "runs 2")
+	// ...and cached.
+	assertLines(t, collectRuns(ctx, t, c, server), "runs 2")
+
+	if got := len(server.Requests()); got != 2 {
+		t.Errorf("got %d queries, want 2", got)
+	}
+}
+
+func TestCachingCollectorErrors(t *testing.T) {
+	c, server := cachedCollector(t, "errors")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	before := testutil.ToFloat64(queryErrors.WithLabelValues("errors", "runs"))
+	collectRuns(ctx, t, c, server)
+	if got := testutil.ToFloat64(queryErrors.WithLabelValues("errors", "runs")) - before; got != 1 {
+		t.Errorf("got %v errors, want 1", got)
+	}
+	if got := len(server.Requests()); got != 0 {
+		t.Errorf("got %d queries, want none", got)
+	}
+}
+
+func TestCachingCollectorHits(t *testing.T) {
+	c, server := cachedCollector(t, "hits")
+	ctx := context.Background()
+
+	hitsBefore := testutil.ToFloat64(cacheHits.WithLabelValues("hits"))
+	missesBefore := testutil.ToFloat64(cacheMisses.WithLabelValues("hits"))
+	assertLines(t, collectRuns(ctx, t, c, server), "runs 1")
+	assertLines(t, collectRuns(ctx, t, c, server), "runs 1")
+	if got := testutil.ToFloat64(cacheMisses.WithLabelValues("hits")) - missesBefore; got != 1 {
+		t.Errorf("got %v cache misses, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheHits.WithLabelValues("hits")) - hitsBefore; got != 1 {
+		t.Errorf("got %v cache hits, want 1", got)
+	}
+}
+
+func TestCollectorMaxConcurrentQueries(t *testing.T) {
+	for _, tc := range []struct {
+		max  int
+		want int
+	}{
+		{2, 2},
+		// Unlimited.
+		{0, 4},
+	} {
+		t.Run(fmt.Sprint(tc.max), func(t *testing.T) {
+			text := fmt.Sprintf("collector_name: test\nmax_concurrent_queries: %d\nqueries:\n", tc.max)
+			for i := 0; i < 4; i++ {
+				text += fmt.Sprintf("  - query_name: q%d\n    query: \"*\"\n", i)
+			}
+			text += "metrics:\n"
+			for i := 0; i < 4; i++ {
+				text += fmt.Sprintf("  - metric_name: hits%d\n    type: gauge\n    help: Hits.\n    query_ref: q%d\n    track_total: true\n", i, i)
+			}
+
+			var (
+				mu            sync.Mutex
+				running, peak int
+			)
+			lines, _ := runCollector(t, text, nil, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				running++
+				if running > peak {
+					peak = running
+				}
+				mu.Unlock()
+				time.Sleep(50 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				respondJSON(`{"hits": {"total": {"value": 1}}}`)(w, r)
+			})
+			assertLines(t, errorLines(lines))
+			if peak != tc.want {
+				t.Errorf("got a peak of %d concurrent queries, want %d", peak, tc.want)
+			}
+		})
+	}
+}
+
+func TestCachingCollectorChannelCapacity(t *testing.T) {
+	c := mustCollector(t, `
+collector_name: test
+min_interval: 1h
+queries:
+  - query_name: runs
+    query: "*"
+metrics:
+  - metric_name: runs
+    type: gauge
+    help: Query runs.
+    query_ref: runs
+    track_total: true
+`, mustGlobalConfig(t, "metric_channel_capacity: 7"))
+	if got := c.(*cachingCollector).chanCap; got != 7 {
+		t.Errorf("got a channel capacity of %d, want 7", got)
+	}
+}
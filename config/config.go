@@ -1,10 +1,15 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
 	"time"
 
 	log "github.com/golang/glog"
@@ -135,11 +140,46 @@ func (c *Config) loadCollectorFiles() error {
 	return nil
 }
 
+// metricNameRE matches valid Prometheus metric names.
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// invalidLabelCharRE matches characters not allowed in Prometheus label names.
+var invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
 // GlobalConfig contains globally applicable defaults.
 type GlobalConfig struct {
-	MinInterval   model.Duration `yaml:"min_interval"`          // minimum interval between query executions, default is 0
-	ScrapeTimeout model.Duration `yaml:"scrape_timeout"`        // per-scrape timeout, global
-	TimeoutOffset model.Duration `yaml:"scrape_timeout_offset"` // offset to subtract from timeout in seconds
+	MinInterval           model.Duration `yaml:"min_interval"`            // minimum interval between query executions, default is 0
+	ScrapeTimeout         model.Duration `yaml:"scrape_timeout"`          // per-scrape timeout, global
+	TimeoutOffset         model.Duration `yaml:"scrape_timeout_offset"`   // offset to subtract from timeout in seconds
+	WarmupTimeout         model.Duration `yaml:"warmup_timeout"`          // timeout for connecting to targets at startup, 0 disables warmup
+	HealthTimeout         model.Duration `yaml:"health_timeout"`          // timeout of the cluster health check preceding each scrape, 0 means the scrape timeout applies
+	HealthWaitFor         string         `yaml:"health_wait_for_status"`  // status the cluster health check waits for (up to health_timeout, required): green, yellow or red; none if empty
+	HealthLevel           string         `yaml:"health_level"`            // level of detail of the cluster health check: cluster (default), indices or shards
+	HealthScope           string         `yaml:"health_scope"`            // cluster (default), or indices for the health of the indices queried by the target only
+	MaxResponse           int64          `yaml:"max_response_bytes"`      // maximum size of a query response, 0 means unlimited
+	MinStatus             string         `yaml:"min_cluster_status"`      // minimum cluster health status for a target to be up: green, yellow or red (default)
+	MetricPrefix          string         `yaml:"metric_prefix"`           // prefix applied to all exported metric names, e.g. `myapp_`
+	TookMillis            bool           `yaml:"took_milliseconds"`       // export the query `took` time in raw milliseconds rather than seconds
+	InfoTTL               model.Duration `yaml:"cluster_info_ttl"`        // how long to cache targets' cluster info (name, version), 0 means no caching
+	MetricUp              bool           `yaml:"metric_up"`               // export a `metric_up` gauge per metric, 0 if its query failed
+	MaxTargets            int            `yaml:"max_concurrent_targets"`  // maximum number of targets scraped concurrently, 0 means unlimited
+	MetricChanCap         int            `yaml:"metric_channel_capacity"` // capacity of the channels metrics are collected through, default 1000
+	DurationBuckets       []float64      `yaml:"query_duration_buckets"`  // buckets of the query_duration_seconds histogram, Prometheus defaults if empty
+	UserAgent             string         `yaml:"user_agent"`              // User-Agent sent to targets, may reference `{{ .target }}` and `{{ .version }}`
+	QueryRetries          int            `yaml:"query_retries"`           // number of times a failed query is retried, default 0
+	RetryBudget           int            `yaml:"retry_budget"`            // maximum number of query retries across a target scrape, 0 means unlimited
+	RetryBackoff          model.Duration `yaml:"retry_backoff"`           // delay before the first query retry, doubled on each subsequent one, 0 means retry immediately
+	CompressRequestBody   bool           `yaml:"compress_request_body"`   // gzip query bodies sent to targets; responses are decompressed transparently either way
+	CompressionLevel      int            `yaml:"compression_level"`       // gzip level of request bodies, 1 (fastest) to 9 (smallest), 0 means the gzip default
+	MaxIdleConns          int            `yaml:"max_idle_conns"`          // maximum number of idle connections kept open to all nodes of a target, 0 means the Go default
+	MaxIdleConnsPerHost   int            `yaml:"max_idle_conns_per_host"` // maximum number of idle connections kept open to each node, 0 means max_idle_conns if set, else the Go default
+	IdleConnTimeout       model.Duration `yaml:"idle_conn_timeout"`       // how long idle connections are kept open, 0 means the Go default
+	ResponseHeaderTimeout model.Duration `yaml:"response_header_timeout"` // timeout of waiting for response headers once a request is sent, 0 means none
+	DialTimeout           model.Duration `yaml:"dial_timeout"`            // timeout of establishing connections, 0 means the Go default
+	ScrapeResult          bool           `yaml:"scrape_result"`           // export a `scrape_result` gauge per target, labeled by status (success or failure)
+
+	minClusterStatus ClusterStatus // MinStatus converted to ClusterStatus
+	healthWaitFor    ClusterStatus // HealthWaitFor converted to ClusterStatus
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -153,6 +193,11 @@ func (g *GlobalConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	g.ScrapeTimeout = model.Duration(60 * time.Second)
 	// Default to .5 seconds.
 	g.TimeoutOffset = model.Duration(500 * time.Millisecond)
+	g.UserAgent = "elastic_exporter/{{ .version }}"
+	// Default to 5 minutes, cluster name and version hardly ever change.
+	g.InfoTTL = model.Duration(5 * time.Minute)
+	// Enough for most collectors not to block on a full channel.
+	g.MetricChanCap = 1000
 
 	type plain GlobalConfig
 	if err := unmarshal((*plain)(g)); err != nil {
@@ -162,20 +207,133 @@ func (g *GlobalConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if g.TimeoutOffset <= 0 {
 		return fmt.Errorf("global.scrape_timeout_offset must be strictly positive, have %s", g.TimeoutOffset)
 	}
+	if g.WarmupTimeout < 0 {
+		return fmt.Errorf("global.warmup_timeout must be non-negative, have %s", g.WarmupTimeout)
+	}
+	if _, err := template.New("user_agent").Parse(g.UserAgent); err != nil {
+		return fmt.Errorf("invalid global.user_agent: %s", err)
+	}
+	if g.HealthTimeout < 0 {
+		return fmt.Errorf("global.health_timeout must be non-negative, have %s", g.HealthTimeout)
+	}
+	if g.InfoTTL < 0 {
+		return fmt.Errorf("global.cluster_info_ttl must be non-negative, have %s", g.InfoTTL)
+	}
+	if !sort.Float64sAreSorted(g.DurationBuckets) {
+		return fmt.Errorf("global.query_duration_buckets must be in increasing order, have %v", g.DurationBuckets)
+	}
+	if g.QueryRetries < 0 {
+		return fmt.Errorf("global.query_retries must be non-negative, have %d", g.QueryRetries)
+	}
+	if g.RetryBudget < 0 {
+		return fmt.Errorf("global.retry_budget must be non-negative, have %d", g.RetryBudget)
+	}
+	if g.RetryBackoff < 0 {
+		return fmt.Errorf("global.retry_backoff must be non-negative, have %s", g.RetryBackoff)
+	}
+	if g.CompressionLevel < 0 || g.CompressionLevel > 9 {
+		return fmt.Errorf("global.compression_level must be between 1 and 9 (or 0 for the default), have %d", g.CompressionLevel)
+	}
+	if g.CompressionLevel != 0 && !g.CompressRequestBody {
+		return fmt.Errorf("global.compression_level requires global.compress_request_body")
+	}
+	if g.MaxIdleConns < 0 || g.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("global.max_idle_conns and max_idle_conns_per_host must be non-negative")
+	}
+	if g.IdleConnTimeout < 0 || g.ResponseHeaderTimeout < 0 || g.DialTimeout < 0 {
+		return fmt.Errorf("global.idle_conn_timeout, response_header_timeout and dial_timeout must be non-negative")
+	}
+	if g.MetricChanCap <= 0 {
+		return fmt.Errorf("global.metric_channel_capacity must be strictly positive, have %d", g.MetricChanCap)
+	}
+	if g.MaxTargets < 0 {
+		return fmt.Errorf("global.max_concurrent_targets must be non-negative, have %d", g.MaxTargets)
+	}
+	if g.MaxResponse < 0 {
+		return fmt.Errorf("global.max_response_bytes must be non-negative, have %d", g.MaxResponse)
+	}
+	if g.MetricPrefix != "" && !metricNameRE.MatchString(g.MetricPrefix) {
+		return fmt.Errorf("global.metric_prefix %q is not a valid metric name prefix", g.MetricPrefix)
+	}
+	switch status := ClusterStatus(strings.ToLower(g.MinStatus)); status {
+	case "":
+		g.minClusterStatus = ClusterStatusRed
+	case ClusterStatusGreen, ClusterStatusYellow, ClusterStatusRed:
+		g.minClusterStatus = status
+	default:
+		return fmt.Errorf("unsupported global.min_cluster_status: %s", g.MinStatus)
+	}
+	switch status := ClusterStatus(strings.ToLower(g.HealthWaitFor)); status {
+	case "", ClusterStatusGreen, ClusterStatusYellow, ClusterStatusRed:
+		g.healthWaitFor = status
+	default:
+		return fmt.Errorf("unsupported global.health_wait_for_status: %s", g.HealthWaitFor)
+	}
+	if g.healthWaitFor != "" && g.HealthTimeout == 0 {
+		// Otherwise ElasticSearch waits for the status for its default of 30 seconds, likely past the scrape timeout.
+		return fmt.Errorf("global.health_wait_for_status requires global.health_timeout")
+	}
+	switch g.HealthLevel {
+	case "", "cluster", "indices", "shards":
+	default:
+		return fmt.Errorf("unsupported global.health_level: %s", g.HealthLevel)
+	}
+	switch g.HealthScope {
+	case "", "cluster", "indices":
+	default:
+		return fmt.Errorf("unsupported global.health_scope: %s", g.HealthScope)
+	}
 
 	return checkOverflow(g.XXX, "global")
 }
 
+// MinClusterStatus returns the minimum cluster health status required for a target to be considered up.
+func (g *GlobalConfig) MinClusterStatus() ClusterStatus {
+	if g.minClusterStatus == "" {
+		return ClusterStatusRed
+	}
+	return g.minClusterStatus
+}
+
+// HealthWaitForStatus returns the status the cluster health check waits for, empty for none.
+func (g *GlobalConfig) HealthWaitForStatus() ClusterStatus {
+	return g.healthWaitFor
+}
+
+// ClusterStatus is an ElasticSearch cluster health status.
+type ClusterStatus string
+
+const (
+	ClusterStatusGreen  = ClusterStatus("green")
+	ClusterStatusYellow = ClusterStatus("yellow")
+	ClusterStatusRed    = ClusterStatus("red")
+)
+
+// ClusterStatuses lists all cluster health statuses, from the healthiest one.
+var ClusterStatuses = []ClusterStatus{ClusterStatusGreen, ClusterStatusYellow, ClusterStatusRed}
+
+// Satisfies returns true if the status is at least as healthy as minStatus. Unknown statuses are considered worse than red.
+func (s ClusterStatus) Satisfies(minStatus ClusterStatus) bool {
+	return s.rank() <= minStatus.rank()
+}
+
+func (s ClusterStatus) rank() int {
+	for i, status := range ClusterStatuses {
+		if s == status {
+			return i
+		}
+	}
+	return len(ClusterStatuses)
+}
+
 //
 // Target
 //
 
 // TargetConfig defines a URL and a set of collectors to be executed on it.
 type TargetConfig struct {
-	URL           Secret   `yaml:"url"` // ElasticSearch URL
-	Username      Secret   `yaml:"username"`
-	Password      Secret   `yaml:"password"`
-	CollectorRefs []string `yaml:"collectors"` // names of collectors to execute on the target
+	DataSourceConfig `yaml:",inline"`
+	CollectorRefs    []string `yaml:"collectors"` // names of collectors to execute on the target
 
 	collectors []*CollectorConfig // resolved collector references
 
@@ -195,9 +353,8 @@ func (t *TargetConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
-	// Check required fields
-	if t.URL == "" {
-		return fmt.Errorf("missing data_source_name for target %+v", t)
+	if err := t.DataSourceConfig.validate("target"); err != nil {
+		return err
 	}
 	checkCollectorRefs(t.CollectorRefs, "target")
 
@@ -247,19 +404,13 @@ func (j *JobConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // StaticConfig defines a set of targets and optional labels to apply to the metrics collected from them.
 type StaticConfig struct {
-	Targets map[string]StaticTargetConfig `yaml:"targets"`          // map of target names to data source names
-	Labels  map[string]string             `yaml:"labels,omitempty"` // labels to apply to all metrics collected from the targets
+	Targets map[string]*DataSourceConfig `yaml:"targets"`          // map of target names to data source names
+	Labels  map[string]string            `yaml:"labels,omitempty"` // labels to apply to all metrics collected from the targets
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
-type StaticTargetConfig struct {
-	Url      Secret `yaml:"url"`
-	Username Secret `yaml:"username"`
-	Password Secret `yaml:"password"`
-}
-
 // UnmarshalYAML implements the yaml.Unmarshaler interface for StaticConfig.
 func (s *StaticConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain StaticConfig
@@ -278,28 +429,146 @@ func (s *StaticConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			return fmt.Errorf("duplicate target name %q in static_config %+v", tname, s)
 		}
 		tnames[tname] = nil
-		if cfgs.Url == "" {
+		if cfgs == nil {
 			return fmt.Errorf("empty data source name in static config %+v", s)
 		}
-		if _, ok := urls[string(cfgs.Url)]; ok {
+		if err := cfgs.validate(fmt.Sprintf("target %q", tname)); err != nil {
+			return err
+		}
+		// Exactly one of them is set.
+		dsn := string(cfgs.URL + cfgs.CloudID)
+		if _, ok := urls[dsn]; ok {
 			return fmt.Errorf("duplicate data source name %q in static_config %+v", tname, s)
 		}
-		urls[string(cfgs.Url)] = nil
+		urls[dsn] = nil
 	}
 
 	return checkOverflow(s.XXX, "static_config")
 }
 
+// DataSourceConfig defines how to connect to an ElasticSearch target.
+type DataSourceConfig struct {
+	URL          Secret            `yaml:"url"`                // ElasticSearch URL, or comma separated URLs of the cluster's nodes
+	CloudID      Secret            `yaml:"cloud_id,omitempty"` // Elastic Cloud deployment ID, instead of the URL
+	Username     Secret            `yaml:"username"`
+	Password     Secret            `yaml:"password"`
+	APIKey       Secret            `yaml:"api_key,omitempty"`       // base64 encoded API key, overrides username and password
+	APIKeyFile   string            `yaml:"api_key_file,omitempty"`  // file to read the API key from, re-read whenever it changes
+	ServiceToken Secret            `yaml:"service_token,omitempty"` // service account token, sent as a bearer token instead of other credentials
+	FallbackURLs []Secret          `yaml:"fallback_urls,omitempty"` // URLs failed over to, in order, while the current one is down
+	TLS          *TLSConfig        `yaml:"tls_config,omitempty"`    // TLS settings of HTTPS connections, Go defaults if missing
+	ProxyURL     Secret            `yaml:"proxy_url,omitempty"`     // http, https or socks5 proxy to connect through, HTTP_PROXY etc. environment variables if empty
+	Headers      map[string]string `yaml:"headers,omitempty"`       // extra headers sent with all requests, e.g. `X-Tenant-ID` required by a gateway
+
+	proxyURL *url.URL // ProxyURL, parsed
+}
+
+// Proxy returns the URL of the proxy to connect through, nil to use the proxy environment variables.
+func (d *DataSourceConfig) Proxy() *url.URL {
+	return d.proxyURL
+}
+
+// TLSConfig defines the TLS settings of the connections to a data source.
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`              // PEM file of the CA certificates verifying the server, system ones if empty
+	CertFile           string `yaml:"cert_file,omitempty"`            // PEM file of the client certificate, for mutual TLS
+	KeyFile            string `yaml:"key_file,omitempty"`             // PEM file of the client certificate's private key
+	ServerName         string `yaml:"server_name,omitempty"`          // server name verified against the certificate, the URL host if empty
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"` // don't verify the server certificate at all
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for TLSConfig.
+func (t *TLSConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TLSConfig
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be specified together in tls_config")
+	}
+
+	return checkOverflow(t.XXX, "tls_config")
+}
+
+// validate checks the data source settings for consistency.
+func (d *DataSourceConfig) validate(ctx string) error {
+	if (d.URL == "") == (d.CloudID == "") {
+		return fmt.Errorf("exactly one of url and cloud_id is required for %s", ctx)
+	}
+	if d.CloudID != "" && len(d.FallbackURLs) > 0 {
+		return fmt.Errorf("fallback_urls are not supported with cloud_id for %s", ctx)
+	}
+	if d.APIKey != "" && d.APIKeyFile != "" {
+		return fmt.Errorf("at most one of api_key and api_key_file must be specified for %s", ctx)
+	}
+	if d.ProxyURL != "" {
+		u, err := url.Parse(string(d.ProxyURL))
+		if err != nil {
+			return fmt.Errorf("invalid proxy_url for %s: %s", ctx, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy_url scheme %q for %s, expected one of http, https or socks5", u.Scheme, ctx)
+		}
+		d.proxyURL = u
+	}
+	for name := range d.Headers {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("empty header name for %s", ctx)
+		}
+		if strings.EqualFold(name, "Authorization") {
+			return fmt.Errorf("the Authorization header is set from the credentials, it can't be in headers for %s", ctx)
+		}
+	}
+	if d.ServiceToken != "" && (d.Username != "" || d.Password != "" || d.APIKey != "" || d.APIKeyFile != "") {
+		return fmt.Errorf("service_token is exclusive with username, password, api_key and api_key_file for %s", ctx)
+	}
+	for _, u := range d.FallbackURLs {
+		if u == "" || u == d.URL {
+			return fmt.Errorf("fallback URLs must be non-empty and differ from the URL for %s", ctx)
+		}
+	}
+	for _, u := range append([]Secret{d.URL}, d.FallbackURLs...) {
+		if u == "" {
+			continue
+		}
+		for _, node := range SplitURLs(u) {
+			if node == "" {
+				return fmt.Errorf("empty node URL in comma separated URLs for %s", ctx)
+			}
+		}
+	}
+	return nil
+}
+
+// SplitURLs returns the node URLs of a comma separated URL list.
+func SplitURLs(urls Secret) []string {
+	nodes := strings.Split(string(urls), ",")
+	for i := range nodes {
+		nodes[i] = strings.TrimSpace(nodes[i])
+	}
+	return nodes
+}
+
 //
 // Collectors
 //
 
 // CollectorConfig defines a set of metrics and how they are collected.
 type CollectorConfig struct {
-	Name        string          `yaml:"collector_name"`         // name of this collector
-	MinInterval model.Duration  `yaml:"min_interval,omitempty"` // minimum interval between query executions
-	Metrics     []*MetricConfig `yaml:"metrics"`                // metrics/queries defined by this collector
-	Queries     []*QueryConfig  `yaml:"queries,omitempty"`      // Lucene queries defined by this collector
+	Name                         string          `yaml:"collector_name"`                     // name of this collector
+	MinInterval                  model.Duration  `yaml:"min_interval,omitempty"`             // minimum interval between query executions
+	MaxQueries                   int             `yaml:"max_concurrent_queries,omitempty"`   // maximum number of the collector's queries run concurrently on a target, 0 means unlimited
+	Metrics                      []*MetricConfig `yaml:"metrics"`                            // metrics/queries defined by this collector
+	Queries                      []*QueryConfig  `yaml:"queries,omitempty"`                  // Lucene queries defined by this collector
+	OnDuplicateAggregationString string          `yaml:"on_duplicate_aggregation,omitempty"` // ignore, warn (default) or error on metrics of the same name fed by same named aggregations of different queries
+
+	onDuplicateAggregation Strictness // OnDuplicateAggregationString converted to Strictness
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -318,6 +587,17 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	if len(c.Metrics) == 0 {
 		return fmt.Errorf("no metrics defined for collector %q", c.Name)
 	}
+	if c.MaxQueries < 0 {
+		return fmt.Errorf("max_concurrent_queries must be non-negative for collector %q, have %d", c.Name, c.MaxQueries)
+	}
+	if c.OnDuplicateAggregationString == "" {
+		c.onDuplicateAggregation = StrictnessWarn
+	} else {
+		var err error
+		if c.onDuplicateAggregation, err = parseStrictness(c.OnDuplicateAggregationString); err != nil {
+			return fmt.Errorf("invalid on_duplicate_aggregation for collector %q: %s", c.Name, err)
+		}
+	}
 
 	// Set metric.query for all metrics: resolve query references (if any) and generate QueryConfigs for literal queries.
 	queries := make(map[string]*QueryConfig, len(c.Queries))
@@ -332,35 +612,79 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 			}
 			metric.query = query
 			query.metrics = append(query.metrics, metric)
-			if metric.AggregationRef != "" {
-				aggFound := false
-				for _, agg := range query.Aggregations {
-					if metric.AggregationRef == agg.Name {
-						aggFound = true
-						metric.aggregation = agg
+			if metric.Derived != nil {
+				for _, name := range []string{metric.Derived.Left, metric.Derived.Right} {
+					if query.aggregation(name) == nil {
+						return fmt.Errorf("unresolved derived aggregation %q in metric %q of collector %q", name, metric.Name, c.Name)
 					}
 				}
-				if !aggFound {
+			}
+			if metric.AggregationRef != "" {
+				metric.aggregation = query.aggregation(metric.AggregationRef)
+				if metric.aggregation == nil {
 					return fmt.Errorf("unresolved aggregation_ref %q in metric %q of collector %q", metric.AggregationRef, metric.Name, c.Name)
 				}
 			}
+		} else if metric.Derived != nil {
+			return fmt.Errorf("derived metric %q of collector %q must reference a query via query_ref", metric.Name, c.Name)
 		} else {
+			if agg := metric.AggregationLiteral; agg != nil && agg.aggType.isPipeline() {
+				return fmt.Errorf("pipeline aggregation %q of metric %q must be a sub-aggregation of a query's bucket aggregation", agg.Name, metric.Name)
+			}
 			// For literal queries generate a QueryConfig with a name based off collector and metric name.
 			metric.query = &QueryConfig{
 				Name:         metric.Name,
 				Query:        metric.QueryLiteral,
 				Aggregations: []*AggregationConfig{metric.AggregationLiteral},
 			}
+			if metric.SourceField != "" && metric.AggregationLiteral == nil {
+				// Documents rather than aggregations, the top hit is all there is to read.
+				metric.query.Aggregations = nil
+				metric.query.Size = 1
+			}
 			metric.aggregation = metric.AggregationLiteral
 		}
 		if err := metric.FinalizeConfig(); err != nil {
 			return err
 		}
 	}
+	if err := c.checkDuplicateAggregations(); err != nil {
+		return err
+	}
 
 	return checkOverflow(c.XXX, "collector")
 }
 
+// checkDuplicateAggregations looks for metrics of the same name fed by aggregations of the same name, but from
+// different queries. Their samples would be labeled the same (e.g. `by_status="500"` from both queries), so they end
+// up as duplicate series.
+func (c *CollectorConfig) checkDuplicateAggregations() error {
+	seen := make(map[string]*MetricConfig)
+	for _, metric := range c.Metrics {
+		if metric.aggregation == nil {
+			continue
+		}
+		key := metric.Name + "/" + metric.aggregation.Name
+		other, found := seen[key]
+		if !found {
+			seen[key] = metric
+			continue
+		}
+		if other.query == metric.query {
+			continue
+		}
+		err := fmt.Errorf("aggregation %q of both queries %q and %q feeds metric %q of collector %q",
+			metric.aggregation.Name, other.query.Name, metric.query.Name, metric.Name, c.Name)
+		switch c.onDuplicateAggregation {
+		case StrictnessError:
+			return err
+		case StrictnessWarn:
+			log.Warning(err)
+		}
+	}
+	return nil
+}
+
 type MetricValueType string
 
 const (
@@ -368,22 +692,185 @@ const (
 	ValueTypePercentage = MetricValueType("percent")
 )
 
+// DerivedOperation defines how a derived metric value is computed from two aggregation values.
+type DerivedOperation string
+
+const (
+	DerivedRatio      = DerivedOperation("ratio")
+	DerivedDifference = DerivedOperation("difference")
+	DerivedSum        = DerivedOperation("sum")
+)
+
+// DerivedConfig defines a metric value computed from the values of two single-value aggregations of the same query,
+// e.g. the ratio of errors to total requests.
+type DerivedConfig struct {
+	OperationString string  `yaml:"operation"`       // ratio (left / right), difference (left - right) or sum
+	Left            string  `yaml:"left"`            // name of the left hand side aggregation
+	Right           string  `yaml:"right"`           // name of the right hand side aggregation
+	Scale           float64 `yaml:"scale,omitempty"` // factor the result is multiplied by, e.g. 100 for a percentage; default 1
+
+	operation DerivedOperation // OperationString converted to DerivedOperation
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for DerivedConfig.
+func (d *DerivedConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	d.Scale = 1
+
+	type plain DerivedConfig
+	if err := unmarshal((*plain)(d)); err != nil {
+		return err
+	}
+
+	if d.Left == "" || d.Right == "" {
+		return fmt.Errorf("both left and right aggregations are required for derived metrics")
+	}
+	switch op := DerivedOperation(strings.ToLower(d.OperationString)); op {
+	case DerivedRatio, DerivedDifference, DerivedSum:
+		d.operation = op
+	default:
+		return fmt.Errorf("unsupported derived operation: %s", d.OperationString)
+	}
+
+	return checkOverflow(d.XXX, "derived")
+}
+
+// Operation returns the operation computing the derived value.
+func (d *DerivedConfig) Operation() DerivedOperation {
+	return d.operation
+}
+
+// ConditionConfig defines a condition on metric values, e.g. `> 0`.
+type ConditionConfig struct {
+	Operator  string  `yaml:"operator"`  // one of >, >=, <, <=, == and !=
+	Threshold float64 `yaml:"threshold"` // the value compared against
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for ConditionConfig.
+func (c *ConditionConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ConditionConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	switch c.Operator {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return fmt.Errorf("unsupported condition operator: %q", c.Operator)
+	}
+
+	return checkOverflow(c.XXX, "condition")
+}
+
+// Matches returns true if value meets the condition.
+func (c *ConditionConfig) Matches(value float64) bool {
+	switch c.Operator {
+	case ">":
+		return value > c.Threshold
+	case ">=":
+		return value >= c.Threshold
+	case "<":
+		return value < c.Threshold
+	case "<=":
+		return value <= c.Threshold
+	case "==":
+		return value == c.Threshold
+	case "!=":
+		return value != c.Threshold
+	}
+	return false
+}
+
+// NonFiniteMode defines what to do with NaN and Inf metric values.
+type NonFiniteMode string
+
+const (
+	NonFiniteDrop = NonFiniteMode("drop")
+	NonFiniteZero = NonFiniteMode("zero")
+)
+
+// DuplicateMode defines what to do with samples of a metric sharing the same labels.
+type DuplicateMode string
+
+const (
+	DuplicateError     = DuplicateMode("error")
+	DuplicateKeepFirst = DuplicateMode("first")
+	DuplicateKeepLast  = DuplicateMode("last")
+	DuplicateKeepMax   = DuplicateMode("max")
+)
+
+// DateBuckets defines which buckets of a date_histogram aggregation are exported.
+type DateBuckets string
+
+const (
+	// DateBucketsAll exports every bucket, labeled with its formatted date.
+	DateBucketsAll = DateBuckets("all")
+	// DateBucketsLatest exports only the latest bucket, unlabeled.
+	DateBucketsLatest = DateBuckets("latest")
+)
+
+// ValueTransform defines a function applied to metric values, e.g. to export values spanning many orders of magnitude
+// on a log scale.
+type ValueTransform string
+
+const (
+	TransformNone  = ValueTransform("none")
+	TransformLog10 = ValueTransform("log10")
+	TransformLn    = ValueTransform("ln")
+	TransformSqrt  = ValueTransform("sqrt")
+)
+
+// NegativeMode defines what to do with negative values a percentage is calculated from.
+type NegativeMode string
+
+const (
+	// NegativeAllow calculates a negative percentage.
+	NegativeAllow = NegativeMode("allow")
+	// NegativeClamp calculates the percentage of 0 instead.
+	NegativeClamp = NegativeMode("clamp")
+	// NegativeError drops the sample and reports an error.
+	NegativeError = NegativeMode("error")
+)
+
 // MetricConfig defines a Prometheus metric, ElasticSearch query to populate it
 // keys/values.
 type MetricConfig struct {
-	Name                  string               `yaml:"metric_name"`               // the Prometheus metric name
-	TypeString            string               `yaml:"type"`                      // the Prometheus metric type
-	Help                  string               `yaml:"help"`                      // the Prometheus metric help text
-	Filters               []interface{}        `yaml:"filters,omitempty"`         // expose only these values as labels
-	StaticLabels          map[string]string    `yaml:"static_labels,omitempty"`   // fixed key/value pairs as static labels
-	QueryLiteral          string               `yaml:"query,omitempty"`           // a literal query
-	QueryRef              string               `yaml:"query_ref,omitempty"`       // references a query in the query map
-	AggregationRef        string               `yaml:"aggregation_ref,omitempty"` // references an aggregation in referenced query
-	AggregationLiteral    *AggregationConfig   `yaml:"aggregation,omitempty"`     // aggregations
-	TrackTotal            bool                 `yaml:"track_total,omitempty"`     // separate metric for total hits
-	MetricValueTypeString string               `yaml:"value_type,omitempty"`
+	Name                  string               `yaml:"metric_name"`                    // the Prometheus metric name
+	TypeString            string               `yaml:"type"`                           // the Prometheus metric type
+	Help                  string               `yaml:"help"`                           // the Prometheus metric help text, may reference `{{ .aggregation }}` and `{{ .field }}`
+	Filters               []interface{}        `yaml:"filters,omitempty"`              // expose only these values as labels
+	StaticLabels          map[string]string    `yaml:"static_labels,omitempty"`        // fixed key/value pairs as static labels
+	ResponseLabels        map[string]string    `yaml:"response_labels,omitempty"`      // labels valued per scrape from the response, by gjson path e.g. `_shards.total`
+	QueryLiteral          string               `yaml:"query,omitempty"`                // a literal query
+	QueryRef              string               `yaml:"query_ref,omitempty"`            // references a query in the query map
+	AggregationRef        string               `yaml:"aggregation_ref,omitempty"`      // references an aggregation in referenced query
+	AggregationLiteral    *AggregationConfig   `yaml:"aggregation,omitempty"`          // aggregations
+	TrackTotal            bool                 `yaml:"track_total,omitempty"`          // separate metric for total hits
+	TotalRelation         bool                 `yaml:"total_relation_label,omitempty"` // label the total hits with their `relation` (`eq` or `gte`)
+	MetricValueTypeString string               `yaml:"value_type,omitempty"`           // absolute (default) or percent
+	TopN                  int                  `yaml:"top_n,omitempty"`                // keep only top N labeled values, sum up the rest into `other`
+	NonFiniteString       string               `yaml:"non_finite,omitempty"`           // how to treat NaN/Inf values: drop (default) or zero
+	OnDuplicateString     string               `yaml:"on_duplicate,omitempty"`         // how to treat samples with same labels: error (default), first, last or max
+	NegativeString        string               `yaml:"negative_percentage,omitempty"`  // how to treat negative values in percent mode: allow (default), clamp or error
+	Derived               *DerivedConfig       `yaml:"derived,omitempty"`              // value computed from two single-value aggregations of the referenced query
+	Delta                 bool                 `yaml:"delta,omitempty"`                // export the increases of the value across scrapes, as a counter
+	Condition             *ConditionConfig     `yaml:"condition,omitempty"`            // export only the samples whose value meets the condition
+	ProcessingTimeout     model.Duration       `yaml:"processing_timeout,omitempty"`   // maximum time to spend turning the query results into samples, 0 means no limit
+	TransformString       string               `yaml:"transform,omitempty"`            // transform applied to values: none (default), log10, ln or sqrt
+	SourceField           string               `yaml:"source_field,omitempty"`         // `_source` field of the query's hits read as value, one sample per hit resolved by on_duplicate
 	valueType             prometheus.ValueType // TypeString converted to prometheus.ValueType
 	metricValueType       MetricValueType      // MetricValueTypeString converted to MetricValueType
+	nonFinite             NonFiniteMode        // NonFiniteString converted to NonFiniteMode
+	onDuplicate           DuplicateMode        // OnDuplicateString converted to DuplicateMode
+	negative              NegativeMode         // NegativeString converted to NegativeMode
+	transform             ValueTransform       // TransformString converted to ValueTransform
+	summary               bool                 // whether TypeString is `summary`
+	histogram             bool                 // whether TypeString is `histogram`
 	query                 *QueryConfig         // QueryConfig resolved from QueryRef or generated from Query
 	aggregation           *AggregationConfig   // AggregationConfig resolved from AggregationRef or generated from AggregationLiteral
 
@@ -391,6 +878,10 @@ type MetricConfig struct {
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
+// TotalRelationLabel is the label holding the relation of the total hits to the actual number of matching documents:
+// `eq` if exact, `gte` if a lower bound.
+const TotalRelationLabel = "relation"
+
 type AggregationType string
 
 const (
@@ -401,18 +892,105 @@ const (
 	AggregationTypeStats       = "stats"
 	AggregationTypeTerms       = "terms"
 	AggregationTypeCardinality = "cardinality"
+	AggregationTypeTopHits     = "top_hits"
+	AggregationTypePercentiles = "percentiles"
+	// AggregationTypeSuggest is not an actual aggregation but a suggester, run alongside the aggregations of the query.
+	AggregationTypeSuggest          = "suggest"
+	AggregationTypeComposite        = "composite"
+	AggregationTypeDateHistogram    = "date_histogram"
+	AggregationTypeRange            = "range"
+	AggregationTypeExtendedStats    = "extended_stats"
+	AggregationTypeValueCount       = "value_count"
+	AggregationTypeHistogram        = "histogram"
+	AggregationTypeFilters          = "filters"
+	AggregationTypeMissing          = "missing"
+	AggregationTypeDerivative       = "derivative"
+	AggregationTypeBucketScript     = "bucket_script"
+	AggregationTypeSignificantTerms = "significant_terms"
+	AggregationTypePercentileRanks  = "percentile_ranks"
 )
 
 func (t AggregationType) supportsPercentage() bool {
 	return t == AggregationTypeTerms
 }
 
+// isSingleValue returns true for aggregations with a single `value` result.
+func (t AggregationType) isSingleValue() bool {
+	switch t {
+	case AggregationTypeSum, AggregationTypeAvg, AggregationTypeMin, AggregationTypeMax, AggregationTypeCardinality,
+		AggregationTypeValueCount, AggregationTypeDerivative, AggregationTypeBucketScript:
+		return true
+	}
+	return false
+}
+
+// isPipeline returns true for parent pipeline aggregations, computed from sibling aggregations of each bucket of their
+// parent rather than from a field.
+func (t AggregationType) isPipeline() bool {
+	return t == AggregationTypeDerivative || t == AggregationTypeBucketScript
+}
+
+// isBucketAggregation returns true for aggregations whose result is a list of buckets, which sub-aggregations are run
+// on.
+func (t AggregationType) isBucketAggregation() bool {
+	switch t {
+	case AggregationTypeTerms, AggregationTypeComposite, AggregationTypeDateHistogram, AggregationTypeRange,
+		AggregationTypeHistogram, AggregationTypeFilters, AggregationTypeMissing, AggregationTypeSignificantTerms:
+		return true
+	}
+	return false
+}
+
+// isMetricAggregation returns true for aggregations whose result is an object of numeric fields (e.g. `value` or
+// `min`, `max`, `avg`...).
+func (t AggregationType) isMetricAggregation() bool {
+	switch t {
+	case AggregationTypeSum, AggregationTypeAvg, AggregationTypeMin, AggregationTypeMax, AggregationTypeStats,
+		AggregationTypeExtendedStats, AggregationTypeCardinality, AggregationTypeValueCount:
+		return true
+	}
+	return false
+}
+
 type AggregationConfig struct {
-	Name       string `yaml:"name"`
-	TypeString string `yaml:"type"`
-	Field      string `yaml:"field"`
-	ParsedBody map[AggregationType]AggregationField
-	aggType    AggregationType // TypeString parsed into AggregationType
+	Name              string                   `yaml:"name"`
+	TypeString        string                   `yaml:"type"`
+	Field             string                   `yaml:"field"`
+	LabelFields       []string                 `yaml:"label_fields,omitempty"`          // top_hits only: `_source` fields of the hit exported as labels
+	SortField         string                   `yaml:"sort_field,omitempty"`            // top_hits only: field to sort hits by, descending
+	Percents          []float64                `yaml:"percents,omitempty"`              // percentiles only: percentiles to calculate, ElasticSearch defaults if empty
+	RankValues        []float64                `yaml:"values,omitempty"`                // percentile_ranks only: values to get the percentile rank of
+	ExpectedKeys      []string                 `yaml:"expected_keys,omitempty"`         // terms only: bucket keys exported as 0 when missing from the response
+	ReportMissingKeys bool                     `yaml:"report_missing_keys,omitempty"`   // terms only: export a `missing_key` gauge for expected keys
+	ShowDocCountError bool                     `yaml:"show_doc_count_error,omitempty"`  // terms only: export the `doc_count_error_upper_bound` of each bucket
+	Text              string                   `yaml:"text,omitempty"`                  // suggest only: the text to get suggestions for
+	Suggester         string                   `yaml:"suggester,omitempty"`             // suggest only: term (default), phrase or completion
+	SuggestValue      string                   `yaml:"suggest_value,omitempty"`         // suggest only: option value to export, score (default) or freq
+	AllFields         bool                     `yaml:"all_fields,omitempty"`            // metric aggregations only: export all numeric fields, labeled by `field`
+	AsStringLabel     string                   `yaml:"value_as_string_label,omitempty"` // single-value only: label to export `value_as_string` as
+	Sources           []*CompositeSourceConfig `yaml:"sources,omitempty"`               // composite only: terms sources, each exported as a label
+	Size              int                      `yaml:"size,omitempty"`                  // composite only: number of buckets per request, ElasticSearch default if 0
+	Checkpoint        bool                     `yaml:"checkpoint,omitempty"`            // composite only: resume from the previous scrape's `after_key`
+	MaxPages          int                      `yaml:"max_pages,omitempty"`             // composite only: maximum number of pages fetched per scrape following `after_key`, 0 means all
+	KeyRegex          string                   `yaml:"key_regex,omitempty"`             // terms only: regex replaced in bucket keys, e.g. `-\d{4}\.\d{2}\.\d{2}$` for daily indices
+	KeyReplacement    string                   `yaml:"key_replacement,omitempty"`       // terms only: replacement for key_regex matches, may reference groups e.g. `${1}`
+	CalendarInterval  string                   `yaml:"calendar_interval,omitempty"`     // date_histogram only: calendar aware interval, e.g. `1d` or `1M`
+	FixedInterval     string                   `yaml:"fixed_interval,omitempty"`        // date_histogram only: fixed interval, e.g. `5m`
+	BucketsString     string                   `yaml:"buckets,omitempty"`               // date_histogram only: all (default) buckets labeled by date, or the latest one only
+	Ranges            []*RangeConfig           `yaml:"ranges,omitempty"`                // range only: the ranges to count documents in
+	StatLabel         string                   `yaml:"stat_label,omitempty"`            // stats and extended_stats only: label to export the stat name as, default the aggregation name
+	Interval          float64                  `yaml:"interval,omitempty"`              // histogram only: width of the buckets
+	NamedFilters      map[string]string        `yaml:"filters,omitempty"`               // filters only: Lucene queries by name, each counting documents in a bucket labeled with the name
+	OtherBucket       bool                     `yaml:"other_bucket,omitempty"`          // filters only: also count documents matching none of the filters, in bucket `_other_`
+	BucketsPath       string                   `yaml:"buckets_path,omitempty"`          // derivative only: path to the sibling aggregation to derive, e.g. `sales` or `_count`
+	BucketsPathVars   map[string]string        `yaml:"buckets_path_vars,omitempty"`     // bucket_script only: script variables by name, each a path to a sibling aggregation
+	Script            string                   `yaml:"script,omitempty"`                // bucket_script only: script computing the value from the variables, e.g. `params.errors / params.total`
+	SignificantValue  string                   `yaml:"significant_value,omitempty"`     // significant_terms only: bucket value to export, score (default), doc_count or bg_count
+	Aggregations      []*AggregationConfig     `yaml:"aggregations,omitempty"`          // bucket aggregations only: sub-aggregations run on each bucket, labeled with the bucket key
+	ParsedBody        map[AggregationType]interface{}
+	aggType           AggregationType // TypeString parsed into AggregationType
+	keyRegex          *regexp.Regexp  // KeyRegex compiled
+	buckets           DateBuckets     // BucketsString converted to DateBuckets
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
@@ -428,11 +1006,6 @@ func (a *AggregationConfig) UnmarshalYAML(unmarshal func(interface{}) error) err
 	if a.Name == "" {
 		return fmt.Errorf("missing name for aggregation %+v", a)
 	}
-	if a.Field == "" {
-		return fmt.Errorf("missing field for aggregation %+v", a)
-	}
-	field := AggregationField{Field: a.Field}
-
 	err := checkLabel(a.Name, "aggregation", a.Name)
 	if err != nil {
 		return err
@@ -452,10 +1025,266 @@ func (a *AggregationConfig) UnmarshalYAML(unmarshal func(interface{}) error) err
 		a.aggType = AggregationTypeSum
 	case "terms":
 		a.aggType = AggregationTypeTerms
+	case "top_hits":
+		a.aggType = AggregationTypeTopHits
+	case "percentiles":
+		a.aggType = AggregationTypePercentiles
+	case "suggest":
+		a.aggType = AggregationTypeSuggest
+	case "composite":
+		a.aggType = AggregationTypeComposite
+	case "date_histogram":
+		a.aggType = AggregationTypeDateHistogram
+	case "range":
+		a.aggType = AggregationTypeRange
+	case "extended_stats":
+		a.aggType = AggregationTypeExtendedStats
+	case "value_count":
+		a.aggType = AggregationTypeValueCount
+	case "histogram":
+		a.aggType = AggregationTypeHistogram
+	case "filters":
+		a.aggType = AggregationTypeFilters
+	case "missing":
+		a.aggType = AggregationTypeMissing
+	case "derivative":
+		a.aggType = AggregationTypeDerivative
+	case "bucket_script":
+		a.aggType = AggregationTypeBucketScript
+	case "significant_terms":
+		a.aggType = AggregationTypeSignificantTerms
+	case "percentile_ranks":
+		a.aggType = AggregationTypePercentileRanks
 	default:
 		return fmt.Errorf("unsupported aggregation type: %s", a.aggType)
 	}
-	a.ParsedBody = map[AggregationType]AggregationField{a.aggType: field}
+	if a.aggType.isPipeline() && a.Field != "" {
+		return fmt.Errorf("pipeline aggregation %q takes buckets paths rather than a field", a.Name)
+	}
+	if a.Field == "" && a.aggType != AggregationTypeComposite && a.aggType != AggregationTypeFilters && !a.aggType.isPipeline() {
+		return fmt.Errorf("missing field for aggregation %+v", a)
+	}
+
+	if a.aggType == AggregationTypeComposite {
+		if a.Field != "" {
+			return fmt.Errorf("composite aggregation %q takes sources rather than a field", a.Name)
+		}
+		if len(a.Sources) == 0 {
+			return fmt.Errorf("missing sources for composite aggregation %q", a.Name)
+		}
+		if a.Size < 0 {
+			return fmt.Errorf("size must be non-negative for aggregation %q, have %d", a.Name, a.Size)
+		}
+		if a.MaxPages < 0 {
+			return fmt.Errorf("max_pages must be non-negative for aggregation %q, have %d", a.Name, a.MaxPages)
+		}
+		if a.Checkpoint && a.MaxPages != 0 {
+			return fmt.Errorf("max_pages doesn't apply to checkpointed aggregation %q, which fetches one page per scrape", a.Name)
+		}
+		sources := make(map[string]bool, len(a.Sources))
+		for _, s := range a.Sources {
+			if err := checkLabel(s.Name, "aggregation", a.Name); err != nil {
+				return err
+			}
+			if sources[s.Name] {
+				return fmt.Errorf("duplicate source %q in aggregation %q", s.Name, a.Name)
+			}
+			sources[s.Name] = true
+		}
+	} else if len(a.Sources) > 0 || a.Size != 0 || a.Checkpoint || a.MaxPages != 0 {
+		return fmt.Errorf("sources, size, checkpoint and max_pages only apply to composite aggregations, in aggregation %q", a.Name)
+	}
+
+	if a.aggType == AggregationTypeDateHistogram {
+		if (a.CalendarInterval == "") == (a.FixedInterval == "") {
+			return fmt.Errorf("exactly one of calendar_interval and fixed_interval is required for aggregation %q", a.Name)
+		}
+		switch DateBuckets(a.BucketsString) {
+		case "", DateBucketsAll:
+			a.buckets = DateBucketsAll
+		case DateBucketsLatest:
+			a.buckets = DateBucketsLatest
+		default:
+			return fmt.Errorf("unsupported buckets for aggregation %q: %s", a.Name, a.BucketsString)
+		}
+	} else if a.CalendarInterval != "" || a.FixedInterval != "" || a.BucketsString != "" {
+		return fmt.Errorf("calendar_interval, fixed_interval and buckets only apply to date_histogram aggregations, in aggregation %q", a.Name)
+	}
+	if a.aggType == AggregationTypeStats || a.aggType == AggregationTypeExtendedStats {
+		if a.StatLabel == "" {
+			// Like bucket keys, labeled by the aggregation name, so that stats of different aggregations differ.
+			a.StatLabel = a.Name
+		}
+		if err := checkLabel(a.StatLabel, "aggregation", a.Name); err != nil {
+			return err
+		}
+		if !model.LabelName(a.StatLabel).IsValid() {
+			return fmt.Errorf("invalid stat label %q for aggregation %q, set a valid stat_label", a.StatLabel, a.Name)
+		}
+	} else if a.StatLabel != "" {
+		return fmt.Errorf("stat_label only applies to stats and extended_stats aggregations, in aggregation %q", a.Name)
+	}
+	if a.aggType == AggregationTypeFilters {
+		if a.Field != "" {
+			return fmt.Errorf("filters aggregation %q takes filters rather than a field", a.Name)
+		}
+		if len(a.NamedFilters) == 0 {
+			return fmt.Errorf("missing filters for filters aggregation %q", a.Name)
+		}
+		if _, found := a.NamedFilters[OtherBucketKey]; found && a.OtherBucket {
+			return fmt.Errorf("filter name %q is reserved for the other bucket, in aggregation %q", OtherBucketKey, a.Name)
+		}
+	} else if len(a.NamedFilters) > 0 || a.OtherBucket {
+		return fmt.Errorf("filters and other_bucket only apply to filters aggregations, in aggregation %q", a.Name)
+	}
+	switch {
+	case a.aggType == AggregationTypeDerivative && a.BucketsPath == "":
+		return fmt.Errorf("missing buckets_path for derivative aggregation %q", a.Name)
+	case a.aggType == AggregationTypeBucketScript && (len(a.BucketsPathVars) == 0 || a.Script == ""):
+		return fmt.Errorf("both buckets_path_vars and script are required for bucket_script aggregation %q", a.Name)
+	case a.aggType != AggregationTypeDerivative && a.BucketsPath != "":
+		return fmt.Errorf("buckets_path only applies to derivative aggregations, in aggregation %q", a.Name)
+	case a.aggType != AggregationTypeBucketScript && (len(a.BucketsPathVars) > 0 || a.Script != ""):
+		return fmt.Errorf("buckets_path_vars and script only apply to bucket_script aggregations, in aggregation %q", a.Name)
+	}
+	if a.aggType == AggregationTypeSignificantTerms {
+		switch a.SignificantValue {
+		case "":
+			a.SignificantValue = "score"
+		case "score", "doc_count", "bg_count":
+		default:
+			return fmt.Errorf("unsupported significant_value for aggregation %q: %s", a.Name, a.SignificantValue)
+		}
+	} else if a.SignificantValue != "" {
+		return fmt.Errorf("significant_value only applies to significant_terms aggregations, in aggregation %q", a.Name)
+	}
+	if a.aggType == AggregationTypeHistogram && a.Interval <= 0 {
+		return fmt.Errorf("interval must be strictly positive for histogram aggregation %q, have %v", a.Name, a.Interval)
+	} else if a.aggType != AggregationTypeHistogram && a.Interval != 0 {
+		return fmt.Errorf("interval only applies to histogram aggregations, in aggregation %q", a.Name)
+	}
+	if a.aggType == AggregationTypeRange && len(a.Ranges) == 0 {
+		return fmt.Errorf("missing ranges for range aggregation %q", a.Name)
+	} else if a.aggType != AggregationTypeRange && len(a.Ranges) > 0 {
+		return fmt.Errorf("ranges only apply to range aggregations, in aggregation %q", a.Name)
+	}
+	if a.aggType != AggregationTypeTopHits && (len(a.LabelFields) > 0 || a.SortField != "") {
+		return fmt.Errorf("label_fields and sort_field only apply to top_hits aggregations, in aggregation %q", a.Name)
+	}
+	if a.KeyRegex != "" {
+		if a.aggType != AggregationTypeTerms {
+			return fmt.Errorf("key_regex only applies to terms aggregations, in aggregation %q", a.Name)
+		}
+		if a.keyRegex, err = regexp.Compile(a.KeyRegex); err != nil {
+			return fmt.Errorf("invalid key_regex in aggregation %q: %s", a.Name, err)
+		}
+	} else if a.KeyReplacement != "" {
+		return fmt.Errorf("key_replacement without key_regex in aggregation %q", a.Name)
+	}
+	if a.aggType != AggregationTypeTerms && len(a.ExpectedKeys) > 0 {
+		return fmt.Errorf("expected_keys only apply to terms aggregations, in aggregation %q", a.Name)
+	}
+	if a.ShowDocCountError && a.aggType != AggregationTypeTerms {
+		return fmt.Errorf("show_doc_count_error only applies to terms aggregations, in aggregation %q", a.Name)
+	}
+	if a.ReportMissingKeys && len(a.ExpectedKeys) == 0 {
+		return fmt.Errorf("report_missing_keys without expected_keys in aggregation %q", a.Name)
+	}
+	if a.aggType == AggregationTypeSuggest {
+		if a.Text == "" {
+			return fmt.Errorf("missing text for suggest aggregation %q", a.Name)
+		}
+		switch a.Suggester {
+		case "":
+			a.Suggester = "term"
+		case "term", "phrase", "completion":
+		default:
+			return fmt.Errorf("unsupported suggester for aggregation %q: %s", a.Name, a.Suggester)
+		}
+		switch a.SuggestValue {
+		case "":
+			a.SuggestValue = "score"
+		case "score", "freq":
+		default:
+			return fmt.Errorf("unsupported suggest_value for aggregation %q: %s", a.Name, a.SuggestValue)
+		}
+	} else if a.Text != "" || a.Suggester != "" || a.SuggestValue != "" {
+		return fmt.Errorf("text, suggester and suggest_value only apply to suggest aggregations, in aggregation %q", a.Name)
+	}
+	if a.AsStringLabel != "" {
+		if !a.aggType.isSingleValue() {
+			return fmt.Errorf("value_as_string_label only applies to single-value aggregations, in aggregation %q", a.Name)
+		}
+		if err := checkLabel(a.AsStringLabel, "aggregation", a.Name); err != nil {
+			return err
+		}
+	}
+	if a.AllFields && !a.aggType.isMetricAggregation() {
+		return fmt.Errorf("all_fields is not supported for %s aggregation %q", a.aggType, a.Name)
+	}
+	if a.aggType == AggregationTypePercentileRanks && len(a.RankValues) == 0 {
+		return fmt.Errorf("missing values for percentile_ranks aggregation %q", a.Name)
+	} else if a.aggType != AggregationTypePercentileRanks && len(a.RankValues) > 0 {
+		return fmt.Errorf("values only apply to percentile_ranks aggregations, in aggregation %q", a.Name)
+	}
+	if a.aggType != AggregationTypePercentiles && len(a.Percents) > 0 {
+		return fmt.Errorf("percents only apply to percentiles aggregations, in aggregation %q", a.Name)
+	}
+	for _, p := range a.Percents {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("percent %v out of range [0, 100] in aggregation %q", p, a.Name)
+		}
+	}
+	if len(a.Aggregations) > 0 && !a.aggType.isBucketAggregation() {
+		return fmt.Errorf("sub-aggregations are not supported for %s aggregation %q", a.aggType, a.Name)
+	}
+	for _, sub := range a.Aggregations {
+		switch {
+		case sub.aggType == AggregationTypeSuggest || sub.aggType == AggregationTypeComposite:
+			return fmt.Errorf("%s aggregation %q can't be a sub-aggregation, in aggregation %q", sub.aggType, sub.Name, a.Name)
+		case sub.ReportMissingKeys || sub.ShowDocCountError:
+			return fmt.Errorf("report_missing_keys and show_doc_count_error are not supported for sub-aggregation %q, in aggregation %q",
+				sub.Name, a.Name)
+		}
+	}
+	labels := make(map[string]bool, len(a.LabelFields))
+	for _, f := range a.LabelFields {
+		label := a.FieldLabel(f)
+		if err := checkLabel(label, "aggregation", a.Name); err != nil {
+			return err
+		}
+		if labels[label] {
+			return fmt.Errorf("duplicate label %q in aggregation %q", label, a.Name)
+		}
+		labels[label] = true
+	}
+
+	var body interface{} = AggregationField{Field: a.Field}
+	switch a.aggType {
+	case AggregationTypeTopHits:
+		body = a.topHitsBody()
+	case AggregationTypePercentiles:
+		body = PercentilesField{Field: a.Field, Percents: a.Percents}
+	case AggregationTypeRange:
+		body = RangeField{Field: a.Field, Ranges: a.Ranges}
+	case AggregationTypeTerms:
+		body = TermsField{Field: a.Field, ShowTermDocCountError: a.ShowDocCountError}
+	case AggregationTypePercentileRanks:
+		body = PercentileRanksField{Field: a.Field, Values: a.RankValues}
+	case AggregationTypeHistogram:
+		body = HistogramField{Field: a.Field, Interval: a.Interval}
+	case AggregationTypeFilters:
+		body = a.filtersBody()
+	case AggregationTypeDerivative:
+		body = map[string]interface{}{"buckets_path": a.BucketsPath}
+	case AggregationTypeBucketScript:
+		body = map[string]interface{}{"buckets_path": a.BucketsPathVars, "script": a.Script}
+	case AggregationTypeDateHistogram:
+		body = DateHistogramField{Field: a.Field, CalendarInterval: a.CalendarInterval, FixedInterval: a.FixedInterval}
+	case AggregationTypeComposite:
+		body = a.compositeBody(nil)
+	}
+	a.ParsedBody = a.withSubAggregations(map[AggregationType]interface{}{a.aggType: body})
 
 	return checkOverflow(a.XXX, "aggregation_config")
 }
@@ -464,10 +1293,195 @@ func (a *AggregationConfig) Type() AggregationType {
 	return a.aggType
 }
 
+// MapKey returns the label value of a bucket key, with key_regex matches replaced if configured. Expected keys are
+// compared against mapped keys.
+func (a *AggregationConfig) MapKey(key string) string {
+	if a.keyRegex == nil {
+		return key
+	}
+	return a.keyRegex.ReplaceAllString(key, a.KeyReplacement)
+}
+
+// Buckets returns which buckets of a date_histogram aggregation are exported.
+func (a *AggregationConfig) Buckets() DateBuckets {
+	return a.buckets
+}
+
+// FieldLabel returns the label name a `_source` field is exported as, with characters not allowed in label names
+// replaced by underscores.
+func (a *AggregationConfig) FieldLabel(field string) string {
+	return invalidLabelCharRE.ReplaceAllString(field, "_")
+}
+
+// RangeConfig defines a range of a range aggregation, from inclusive to exclusive. Either bound may be omitted.
+type RangeConfig struct {
+	Key  string   `yaml:"key,omitempty" json:"key,omitempty"`   // the bucket key, also the label value; ElasticSearch generates one if empty
+	From *float64 `yaml:"from,omitempty" json:"from,omitempty"` // lower bound, unbounded if not set
+	To   *float64 `yaml:"to,omitempty" json:"to,omitempty"`     // upper bound, unbounded if not set
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for RangeConfig.
+func (r *RangeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RangeConfig
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+
+	if r.From == nil && r.To == nil {
+		return fmt.Errorf("at least one of from and to is required for range %+v", r)
+	}
+	if r.From != nil && r.To != nil && *r.From >= *r.To {
+		return fmt.Errorf("from must be less than to for range %+v", r)
+	}
+
+	return checkOverflow(r.XXX, "range")
+}
+
+// CompositeSourceConfig defines a terms source of a composite aggregation.
+type CompositeSourceConfig struct {
+	Name  string `yaml:"name"`  // the source name, also the label name
+	Field string `yaml:"field"` // the field to get terms from
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for CompositeSourceConfig.
+func (s *CompositeSourceConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CompositeSourceConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+
+	if s.Name == "" || s.Field == "" {
+		return fmt.Errorf("both name and field are required for composite sources, have %+v", s)
+	}
+
+	return checkOverflow(s.XXX, "composite source")
+}
+
+// CompositeBody returns the body of a composite aggregation, resuming after the given key if not empty.
+func (a *AggregationConfig) CompositeBody(after json.RawMessage) map[AggregationType]interface{} {
+	return a.withSubAggregations(map[AggregationType]interface{}{a.aggType: a.compositeBody(after)})
+}
+
+// subAggregationsKey is the key of the sub-aggregations in the body of an aggregation.
+const subAggregationsKey = AggregationType("aggs")
+
+// withSubAggregations adds the bodies of the sub-aggregations (if any) to the given aggregation body.
+func (a *AggregationConfig) withSubAggregations(body map[AggregationType]interface{}) map[AggregationType]interface{} {
+	if len(a.Aggregations) == 0 {
+		return body
+	}
+	subs := make(map[string]interface{}, len(a.Aggregations))
+	for _, sub := range a.Aggregations {
+		subs[sub.Name] = sub.ParsedBody
+	}
+	body[subAggregationsKey] = subs
+	return body
+}
+
+func (a *AggregationConfig) compositeBody(after json.RawMessage) map[string]interface{} {
+	sources := make([]interface{}, 0, len(a.Sources))
+	for _, s := range a.Sources {
+		sources = append(sources, map[string]interface{}{
+			s.Name: map[string]interface{}{"terms": AggregationField{Field: s.Field}},
+		})
+	}
+	body := map[string]interface{}{"sources": sources}
+	if a.Size > 0 {
+		body["size"] = a.Size
+	}
+	if len(after) > 0 {
+		body["after"] = after
+	}
+	return body
+}
+
+// SuggestBody returns the body of the suggester, for suggest aggregations.
+func (a *AggregationConfig) SuggestBody() map[string]interface{} {
+	return map[string]interface{}{
+		"text":      a.Text,
+		a.Suggester: AggregationField{Field: a.Field},
+	}
+}
+
+// OtherBucketKey is the name of the bucket of a filters aggregation counting the documents matching none of the filters.
+const OtherBucketKey = "_other_"
+
+// filtersBody returns the body of a filters aggregation, with each filter a Lucene query.
+func (a *AggregationConfig) filtersBody() map[string]interface{} {
+	filters := make(map[string]interface{}, len(a.NamedFilters))
+	for name, query := range a.NamedFilters {
+		filters[name] = map[string]interface{}{"query_string": map[string]string{"query": query}}
+	}
+	body := map[string]interface{}{"filters": filters}
+	if a.OtherBucket {
+		body["other_bucket_key"] = OtherBucketKey
+	}
+	return body
+}
+
+// topHitsBody returns the body of a top_hits aggregation, fetching only the fields needed from the single top hit.
+func (a *AggregationConfig) topHitsBody() map[string]interface{} {
+	body := map[string]interface{}{
+		"size": 1,
+		"_source": map[string]interface{}{
+			"includes": append([]string{a.Field}, a.LabelFields...),
+		},
+	}
+	if a.SortField != "" {
+		body["sort"] = []interface{}{
+			map[string]interface{}{a.SortField: map[string]string{"order": "desc"}},
+		}
+	}
+	return body
+}
+
 type AggregationField struct {
 	Field string `json:"field"`
 }
 
+// TermsField is the body of a terms aggregation.
+type TermsField struct {
+	Field                 string `json:"field"`
+	ShowTermDocCountError bool   `json:"show_term_doc_count_error,omitempty"`
+}
+
+// HistogramField is the body of a histogram aggregation.
+type HistogramField struct {
+	Field    string  `json:"field"`
+	Interval float64 `json:"interval"`
+}
+
+// RangeField is the body of a range aggregation.
+type RangeField struct {
+	Field  string         `json:"field"`
+	Ranges []*RangeConfig `json:"ranges"`
+}
+
+// DateHistogramField is the body of a date_histogram aggregation.
+type DateHistogramField struct {
+	Field            string `json:"field"`
+	CalendarInterval string `json:"calendar_interval,omitempty"`
+	FixedInterval    string `json:"fixed_interval,omitempty"`
+}
+
+// PercentileRanksField is the body of a percentile_ranks aggregation.
+type PercentileRanksField struct {
+	Field  string    `json:"field"`
+	Values []float64 `json:"values"`
+}
+
+// PercentilesField is the body of a percentiles aggregation.
+type PercentilesField struct {
+	Field    string    `json:"field"`
+	Percents []float64 `json:"percents,omitempty"`
+}
+
 // ValueType returns the metric type, converted to a prometheus.ValueType.
 func (m *MetricConfig) ValueType() prometheus.ValueType {
 	return m.valueType
@@ -486,6 +1500,36 @@ func (m *MetricConfig) Aggregation() *AggregationConfig {
 	return m.aggregation
 }
 
+// NonFinite returns the way NaN and Inf values of the metric are handled.
+func (m *MetricConfig) NonFinite() NonFiniteMode {
+	return m.nonFinite
+}
+
+// Transform returns the function applied to the metric's values.
+func (m *MetricConfig) Transform() ValueTransform {
+	return m.transform
+}
+
+// NegativePercentage returns the way negative values are handled when calculating percentages.
+func (m *MetricConfig) NegativePercentage() NegativeMode {
+	return m.negative
+}
+
+// Histogram returns true if the metric is a histogram, with its buckets approximated from a percentiles aggregation.
+func (m *MetricConfig) Histogram() bool {
+	return m.histogram
+}
+
+// Summary returns true if the metric is a summary, with its quantiles populated from a percentiles aggregation.
+func (m *MetricConfig) Summary() bool {
+	return m.summary
+}
+
+// OnDuplicate returns the way samples of the metric sharing the same labels are handled.
+func (m *MetricConfig) OnDuplicate() DuplicateMode {
+	return m.onDuplicate
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface for MetricConfig.
 func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain MetricConfig
@@ -503,27 +1547,96 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if m.Help == "" {
 		return fmt.Errorf("missing help for metric %q", m.Name)
 	}
+	if _, err := template.New("help").Parse(m.Help); err != nil {
+		return fmt.Errorf("invalid help for metric %q: %s", m.Name, err)
+	}
 	if (m.QueryLiteral == "") == (m.QueryRef == "") {
 		return fmt.Errorf("exactly one of query and query_ref must be specified for metric %q", m.Name)
 	}
 	switch strings.ToLower(m.MetricValueTypeString) {
-	case "absolute":
-	case "":
+	case "", "absolute":
 		m.metricValueType = ValueTypeAbsolute
 	case "percent":
 		m.metricValueType = ValueTypePercentage
 	default:
 		return fmt.Errorf("unsupported metric value type: %s", m.MetricValueTypeString)
 	}
+	switch strings.ToLower(m.NonFiniteString) {
+	case "", "drop":
+		m.nonFinite = NonFiniteDrop
+	case "zero":
+		m.nonFinite = NonFiniteZero
+	default:
+		return fmt.Errorf("unsupported non_finite value for metric %q: %s", m.Name, m.NonFiniteString)
+	}
+	switch strings.ToLower(m.OnDuplicateString) {
+	case "", "error":
+		m.onDuplicate = DuplicateError
+	case "first":
+		m.onDuplicate = DuplicateKeepFirst
+	case "last":
+		m.onDuplicate = DuplicateKeepLast
+	case "max":
+		m.onDuplicate = DuplicateKeepMax
+	default:
+		return fmt.Errorf("unsupported on_duplicate value for metric %q: %s", m.Name, m.OnDuplicateString)
+	}
+	switch strings.ToLower(m.NegativeString) {
+	case "", "allow":
+		m.negative = NegativeAllow
+	case "clamp":
+		m.negative = NegativeClamp
+	case "error":
+		m.negative = NegativeError
+	default:
+		return fmt.Errorf("unsupported negative_percentage value for metric %q: %s", m.Name, m.NegativeString)
+	}
+	if m.NegativeString != "" && m.metricValueType != ValueTypePercentage {
+		return fmt.Errorf("negative_percentage only applies to percent value type, in metric %q", m.Name)
+	}
+	switch transform := ValueTransform(strings.ToLower(m.TransformString)); transform {
+	case "":
+		m.transform = TransformNone
+	case TransformNone, TransformLog10, TransformLn, TransformSqrt:
+		m.transform = transform
+	default:
+		return fmt.Errorf("unsupported transform for metric %q: %s", m.Name, m.TransformString)
+	}
+	if m.transform != TransformNone && m.Delta {
+		return fmt.Errorf("transform is not supported for delta metric %q", m.Name)
+	}
+	if m.TopN < 0 {
+		return fmt.Errorf("top_n must be non-negative for metric %q, have %d", m.Name, m.TopN)
+	}
 
 	switch strings.ToLower(m.TypeString) {
 	case "counter":
 		m.valueType = prometheus.CounterValue
 	case "gauge":
 		m.valueType = prometheus.GaugeValue
+	case "summary":
+		m.valueType = prometheus.UntypedValue
+		m.summary = true
+	case "histogram":
+		m.valueType = prometheus.UntypedValue
+		m.histogram = true
 	default:
 		return fmt.Errorf("unsupported metric type: %s", m.TypeString)
 	}
+	if m.Delta && m.valueType != prometheus.CounterValue {
+		return fmt.Errorf("delta requires type counter for metric %q", m.Name)
+	}
+	for label := range m.ResponseLabels {
+		if err := checkLabel(label, "metric", m.Name); err != nil {
+			return err
+		}
+		if _, found := m.StaticLabels[label]; found {
+			return fmt.Errorf("response label %q is also a static label of metric %q", label, m.Name)
+		}
+	}
+	if _, found := m.StaticLabels[TotalRelationLabel]; found && m.TotalRelation {
+		return fmt.Errorf("static label %q conflicts with total_relation_label for metric %q", TotalRelationLabel, m.Name)
+	}
 
 	return checkOverflow(m.XXX, "metric")
 }
@@ -532,6 +1645,36 @@ func (m *MetricConfig) FinalizeConfig() error {
 	if m.aggregation == nil && len(m.Filters) > 0 {
 		return fmt.Errorf("filters without aggregation for metric %s", m.Name)
 	}
+	if m.aggregation == nil && m.TopN > 0 {
+		return fmt.Errorf("top_n without aggregation for metric %s", m.Name)
+	}
+	if m.SourceField != "" {
+		switch {
+		case m.aggregation != nil || m.Derived != nil:
+			return fmt.Errorf("source_field metric %s must neither use an aggregation nor be derived", m.Name)
+		case m.query.Size == 0:
+			return fmt.Errorf("source_field metric %s requires its query to return hits, with a size of at least 1", m.Name)
+		case m.TrackTotal:
+			return fmt.Errorf("track_total is not supported for source_field metric %s", m.Name)
+		case m.metricValueType == ValueTypePercentage || m.summary || m.histogram:
+			return fmt.Errorf("source_field metric %s can only be an absolute counter or gauge", m.Name)
+		}
+		// The total hits are not part of a value read from documents.
+		return nil
+	}
+	if m.Derived != nil {
+		if m.aggregation != nil {
+			return fmt.Errorf("derived metric %s must not reference an aggregation", m.Name)
+		}
+		if m.metricValueType == ValueTypePercentage {
+			return fmt.Errorf("percentage value type is not supported for derived metric %s, use scale instead", m.Name)
+		}
+		if m.summary || m.histogram {
+			return fmt.Errorf("derived metric %s can not be a %s", m.Name, m.TypeString)
+		}
+		// The total hits are not part of a derived value.
+		return nil
+	}
 	if len(m.query.Aggregations) > 0 && m.aggregation == nil {
 		return fmt.Errorf("metric %s referencing aggregated query without aggregation_ref", m.Name)
 	}
@@ -539,9 +1682,31 @@ func (m *MetricConfig) FinalizeConfig() error {
 		return fmt.Errorf("percentage value type is not supported for aggregation type %s in metric %s", m.aggregation.TypeString, m.Name)
 	}
 
+	if m.summary && (m.aggregation == nil || m.aggregation.aggType != AggregationTypePercentiles) {
+		return fmt.Errorf("summary metric %s must use a percentiles aggregation", m.Name)
+	}
+	if m.histogram && (m.aggregation == nil ||
+		(m.aggregation.aggType != AggregationTypePercentiles && m.aggregation.aggType != AggregationTypeHistogram)) {
+		return fmt.Errorf("histogram metric %s must use a percentiles or histogram aggregation", m.Name)
+	}
+	if (m.summary || m.histogram) && m.TopN > 0 {
+		return fmt.Errorf("top_n is not supported for %s metric %s", m.TypeString, m.Name)
+	}
+
+	if m.query.Mode() == QueryModeRollupSearch && m.query.TotalPath == "" {
+		// Rollup search always reports 0 hits, only a total_path makes for a meaningful total.
+		if m.TrackTotal || m.metricValueType == ValueTypePercentage {
+			return fmt.Errorf("track_total and percentage value type require a total_path in rollup_search mode, for metric %s", m.Name)
+		}
+		return nil
+	}
 	if !m.TrackTotal && len(m.query.Aggregations) > 0 {
 		m.TrackTotal = true
 	}
+	if m.query.Mode() == QueryModeCount {
+		// The count is all there is to export.
+		m.TrackTotal = true
+	}
 
 	return nil
 }
@@ -556,13 +1721,112 @@ func checkLabel(label string, ctx ...string) error {
 	return nil
 }
 
+// IndexWindowConfig defines a window of time based (e.g. daily) indices, expanded at scrape time into the names of the
+// indices for the last `lookback_days` days.
+type IndexWindowConfig struct {
+	Prefix       string `yaml:"prefix"`                  // index name prefix, e.g. `logs-`
+	DateFormat   string `yaml:"date_format,omitempty"`   // Go time layout of the date suffix, default `2006.01.02`
+	LookbackDays int    `yaml:"lookback_days,omitempty"` // number of days to query, including the current one; default 1
+	TimeZone     string `yaml:"time_zone,omitempty"`     // time zone the index dates are in, default UTC
+
+	location *time.Location // TimeZone loaded
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for IndexWindowConfig.
+func (w *IndexWindowConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	w.DateFormat = "2006.01.02"
+	w.LookbackDays = 1
+
+	type plain IndexWindowConfig
+	if err := unmarshal((*plain)(w)); err != nil {
+		return err
+	}
+
+	if w.Prefix == "" {
+		return fmt.Errorf("missing prefix for index_window")
+	}
+	if w.LookbackDays < 1 {
+		return fmt.Errorf("index_window.lookback_days must be at least 1, have %d", w.LookbackDays)
+	}
+	location, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return fmt.Errorf("invalid index_window.time_zone %q: %s", w.TimeZone, err)
+	}
+	w.location = location
+
+	return checkOverflow(w.XXX, "index_window")
+}
+
+// Indices returns the names of the indices in the window ending at now, most recent first.
+func (w *IndexWindowConfig) Indices(now time.Time) []string {
+	now = now.In(w.location)
+	indices := make([]string, 0, w.LookbackDays)
+	for i := 0; i < w.LookbackDays; i++ {
+		indices = append(indices, w.Prefix+now.AddDate(0, 0, -i).Format(w.DateFormat))
+	}
+	return indices
+}
+
+// Strictness defines how to react to a response not matching expectations.
+type Strictness string
+
+const (
+	StrictnessIgnore = Strictness("ignore")
+	StrictnessWarn   = Strictness("warn")
+	StrictnessError  = Strictness("error")
+)
+
+// parseStrictness converts s to a Strictness, defaulting to StrictnessIgnore.
+func parseStrictness(s string) (Strictness, error) {
+	switch strictness := Strictness(strings.ToLower(s)); strictness {
+	case "":
+		return StrictnessIgnore, nil
+	case StrictnessIgnore, StrictnessWarn, StrictnessError:
+		return strictness, nil
+	default:
+		return "", fmt.Errorf("unsupported value %q, expected one of ignore, warn or error", s)
+	}
+}
+
+// QueryMode defines the ElasticSearch endpoint a query is run against.
+type QueryMode string
+
+const (
+	QueryModeSearch       = QueryMode("search")
+	QueryModeRollupSearch = QueryMode("rollup_search")
+	QueryModeCount        = QueryMode("count")
+)
+
 // QueryConfig defines a named query, to be referenced by one or multiple metrics.
 type QueryConfig struct {
-	Name         string               `yaml:"query_name"`             // the query name, to be referenced via `query_ref`
-	Query        string               `yaml:"query"`                  // Lucene query
-	Aggregations []*AggregationConfig `yaml:"aggregations,omitempty"` // aggregations
-
-	metrics []*MetricConfig // metrics referencing this query
+	Name                 string               `yaml:"query_name"`                          // the query name, to be referenced via `query_ref`
+	Query                string               `yaml:"query"`                               // Lucene query
+	RawQuery             string               `yaml:"raw_query,omitempty"`                 // ElasticSearch query DSL (JSON) sent as is, instead of the Lucene query
+	Aggregations         []*AggregationConfig `yaml:"aggregations,omitempty"`              // aggregations
+	ModeString           string               `yaml:"mode,omitempty"`                      // search (default), rollup_search or count
+	Routing              string               `yaml:"routing,omitempty"`                   // routing value, may reference target labels e.g. `{{ .tenant }}`
+	Preference           string               `yaml:"preference,omitempty"`                // search preference, may reference target labels
+	SearchType           string               `yaml:"search_type,omitempty"`               // query_then_fetch or dfs_query_then_fetch, ElasticSearch default if empty
+	IndexWindow          *IndexWindowConfig   `yaml:"index_window,omitempty"`              // query only the time based indices of the last days, rather than all
+	Index                string               `yaml:"index,omitempty"`                     // index, comma separated list of indices or patterns (e.g. `logs-*`) to query, all if empty
+	Size                 int                  `yaml:"size,omitempty"`                      // number of hits returned along with the aggregations, for source_field metrics to read; default 0
+	Timeout              model.Duration       `yaml:"timeout,omitempty"`                   // timeout of each run of the query, 0 means only the scrape timeout applies
+	SearchTimeout        model.Duration       `yaml:"search_timeout,omitempty"`            // server-side timeout of shard execution, partial results are returned past it; 0 means none
+	TotalPath            string               `yaml:"total_path,omitempty"`                // path of the response value used as total (e.g. `aggregations.all.doc_count`), default the total hits
+	NodeHeader           string               `yaml:"node_header,omitempty"`               // response header (e.g. X-Found-Handling-Instance) exported as `node` label
+	ExpectedAggregations []string             `yaml:"expected_aggregations,omitempty"`     // aggregation names expected in responses, default the configured ones
+	OnUnexpectedString   string               `yaml:"on_unexpected_aggregation,omitempty"` // ignore (default), warn or error on aggregations not expected
+	OnMissingString      string               `yaml:"on_missing_aggregation,omitempty"`    // ignore (default), warn or error on expected aggregations missing
+
+	metrics      []*MetricConfig // metrics referencing this query
+	rawQuery     json.RawMessage // RawQuery, validated
+	indices      []string        // Index split into indices
+	mode         QueryMode       // ModeString converted to QueryMode
+	onUnexpected Strictness      // OnUnexpectedString converted to Strictness
+	onMissing    Strictness      // OnMissingString converted to Strictness
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -579,8 +1843,98 @@ func (q *QueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if q.Name == "" {
 		return fmt.Errorf("missing name for query %+v", *q)
 	}
-	if q.Query == "" {
-		return fmt.Errorf("missing query literal for query %q", q.Name)
+	for _, index := range strings.Split(q.Index, ",") {
+		if index = strings.TrimSpace(index); index != "" {
+			q.indices = append(q.indices, index)
+		}
+	}
+	if len(q.indices) > 0 && q.IndexWindow != nil {
+		return fmt.Errorf("at most one of index and index_window must be specified for query %q", q.Name)
+	}
+	if (q.Query == "") == (q.RawQuery == "") {
+		return fmt.Errorf("exactly one of query and raw_query is required for query %q", q.Name)
+	}
+	if q.RawQuery != "" {
+		var parsed map[string]interface{}
+		if err := json.Unmarshal([]byte(q.RawQuery), &parsed); err != nil {
+			return fmt.Errorf("invalid raw_query for query %q, expected a JSON object: %s", q.Name, err)
+		}
+		q.rawQuery = json.RawMessage(q.RawQuery)
+	}
+	switch strings.ToLower(q.ModeString) {
+	case "", "search":
+		q.mode = QueryModeSearch
+	case "rollup_search":
+		q.mode = QueryModeRollupSearch
+	case "count":
+		q.mode = QueryModeCount
+	default:
+		return fmt.Errorf("unsupported mode for query %q: %s", q.Name, q.ModeString)
+	}
+	if q.mode == QueryModeRollupSearch && q.IndexWindow != nil {
+		// The daily indices may not all exist, which rollup search doesn't tolerate.
+		return fmt.Errorf("index_window is not supported in rollup_search mode, in query %q", q.Name)
+	}
+	if q.mode == QueryModeRollupSearch && len(q.indices) == 0 {
+		// Rollup search fails if the indices it's run against hold more than one rollup index, as all of them would.
+		return fmt.Errorf("rollup_search mode requires an index, in query %q", q.Name)
+	}
+	var err error
+	if q.onUnexpected, err = parseStrictness(q.OnUnexpectedString); err != nil {
+		return fmt.Errorf("invalid on_unexpected_aggregation for query %q: %s", q.Name, err)
+	}
+	if q.onMissing, err = parseStrictness(q.OnMissingString); err != nil {
+		return fmt.Errorf("invalid on_missing_aggregation for query %q: %s", q.Name, err)
+	}
+	switch q.SearchType {
+	case "", "query_then_fetch", "dfs_query_then_fetch":
+	default:
+		return fmt.Errorf("unsupported search_type for query %q: %s", q.Name, q.SearchType)
+	}
+	if q.Size < 0 {
+		return fmt.Errorf("size must be non-negative for query %q, have %d", q.Name, q.Size)
+	}
+	if q.Size > 0 && q.mode != QueryModeSearch {
+		return fmt.Errorf("size only applies to search mode, in query %q", q.Name)
+	}
+	if q.SearchTimeout < 0 {
+		return fmt.Errorf("search_timeout must be non-negative for query %q, have %s", q.Name, q.SearchTimeout)
+	}
+	if q.SearchTimeout > 0 && q.mode != QueryModeSearch {
+		return fmt.Errorf("search_timeout only applies to search mode, in query %q", q.Name)
+	}
+	if q.SearchType != "" && q.mode != QueryModeSearch {
+		return fmt.Errorf("search_type only applies to search mode, in query %q", q.Name)
+	}
+	if (q.Routing != "" || q.Preference != "") && q.mode == QueryModeRollupSearch {
+		return fmt.Errorf("routing and preference are not supported in rollup_search mode, in query %q", q.Name)
+	}
+	if q.TotalPath != "" {
+		if q.TotalPath = strings.TrimSpace(q.TotalPath); q.TotalPath == "" {
+			return fmt.Errorf("blank total_path for query %q", q.Name)
+		}
+	}
+	if len(q.Aggregations) > 0 && q.mode == QueryModeCount {
+		return fmt.Errorf("aggregations are not supported in count mode, in query %q", q.Name)
+	}
+	for _, agg := range q.Aggregations {
+		if agg.aggType.isPipeline() {
+			return fmt.Errorf("pipeline aggregation %q must be a sub-aggregation of a bucket aggregation, in query %q", agg.Name, q.Name)
+		}
+	}
+	names := make(map[string]bool)
+	for _, agg := range q.AllAggregations() {
+		// The data of each aggregation is looked up by name, no matter how deeply nested.
+		if names[agg.Name] {
+			return fmt.Errorf("duplicate aggregation name %q in query %q", agg.Name, q.Name)
+		}
+		names[agg.Name] = true
+	}
+	if _, err := template.New("routing").Parse(q.Routing); err != nil {
+		return fmt.Errorf("invalid routing for query %q: %s", q.Name, err)
+	}
+	if _, err := template.New("preference").Parse(q.Preference); err != nil {
+		return fmt.Errorf("invalid preference for query %q: %s", q.Name, err)
 	}
 
 	q.metrics = make([]*MetricConfig, 0, 2)
@@ -588,6 +1942,99 @@ func (q *QueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return checkOverflow(q.XXX, "metric")
 }
 
+// Indices returns the indices (or patterns) the query is restricted to, empty for all.
+func (q *QueryConfig) Indices() []string {
+	return q.indices
+}
+
+// RawQueryBody returns the validated raw_query, nil if the query is a Lucene one.
+func (q *QueryConfig) RawQueryBody() json.RawMessage {
+	return q.rawQuery
+}
+
+// AggregationDepth returns the nesting depth of the query's aggregations, 0 if it has none.
+func (q *QueryConfig) AggregationDepth() int {
+	return aggregationDepth(q.Aggregations)
+}
+
+func aggregationDepth(aggs []*AggregationConfig) int {
+	depth := 0
+	for _, agg := range aggs {
+		if d := 1 + aggregationDepth(agg.Aggregations); d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
+
+// AllAggregations returns the query's aggregations along with all their sub-aggregations, parents before children.
+func (q *QueryConfig) AllAggregations() []*AggregationConfig {
+	var all []*AggregationConfig
+	var walk func(aggs []*AggregationConfig)
+	walk = func(aggs []*AggregationConfig) {
+		for _, agg := range aggs {
+			all = append(all, agg)
+			walk(agg.Aggregations)
+		}
+	}
+	walk(q.Aggregations)
+	return all
+}
+
+// OnUnexpectedAggregation returns how to react to aggregations in the response that are not expected.
+func (q *QueryConfig) OnUnexpectedAggregation() Strictness {
+	if q.onUnexpected == "" {
+		return StrictnessIgnore
+	}
+	return q.onUnexpected
+}
+
+// OnMissingAggregation returns how to react to expected aggregations missing from the response.
+func (q *QueryConfig) OnMissingAggregation() Strictness {
+	if q.onMissing == "" {
+		return StrictnessIgnore
+	}
+	return q.onMissing
+}
+
+// ExpectedAggregationNames returns the names of the aggregations expected in the response: the explicitly configured
+// ones, or else the names of the query's aggregations (suggesters excluded).
+func (q *QueryConfig) ExpectedAggregationNames() []string {
+	if len(q.ExpectedAggregations) > 0 {
+		return q.ExpectedAggregations
+	}
+	names := make([]string, 0, len(q.Aggregations))
+	for _, agg := range q.Aggregations {
+		if agg.aggType != AggregationTypeSuggest {
+			names = append(names, agg.Name)
+		}
+	}
+	return names
+}
+
+// aggregation returns the query's (possibly nested) aggregation with the given name, nil if there is none.
+func (q *QueryConfig) aggregation(name string) *AggregationConfig {
+	for _, agg := range q.AllAggregations() {
+		if agg.Name == name {
+			return agg
+		}
+	}
+	return nil
+}
+
+// AggregationCount returns the total number of aggregations in the query, sub-aggregations included.
+func (q *QueryConfig) AggregationCount() int {
+	return len(q.AllAggregations())
+}
+
+// Mode returns the endpoint the query is run against, `_search` unless configured otherwise.
+func (q *QueryConfig) Mode() QueryMode {
+	if q.mode == "" {
+		return QueryModeSearch
+	}
+	return q.mode
+}
+
 // Secret special type for storing secrets.
 type Secret string
 
@@ -0,0 +1,332 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// mustCollectorConfig parses the given collector configuration, failing the test on error.
+func mustCollectorConfig(t *testing.T, text string) *CollectorConfig {
+	t.Helper()
+	var cc CollectorConfig
+	if err := yaml.Unmarshal([]byte(text), &cc); err != nil {
+		t.Fatalf("invalid collector config: %s", err)
+	}
+	return &cc
+}
+
+// assertInvalid fails the test unless unmarshalling text into out fails with an error containing want.
+func assertInvalid(t *testing.T, text string, out interface{}, want string) {
+	t.Helper()
+	err := yaml.Unmarshal([]byte(text), out)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected an error containing %q, got %v", want, err)
+	}
+}
+
+const nestedAggregations = `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: host
+        type: terms
+        field: host
+        aggregations:
+          - name: status
+            type: terms
+            field: status
+            aggregations:
+              - name: latency
+                type: avg
+                field: latency
+      - name: max_latency
+        type: max
+        field: latency
+metrics:
+  - metric_name: latency
+    type: gauge
+    help: Average latency by host and status.
+    query_ref: requests
+    aggregation_ref: latency
+`
+
+func TestQueryAggregationDepthAndCount(t *testing.T) {
+	q := mustCollectorConfig(t, nestedAggregations).Queries[0]
+	if got := q.AggregationDepth(); got != 3 {
+		t.Errorf("got depth %d, want 3", got)
+	}
+	if got := q.AggregationCount(); got != 4 {
+		t.Errorf("got count %d, want 4", got)
+	}
+}
+
+func TestGlobalMetricPrefix(t *testing.T) {
+	var gc GlobalConfig
+	if err := yaml.Unmarshal([]byte("metric_prefix: myapp_"), &gc); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, prefix := range []string{"my-app_", "1app_"} {
+		assertInvalid(t, "metric_prefix: "+prefix, &GlobalConfig{}, "not a valid metric name prefix")
+	}
+}
+
+func TestIndexWindowIndices(t *testing.T) {
+	var w IndexWindowConfig
+	if err := yaml.Unmarshal([]byte("prefix: logs-\nlookback_days: 3"), &w); err != nil {
+		t.Fatalf("invalid index_window: %s", err)
+	}
+	now := time.Date(2024, 1, 2, 22, 30, 0, 0, time.UTC)
+	if got, want := w.Indices(now), []string{"logs-2024.01.02", "logs-2024.01.01", "logs-2023.12.31"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got indices %v, want %v", got, want)
+	}
+
+	// Already the next day in Tokyo.
+	if err := yaml.Unmarshal([]byte("prefix: logs-\nlookback_days: 2\ntime_zone: Asia/Tokyo\ndate_format: 20060102"), &w); err != nil {
+		t.Fatalf("invalid index_window: %s", err)
+	}
+	if got, want := w.Indices(now), []string{"logs-20240103", "logs-20240102"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got indices %v, want %v", got, want)
+	}
+
+	assertInvalid(t, "prefix: logs-\nlookback_days: 0", &IndexWindowConfig{}, "lookback_days must be at least 1")
+	assertInvalid(t, "prefix: logs-\ntime_zone: Nowhere/Special", &IndexWindowConfig{}, "invalid index_window.time_zone")
+}
+
+const duplicateAggregations = `
+collector_name: test
+%s
+queries:
+  - query_name: web
+    query: "service:web"
+    aggregations:
+      - name: by_status
+        type: terms
+        field: status
+  - query_name: api
+    query: "service:api"
+    aggregations:
+      - name: by_status
+        type: terms
+        field: status
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by status.
+    query_ref: web
+    aggregation_ref: by_status
+  - metric_name: %s
+    type: gauge
+    help: Requests by status.
+    query_ref: api
+    aggregation_ref: by_status
+`
+
+func TestCollectorDuplicateAggregations(t *testing.T) {
+	assertInvalid(t, fmt.Sprintf(duplicateAggregations, "on_duplicate_aggregation: error", "requests"), &CollectorConfig{},
+		`aggregation "by_status" of both queries "web" and "api" feeds metric "requests" of collector "test"`)
+
+	// Only warned about by default.
+	mustCollectorConfig(t, fmt.Sprintf(duplicateAggregations, "", "requests"))
+	// Different metrics don't collide.
+	mustCollectorConfig(t, fmt.Sprintf(duplicateAggregations, "on_duplicate_aggregation: error", "api_requests"))
+
+	assertInvalid(t, fmt.Sprintf(duplicateAggregations, "on_duplicate_aggregation: panic", "requests"), &CollectorConfig{},
+		`invalid on_duplicate_aggregation for collector "test"`)
+}
+
+func TestQueryRawQuery(t *testing.T) {
+	var qc QueryConfig
+	if err := yaml.Unmarshal([]byte(`
+query_name: errors
+raw_query: '{"bool": {"filter": [{"term": {"level": "error"}}]}}'
+`), &qc); err != nil {
+		t.Fatalf("invalid query config: %s", err)
+	}
+	if got, want := string(qc.RawQueryBody()), `{"bool": {"filter": [{"term": {"level": "error"}}]}}`; got != want {
+		t.Errorf("got raw query %s, want %s", got, want)
+	}
+
+	assertInvalid(t, "query_name: errors\nquery: \"level:error\"\nraw_query: '{\"match_all\": {}}'", &QueryConfig{},
+		`exactly one of query and raw_query is required for query "errors"`)
+	assertInvalid(t, "query_name: errors", &QueryConfig{}, `exactly one of query and raw_query is required for query "errors"`)
+	assertInvalid(t, "query_name: errors\nraw_query: '[1, 2]'", &QueryConfig{}, `invalid raw_query for query "errors", expected a JSON object`)
+	assertInvalid(t, "query_name: errors\nraw_query: '{\"bool\":'", &QueryConfig{}, `invalid raw_query for query "errors", expected a JSON object`)
+}
+
+func TestQueryCountMode(t *testing.T) {
+	assertInvalid(t, `
+query_name: errors
+query: "level:error"
+mode: count
+aggregations:
+  - name: host
+    type: terms
+    field: host
+`, &QueryConfig{}, `aggregations are not supported in count mode, in query "errors"`)
+	assertInvalid(t, "query_name: errors\nquery: \"*\"\nmode: counting", &QueryConfig{}, "unsupported mode")
+}
+
+const rollupCollector = `
+collector_name: test
+queries:
+  - query_name: rollup
+    query: "*"
+    index: rollup-logs
+    mode: rollup_search
+    aggregations:
+      - name: host
+        type: terms
+        field: host
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host.
+    query_ref: rollup
+    aggregation_ref: host
+`
+
+func TestQueryRollupSearch(t *testing.T) {
+	assertInvalid(t, "query_name: rollup\nquery: \"*\"\nmode: rollup_search", &QueryConfig{},
+		`rollup_search mode requires an index, in query "rollup"`)
+
+	// No total, rollup search reports 0 hits.
+	if mc := mustCollectorConfig(t, rollupCollector).Metrics[0]; mc.TrackTotal {
+		t.Errorf("got a total tracked for rollup metric %s", mc.Name)
+	}
+	for _, setting := range []string{"track_total: true", "value_type: percent"} {
+		assertInvalid(t, rollupCollector+"    "+setting+"\n", &CollectorConfig{},
+			"track_total and percentage value type require a total_path in rollup_search mode, for metric requests")
+	}
+	assertInvalid(t, "query_name: rollup\nquery: \"*\"\nindex_window: {prefix: rollup-logs-}\nmode: rollup_search", &QueryConfig{},
+		`index_window is not supported in rollup_search mode, in query "rollup"`)
+	for _, setting := range []string{"routing: tenant-a", "preference: _local"} {
+		assertInvalid(t, "query_name: rollup\nquery: \"*\"\nindex: rollup-logs\nmode: rollup_search\n"+setting, &QueryConfig{},
+			`routing and preference are not supported in rollup_search mode, in query "rollup"`)
+	}
+	text := strings.Replace(rollupCollector, "mode: rollup_search", "mode: rollup_search\n    total_path: aggregations.all.value", 1)
+	if mc := mustCollectorConfig(t, text+"    value_type: percent\n").Metrics[0]; !mc.TrackTotal {
+		t.Errorf("got no total tracked for rollup metric %s with a total_path", mc.Name)
+	}
+}
+
+func TestQueryTotalPath(t *testing.T) {
+	assertInvalid(t, "query_name: errors\nquery: \"*\"\ntotal_path: \" \"", &QueryConfig{}, `blank total_path for query "errors"`)
+
+	var qc QueryConfig
+	if err := yaml.Unmarshal([]byte("query_name: errors\nquery: \"*\"\ntotal_path: \" count \""), &qc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if qc.TotalPath != "count" {
+		t.Errorf("got total_path %q, want it trimmed", qc.TotalPath)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	assertInvalid(t, "cert_file: client.pem", &TLSConfig{}, "cert_file and key_file must be specified together")
+	assertInvalid(t, "key_file: client-key.pem", &TLSConfig{}, "cert_file and key_file must be specified together")
+	assertInvalid(t, "ca: ca.pem", &TLSConfig{}, "unknown fields in tls_config")
+}
+
+func TestTargetCloudID(t *testing.T) {
+	var tc TargetConfig
+	if err := yaml.Unmarshal([]byte("cloud_id: \"test:ZXMuZXhhbXBsZS5jb20kYWJjMTIzJGtpYg==\"\ncollectors: [test]"), &tc); err != nil {
+		t.Fatalf("invalid target config: %s", err)
+	}
+
+	assertInvalid(t, "url: http://es:9200\ncloud_id: \"test:ZXMuZXhhbXBsZS5jb20kYWJjMTIzJGtpYg==\"\ncollectors: [test]",
+		&TargetConfig{}, "exactly one of url and cloud_id is required for target")
+	assertInvalid(t, "collectors: [test]", &TargetConfig{}, "exactly one of url and cloud_id is required for target")
+	assertInvalid(t, "cloud_id: \"test:ZXMuZXhhbXBsZS5jb20kYWJjMTIzJGtpYg==\"\nfallback_urls: [http://es:9200]\ncollectors: [test]",
+		&TargetConfig{}, "fallback_urls are not supported with cloud_id for target")
+}
+
+func TestTargetServiceToken(t *testing.T) {
+	for _, other := range []string{"username: exporter", "password: secret", "api_key: a2V5", "api_key_file: /run/secrets/api_key"} {
+		assertInvalid(t, "url: http://es:9200\nservice_token: AAEAAWVsYXN0aWM\n"+other+"\ncollectors: [test]", &TargetConfig{},
+			"service_token is exclusive with username, password, api_key and api_key_file for target")
+	}
+}
+
+func TestTargetNodeURLs(t *testing.T) {
+	if got := SplitURLs("http://es1:9200, http://es2:9200,http://es3:9200"); !reflect.DeepEqual(got,
+		[]string{"http://es1:9200", "http://es2:9200", "http://es3:9200"}) {
+		t.Errorf("got node URLs %q", got)
+	}
+	for _, urls := range []string{"http://es1:9200,", "http://es1:9200, ,http://es3:9200"} {
+		assertInvalid(t, "url: \""+urls+"\"\ncollectors: [test]", &TargetConfig{}, "empty node URL in comma separated URLs for target")
+	}
+}
+
+func TestGlobalHealthCheck(t *testing.T) {
+	assertInvalid(t, "health_wait_for_status: green", &GlobalConfig{}, "global.health_wait_for_status requires global.health_timeout")
+	assertInvalid(t, "health_timeout: 5s\nhealth_wait_for_status: blue", &GlobalConfig{}, "unsupported global.health_wait_for_status: blue")
+	assertInvalid(t, "health_level: nodes", &GlobalConfig{}, "unsupported global.health_level: nodes")
+}
+
+func TestGlobalTransport(t *testing.T) {
+	assertInvalid(t, "max_idle_conns: -1", &GlobalConfig{}, "global.max_idle_conns and max_idle_conns_per_host must be non-negative")
+	assertInvalid(t, "max_idle_conns_per_host: -1", &GlobalConfig{}, "global.max_idle_conns and max_idle_conns_per_host must be non-negative")
+}
+
+func TestTargetProxyURL(t *testing.T) {
+	for _, proxy := range []string{"http://proxy:3128", "https://proxy:3128", "socks5://proxy:1080"} {
+		var tc TargetConfig
+		if err := yaml.Unmarshal([]byte("url: http://es:9200\nproxy_url: "+proxy+"\ncollectors: [test]"), &tc); err != nil {
+			t.Errorf("%s: %s", proxy, err)
+		} else if tc.Proxy().String() != proxy {
+			t.Errorf("got proxy %s, want %s", tc.Proxy(), proxy)
+		}
+	}
+	assertInvalid(t, "url: http://es:9200\nproxy_url: ftp://proxy:21\ncollectors: [test]", &TargetConfig{},
+		`unsupported proxy_url scheme "ftp" for target, expected one of http, https or socks5`)
+}
+
+func TestTargetHeaders(t *testing.T) {
+	assertInvalid(t, "url: http://es:9200\nheaders: {Authorization: Basic Zm9v}\ncollectors: [test]", &TargetConfig{},
+		"the Authorization header is set from the credentials, it can't be in headers for target")
+	assertInvalid(t, "url: http://es:9200\nheaders: {\" \": acme}\ncollectors: [test]", &TargetConfig{}, "empty header name for target")
+}
+
+func TestCollectorMaxConcurrentQueries(t *testing.T) {
+	assertInvalid(t, strings.Replace(nestedAggregations, "collector_name: test\n", "collector_name: test\nmax_concurrent_queries: -1\n", 1),
+		&CollectorConfig{}, `max_concurrent_queries must be non-negative for collector "test", have -1`)
+}
+
+func TestGlobalMetricChannelCapacity(t *testing.T) {
+	var gc GlobalConfig
+	if err := yaml.Unmarshal([]byte("{}"), &gc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if gc.MetricChanCap != 1000 {
+		t.Errorf("got a default capacity of %d, want 1000", gc.MetricChanCap)
+	}
+	for _, capacity := range []string{"0", "-1"} {
+		assertInvalid(t, "metric_channel_capacity: "+capacity, &GlobalConfig{}, "global.metric_channel_capacity must be strictly positive")
+	}
+}
+
+func TestAggregationStatLabel(t *testing.T) {
+	var agg AggregationConfig
+	if err := yaml.Unmarshal([]byte("name: latency\ntype: stats\nfield: latency"), &agg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if agg.StatLabel != "latency" {
+		t.Errorf("got stat label %q, want the aggregation name", agg.StatLabel)
+	}
+	assertInvalid(t, "name: latency-stats\ntype: stats\nfield: latency", &AggregationConfig{},
+		`invalid stat label "latency-stats" for aggregation "latency-stats", set a valid stat_label`)
+	assertInvalid(t, "name: latency\ntype: extended_stats\nfield: latency\nstat_label: 1st", &AggregationConfig{},
+		`invalid stat label "1st" for aggregation "latency"`)
+	if err := yaml.Unmarshal([]byte("name: latency-stats\ntype: stats\nfield: latency\nstat_label: stat"), &AggregationConfig{}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	assertInvalid(t, "name: hosts\ntype: terms\nfield: host\nstat_label: stat", &AggregationConfig{},
+		`stat_label only applies to stats and extended_stats aggregations, in aggregation "hosts"`)
+}
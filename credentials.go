@@ -0,0 +1,49 @@
+package elastic_exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyFile provides an API key stored in a file. The file is re-read whenever its modification time changes, so
+// rotated keys are picked up without restarting the exporter.
+type apiKeyFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	key     string
+}
+
+// newAPIKeyFile returns an apiKeyFile reading the API key from the given path.
+func newAPIKeyFile(path string) *apiKeyFile {
+	return &apiKeyFile{path: path}
+}
+
+// Get returns the current API key and whether it changed since the previous call.
+func (f *apiKeyFile) Get() (string, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", false, err
+	}
+	if info.ModTime().Equal(f.modTime) && f.key != "" {
+		return f.key, false, nil
+	}
+
+	buf, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", false, err
+	}
+	key := strings.TrimSpace(string(buf))
+	changed := key != f.key
+	f.key = key
+	f.modTime = info.ModTime()
+
+	return key, changed, nil
+}
@@ -0,0 +1,73 @@
+package elastic_exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"iss.digital/mt/elastic_exporter/config"
+)
+
+// writeKeyFile writes key to path, with a modification time of modTime.
+func writeKeyFile(t *testing.T, path, key string, modTime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_key")
+	now := time.Now()
+	writeKeyFile(t, path, "first", now)
+	f := newAPIKeyFile(path)
+
+	for _, want := range []struct {
+		key     string
+		changed bool
+	}{{"first", true}, {"first", false}} {
+		key, changed, err := f.Get()
+		if err != nil || key != want.key || changed != want.changed {
+			t.Errorf("Get() = %q, %t, %v; want %q, %t", key, changed, err, want.key, want.changed)
+		}
+	}
+
+	writeKeyFile(t, path, "second", now.Add(time.Second))
+	if key, changed, err := f.Get(); err != nil || key != "second" || !changed {
+		t.Errorf("Get() = %q, %t, %v; want %q, true", key, changed, err, "second")
+	}
+}
+
+func TestTargetAPIKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_key")
+	now := time.Now()
+	writeKeyFile(t, path, "first", now)
+
+	transport := &recordingTransport{handler: respondRoutes(map[string]string{"/_cluster/health": greenHealth})}
+	tt := newTestTargetFor(t, nil, &config.DataSourceConfig{URL: "http://es:9200", APIKeyFile: path})
+	tt.transport = transport
+
+	if _, err := tt.ensureUp(context.Background()); err != nil {
+		t.Fatalf("ensureUp: %s", err)
+	}
+	writeKeyFile(t, path, "second", now.Add(time.Second))
+	if _, err := tt.ensureUp(context.Background()); err != nil {
+		t.Fatalf("ensureUp: %s", err)
+	}
+
+	requests := transport.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+	for i, want := range []string{"APIKey first", "APIKey second"} {
+		if got := requests[i].Header.Get("Authorization"); got != want {
+			t.Errorf("request %d: got Authorization %q, want %q", i, got, want)
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"sync"
+	"time"
 
+	log "github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -14,6 +16,23 @@ import (
 
 var dsnOverride = flag.String("config.data-source-name", "", "Data source name to override the value in the configuration file with.")
 
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "elastic_exporter",
+		Name:      "config_reload_success",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+	configLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "elastic_exporter",
+		Name:      "config_last_reload_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess, configLastReload)
+}
+
 // Exporter is a prometheus.Gatherer that gathers ElasticSearch metrics from targets and merges them with the default registry.
 type Exporter interface {
 	prometheus.Gatherer
@@ -22,36 +41,64 @@ type Exporter interface {
 	WithContext(context.Context) Exporter
 	// Config returns the Exporter's underlying Config object.
 	Config() *config.Config
+	// Reload reloads the configuration file and recreates all targets. On failure the previous configuration stays
+	// active.
+	Reload() error
 }
 
 type exporter struct {
+	configFile string
+
+	// Protects config, targets and targetSem, replaced on reload.
+	mu      sync.RWMutex
 	config  *config.Config
 	targets []Target
+	// Limits the number of targets collected concurrently (across scrapes), nil if unlimited.
+	targetSem chan struct{}
 
 	ctx context.Context
 }
 
 // NewExporter returns a new Exporter with the provided config.
 func NewExporter(configFile string) (Exporter, error) {
-	c, err := config.Load(configFile)
+	c, targets, err := load(configFile)
 	if err != nil {
 		return nil, err
 	}
+	configReloadSuccess.Set(1)
+	configLastReload.SetToCurrentTime()
+
+	return &exporter{
+		configFile: configFile,
+		config:     c,
+		targets:    targets,
+		targetSem:  newTargetSem(c),
+		ctx:        context.Background(),
+	}, nil
+}
+
+// load loads the configuration file and creates the targets it defines.
+func load(configFile string) (*config.Config, []Target, error) {
+	c, err := config.Load(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Override the URL if requested (and in single target mode).
 	if *dsnOverride != "" {
 		if len(c.Jobs) > 0 {
-			return nil, fmt.Errorf("The config.data-source-name flag (value %q) only applies in single target mode", *dsnOverride)
+			return nil, nil, fmt.Errorf("The config.data-source-name flag (value %q) only applies in single target mode", *dsnOverride)
 		} else {
 			c.Target.URL = config.Secret(*dsnOverride)
+			c.Target.CloudID = ""
 		}
 	}
 
 	var targets []Target
 	if c.Target != nil {
-		target, err := NewTarget("", "", string(c.Target.URL), string(c.Target.Username), string(c.Target.Password), c.Target.Collectors(), nil, c.Globals)
+		target, err := NewTarget("", "", &c.Target.DataSourceConfig, c.Target.Collectors(), nil, c.Globals)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		targets = []Target{target}
 	} else {
@@ -59,31 +106,82 @@ func NewExporter(configFile string) (Exporter, error) {
 		for _, jc := range c.Jobs {
 			job, err := NewJob(jc, c.Globals)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			targets = append(targets, job.Targets()...)
 		}
 	}
 
-	return &exporter{
-		config:  c,
-		targets: targets,
-		ctx:     context.Background(),
-	}, nil
+	if c.Globals.WarmupTimeout > 0 {
+		warmup(targets, time.Duration(c.Globals.WarmupTimeout))
+	}
+
+	return c, targets, nil
+}
+
+// newTargetSem returns the semaphore limiting the number of targets collected concurrently, nil if unlimited.
+func newTargetSem(c *config.Config) chan struct{} {
+	if c.Globals.MaxTargets > 0 {
+		return make(chan struct{}, c.Globals.MaxTargets)
+	}
+	return nil
+}
+
+// warmup connects to all targets in parallel, so that the first scrape doesn't pay for it. Failures are only logged,
+// targets that are down will be retried on scrape as usual.
+func warmup(targets []Target, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(len(targets))
+	for _, t := range targets {
+		go func(target Target) {
+			defer wg.Done()
+			if err := target.Warmup(ctx); err != nil {
+				log.Warningf("Target warmup failed: %s", err)
+			}
+		}(t)
+	}
+	wg.Wait()
 }
 
 func (e *exporter) WithContext(ctx context.Context) Exporter {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	return &exporter{
-		config:  e.config,
-		targets: e.targets,
-		ctx:     ctx,
+		configFile: e.configFile,
+		config:     e.config,
+		targets:    e.targets,
+		targetSem:  e.targetSem,
+		ctx:        ctx,
 	}
 }
 
+// Reload implements Exporter.
+func (e *exporter) Reload() error {
+	c, targets, err := load(e.configFile)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+
+	e.mu.Lock()
+	e.config = c
+	e.targets = targets
+	e.targetSem = newTargetSem(c)
+	e.mu.Unlock()
+
+	configReloadSuccess.Set(1)
+	configLastReload.SetToCurrentTime()
+	return nil
+}
+
 // Gather implements prometheus.Gatherer.
 func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 	var (
-		metricChan = make(chan Metric, capMetricChan)
+		metricChan = make(chan Metric, e.config.Globals.MetricChanCap)
 		errs       prometheus.MultiError
 	)
 
@@ -92,6 +190,14 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 	for _, t := range e.targets {
 		go func(target Target) {
 			defer wg.Done()
+			if e.targetSem != nil {
+				select {
+				case e.targetSem <- struct{}{}:
+					defer func() { <-e.targetSem }()
+				case <-e.ctx.Done():
+					// Out of time waiting for our turn, the target will only report the context error.
+				}
+			}
 			target.Collect(e.ctx, metricChan)
 		}(t)
 	}
@@ -127,6 +233,10 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 				dtoMetricFamily.Type = dto.MetricType_GAUGE.Enum()
 			case dtoMetric.Counter != nil:
 				dtoMetricFamily.Type = dto.MetricType_COUNTER.Enum()
+			case dtoMetric.Summary != nil:
+				dtoMetricFamily.Type = dto.MetricType_SUMMARY.Enum()
+			case dtoMetric.Histogram != nil:
+				dtoMetricFamily.Type = dto.MetricType_HISTOGRAM.Enum()
 			default:
 				errs = append(errs, fmt.Errorf("don't know how to handle metric %v", dtoMetric))
 				continue
@@ -146,5 +256,7 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 
 // Config implements Exporter.
 func (e *exporter) Config() *config.Config {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	return e.config
 }
@@ -0,0 +1,148 @@
+package elastic_exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"iss.digital/mt/elastic_exporter/config"
+	"iss.digital/mt/elastic_exporter/errors"
+)
+
+// concurrencyTarget is a Target recording how many of its kind collect concurrently.
+type concurrencyTarget struct {
+	mu      *sync.Mutex
+	running *int
+	peak    *int
+}
+
+func (t concurrencyTarget) Collect(ctx context.Context, ch chan<- Metric) {
+	t.mu.Lock()
+	*t.running++
+	if *t.running > *t.peak {
+		*t.peak = *t.running
+	}
+	t.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	t.mu.Lock()
+	*t.running--
+	t.mu.Unlock()
+}
+
+func (t concurrencyTarget) Warmup(ctx context.Context) errors.WithContext {
+	return nil
+}
+
+// newTestExporter returns an exporter for the given targets and global configuration.
+func newTestExporter(gc *config.GlobalConfig, targets ...Target) *exporter {
+	c := &config.Config{Globals: gc}
+	return &exporter{
+		config:    c,
+		targets:   targets,
+		targetSem: newTargetSem(c),
+		ctx:       context.Background(),
+	}
+}
+
+func TestExporterMaxConcurrentTargets(t *testing.T) {
+	for _, tc := range []struct {
+		max, want int
+	}{
+		{2, 2},
+		{0, 8},
+	} {
+		var (
+			mu            sync.Mutex
+			running, peak int
+			targets       []Target
+		)
+		for i := 0; i < 8; i++ {
+			targets = append(targets, concurrencyTarget{mu: &mu, running: &running, peak: &peak})
+		}
+		gc := mustGlobalConfig(t, "")
+		gc.MaxTargets = tc.max
+
+		newTestExporter(gc, targets...).Gather()
+		if (tc.max > 0 && peak > tc.max) || (tc.max == 0 && peak < 2) {
+			t.Errorf("max_concurrent_targets %d: got %d targets collecting at once", tc.max, peak)
+		}
+	}
+}
+
+const exporterConfig = `
+global: {}
+target:
+  url: http://es:9200
+  collectors: [test]
+collectors:
+  - collector_name: test
+    queries:
+      - query_name: hits
+        query: "*"
+    metrics:
+      - metric_name: hits
+        type: gauge
+        help: Hits.
+        query_ref: hits
+`
+
+func TestExporterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "elastic_exporter.yml")
+	writeConfig := func(text string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(exporterConfig)
+	configLastReload.Set(0)
+	e, err := NewExporter(path)
+	if err != nil {
+		t.Fatalf("NewExporter: %s", err)
+	}
+	if got := testutil.ToFloat64(configReloadSuccess); got != 1 {
+		t.Errorf("got config_reload_success %g after loading, want 1", got)
+	}
+	loaded := testutil.ToFloat64(configLastReload)
+	if loaded == 0 {
+		t.Error("config_last_reload_timestamp_seconds not set after loading")
+	}
+
+	writeConfig("global: {}\ntarget: {url: http://es:9200, collectors: [missing]}")
+	if err := e.Reload(); err == nil {
+		t.Error("expected an error reloading an invalid configuration")
+	}
+	if got := testutil.ToFloat64(configReloadSuccess); got != 0 {
+		t.Errorf("got config_reload_success %g after a failed reload, want 0", got)
+	}
+	if got := testutil.ToFloat64(configLastReload); got != loaded {
+		t.Errorf("config_last_reload_timestamp_seconds changed from %g to %g on a failed reload", loaded, got)
+	}
+	// The previous configuration stays active.
+	if got := e.Config().Collectors[0].Name; got != "test" {
+		t.Errorf("got collector %q after a failed reload, want test", got)
+	}
+
+	configLastReload.Set(0)
+	writeConfig(strings.Replace(exporterConfig, "help: Hits.", "help: All hits.", 1))
+	if err := e.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	if got := testutil.ToFloat64(configReloadSuccess); got != 1 {
+		t.Errorf("got config_reload_success %g after a successful reload, want 1", got)
+	}
+	if got := testutil.ToFloat64(configLastReload); got == 0 {
+		t.Error("config_last_reload_timestamp_seconds not updated on a successful reload")
+	}
+	if got := e.Config().Collectors[0].Metrics[0].Help; got != "All hits." {
+		t.Errorf("got help %q after a successful reload, want %q", got, "All hits.")
+	}
+}
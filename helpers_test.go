@@ -0,0 +1,290 @@
+package elastic_exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v2"
+	"iss.digital/mt/elastic_exporter/config"
+)
+
+// mustGlobalConfig parses the given global configuration, with defaults applied.
+func mustGlobalConfig(t *testing.T, text string) *config.GlobalConfig {
+	t.Helper()
+	if text == "" {
+		text = "{}"
+	}
+	var gc config.GlobalConfig
+	if err := yaml.Unmarshal([]byte(text), &gc); err != nil {
+		t.Fatalf("invalid global config: %s", err)
+	}
+	return &gc
+}
+
+// mustCollectorConfig parses the given collector configuration, failing the test on error.
+func mustCollectorConfig(t *testing.T, text string) *config.CollectorConfig {
+	t.Helper()
+	var cc config.CollectorConfig
+	if err := yaml.Unmarshal([]byte(text), &cc); err != nil {
+		t.Fatalf("invalid collector config: %s", err)
+	}
+	return &cc
+}
+
+// mustMetricFamily returns the metric family of the first metric of the given collector configuration.
+func mustMetricFamily(t *testing.T, text string) *MetricFamily {
+	t.Helper()
+	cc := mustCollectorConfig(t, text)
+	mf, err := NewMetricFamily("test", cc.Metrics[0], nil, mustGlobalConfig(t, ""))
+	if err != nil {
+		t.Fatalf("NewMetricFamily: %s", err)
+	}
+	return mf
+}
+
+// mustCollector returns a collector for the given collector configuration.
+func mustCollector(t *testing.T, text string, gc *config.GlobalConfig) Collector {
+	t.Helper()
+	c, err := NewCollector("test", mustCollectorConfig(t, text), nil, gc)
+	if err != nil {
+		t.Fatalf("NewCollector: %s", err)
+	}
+	return c
+}
+
+// collectMetrics runs f and returns the metrics it sends, in order.
+func collectMetrics(f func(ch chan<- Metric)) []Metric {
+	ch := make(chan Metric)
+	done := make(chan struct{})
+	var metrics []Metric
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	f(ch)
+	close(ch)
+	<-done
+	return metrics
+}
+
+// formatMetrics formats the given metrics much like the text exposition format, e.g. `name{label="value"} 1`. Invalid
+// metrics are formatted as `error: ` followed by the error.
+func formatMetrics(metrics []Metric) []string {
+	lines := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			lines = append(lines, "error: "+err.Error())
+			continue
+		}
+		pairs := make([]string, 0, len(out.Label))
+		for _, l := range out.Label {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+		}
+		labels := ""
+		if len(pairs) > 0 {
+			labels = "{" + strings.Join(pairs, ",") + "}"
+		}
+
+		var value string
+		switch {
+		case out.Gauge != nil:
+			value = formatFloat(out.Gauge.GetValue())
+		case out.Counter != nil:
+			value = formatFloat(out.Counter.GetValue())
+		case out.Summary != nil:
+			quantiles := make([]string, 0, len(out.Summary.Quantile))
+			for _, q := range out.Summary.Quantile {
+				quantiles = append(quantiles, formatFloat(q.GetQuantile())+":"+formatFloat(q.GetValue()))
+			}
+			value = fmt.Sprintf("summary count=%d quantiles=%s", out.Summary.GetSampleCount(), strings.Join(quantiles, ","))
+		case out.Histogram != nil:
+			buckets := make([]string, 0, len(out.Histogram.Bucket))
+			for _, b := range out.Histogram.Bucket {
+				buckets = append(buckets, formatFloat(b.GetUpperBound())+":"+strconv.FormatUint(b.GetCumulativeCount(), 10))
+			}
+			value = fmt.Sprintf("histogram count=%d buckets=%s", out.Histogram.GetSampleCount(), strings.Join(buckets, ","))
+		}
+		lines = append(lines, m.Desc().Name()+labels+" "+value)
+	}
+	return lines
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// linesOf returns the lines of the named metric, as formatted by formatMetrics.
+func linesOf(lines []string, name string) []string {
+	var res []string
+	for _, l := range lines {
+		if strings.HasPrefix(l, name+"{") || strings.HasPrefix(l, name+" ") {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// errorLines returns the invalid metric lines, as formatted by formatMetrics.
+func errorLines(lines []string) []string {
+	var res []string
+	for _, l := range lines {
+		if strings.HasPrefix(l, "error: ") {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// assertLines fails the test unless got and want hold the same lines, in the same order.
+func assertLines(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+}
+
+// assertSortedLines is assertLines ignoring the order of the lines.
+func assertSortedLines(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	got = append([]string(nil), got...)
+	want = append([]string(nil), want...)
+	sort.Strings(got)
+	sort.Strings(want)
+	assertLines(t, got, want...)
+}
+
+// recordedRequest is a request received by a testServer.
+type recordedRequest struct {
+	Method string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+// testServer is a fake ElasticSearch node, recording the requests it receives and answering them with a handler.
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+// newTestServer starts a testServer answering requests with handler, stopped at the end of the test.
+func newTestServer(t *testing.T, handler http.HandlerFunc) *testServer {
+	t.Helper()
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, recordedRequest{
+			Method: r.Method,
+			Host:   r.Host,
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Header: r.Header.Clone(),
+			Body:   string(body),
+		})
+		s.mu.Unlock()
+		r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Requests returns the requests received so far.
+func (s *testServer) Requests() []recordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]recordedRequest(nil), s.requests...)
+}
+
+// esClient returns an ElasticSearch client connected to the server.
+func (s *testServer) esClient(t *testing.T) *elasticsearch.Client {
+	t.Helper()
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{s.URL}})
+	if err != nil {
+		t.Fatalf("NewClient: %s", err)
+	}
+	return client
+}
+
+// respondJSON returns a handler answering all requests with the given JSON body.
+func respondJSON(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}
+}
+
+// respondRoutes returns a handler answering requests with the JSON body of the route their path ends with, 404 if
+// none matches. The `/` route only matches the root path.
+func respondRoutes(routes map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for route, body := range routes {
+			if r.URL.Path == route || (route != "/" && strings.HasSuffix(r.URL.Path, route)) {
+				respondJSON(body)(w, r)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}
+}
+
+// recordingTransport is a http.RoundTripper recording the requests it receives and answering them with a handler,
+// without any network involved.
+type recordingTransport struct {
+	handler http.HandlerFunc
+
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	rt.mu.Lock()
+	rt.requests = append(rt.requests, recordedRequest{
+		Method: req.Method,
+		Host:   req.URL.Host,
+		Path:   req.URL.Path,
+		Query:  req.URL.Query(),
+		Header: req.Header.Clone(),
+		Body:   string(body),
+	})
+	rt.mu.Unlock()
+
+	r := req.Clone(req.Context())
+	r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+	rec := httptest.NewRecorder()
+	rt.handler(rec, r)
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// Requests returns the requests received so far.
+func (rt *recordingTransport) Requests() []recordedRequest {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([]recordedRequest(nil), rt.requests...)
+}
@@ -41,7 +41,7 @@ func NewJob(jc *config.JobConfig, gc *config.GlobalConfig) (Job, errors.WithCont
 				}
 				constLabels[name] = value
 			}
-			t, err := NewTarget(j.logContext, tname, string(dsn.Url), string(dsn.Username), string(dsn.Password), jc.Collectors(), constLabels, gc)
+			t, err := NewTarget(j.logContext, tname, dsn, jc.Collectors(), constLabels, gc)
 			if err != nil {
 				return nil, err
 			}
@@ -1,12 +1,19 @@
 package elastic_exporter
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"sort"
+	"strconv"
+	"sync"
+	"time"
 
+	log "github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/tidwall/gjson"
 	"iss.digital/mt/elastic_exporter/config"
 	"iss.digital/mt/elastic_exporter/errors"
 )
@@ -20,6 +27,17 @@ type MetricDesc interface {
 	LogContext() string
 }
 
+// maxDeltaSeries is the maximum number of series a delta metric keeps the previous values of. Values of further series
+// are dropped, until idle ones are forgotten.
+const maxDeltaSeries = 10000
+
+// deltaIdleScrapes is the number of scrapes a delta metric keeps track of a series it no longer sees, e.g. a terms bucket
+// rotated out. The series is forgotten past that, and starts counting afresh if it comes back.
+const deltaIdleScrapes = 10
+
+// otherLabelValue is the label value of the sample accumulating values cut off by `top_n`.
+const otherLabelValue = "other"
+
 type labelPair struct {
 	key   string
 	value string
@@ -32,12 +50,66 @@ type labelPair struct {
 // MetricFamily implements MetricDesc for ElasticSearch metrics, with logic for populating its filters and values from query result.
 type MetricFamily struct {
 	config      *config.MetricConfig
+	name        string
+	help        string
 	constLabels []*dto.LabelPair
+	deltas      *deltaState // previous values and counters by label set, nil unless the metric is a delta
 	logContext  string
 }
 
+// deltaState keeps the state of a delta metric across scrapes.
+type deltaState struct {
+	mu       sync.Mutex
+	scrape   uint64 // number of scrapes so far
+	previous map[string]float64
+	counters map[string]float64
+	lastSeen map[string]uint64 // scrape each series was last seen on
+}
+
+// nextScrape starts a new scrape, forgetting the series not seen on any of the last deltaIdleScrapes ones.
+func (s *deltaState) nextScrape() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scrape++
+	for labels, seen := range s.lastSeen {
+		if s.scrape-seen > deltaIdleScrapes {
+			delete(s.previous, labels)
+			delete(s.counters, labels)
+			delete(s.lastSeen, labels)
+		}
+	}
+}
+
+// update records the current value of the series with the given labels and returns its counter, i.e. the sum of all
+// increases seen so far. A decrease is taken as a reset of the underlying value, so all of the current value counts as
+// increase. It returns false if the series is new and there's no room left to keep track of it.
+func (s *deltaState) update(labels string, value float64) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, found := s.previous[labels]
+	if !found {
+		if len(s.previous) >= maxDeltaSeries {
+			return 0, false
+		}
+		// First time we see the series, start counting from here.
+		previous = value
+	}
+	increase := value - previous
+	if increase < 0 {
+		increase = value
+	}
+	s.previous[labels] = value
+	s.counters[labels] += increase
+	s.lastSeen[labels] = s.scrape
+	return s.counters[labels], true
+}
+
 // NewMetricFamily creates a new MetricFamily with the given metric config and const filters (e.g. job and instance).
-func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*dto.LabelPair) (*MetricFamily, errors.WithContext) {
+// The metric name gets the global metric prefix (if any) applied.
+func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*dto.LabelPair, gc *config.GlobalConfig) (
+	*MetricFamily, errors.WithContext) {
 	logContext = fmt.Sprintf("%s, metric=%q", logContext, mc.Name)
 
 	// Create a copy of original slice to avoid modifying constLabels
@@ -51,41 +123,436 @@ func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*
 	}
 	sort.Sort(labelPairSorter(sortedLabels))
 
-	return &MetricFamily{
+	// Resolve references to the aggregation in the help text, e.g. `{{ .field }}`.
+	helpData := map[string]string{"aggregation": "", "field": ""}
+	if agg := mc.Aggregation(); agg != nil {
+		helpData["aggregation"] = agg.Name
+		helpData["field"] = agg.Field
+	}
+	help, err := renderLabelTemplate("help", mc.Help, helpData)
+	if err != nil {
+		return nil, errors.Wrapf(logContext, err, "invalid help")
+	}
+
+	mf := MetricFamily{
 		config:      mc,
+		name:        gc.MetricPrefix + mc.Name,
+		help:        help,
 		constLabels: sortedLabels,
 		logContext:  logContext,
-	}, nil
+	}
+	if mc.Delta {
+		mf.deltas = &deltaState{
+			previous: make(map[string]float64),
+			counters: make(map[string]float64),
+			lastSeen: make(map[string]uint64),
+		}
+	}
+	return &mf, nil
+}
+
+// Collect emits the metric family's samples from the given aggregation data, abandoning the remaining ones if ctx is
+// done. The extra labels (if any) are applied to all samples. The relation of the total hits (`eq` or `gte`) is only
+// exported if so configured. A NaN total stands for an invalid one: the total sample and everything calculated from
+// it (percentages, summaries and percentiles histograms) are skipped.
+func (mf MetricFamily) Collect(
+	ctx context.Context, data []metricData, total float64, relation string, ch chan<- Metric, extraLabels ...*labelPair) {
+	var deadline time.Time
+	if timeout := time.Duration(mf.config.ProcessingTimeout); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if mf.deltas != nil {
+		mf.deltas.nextScrape()
+	}
+	samples := make([]metricData, 0, len(data))
+	for _, d := range data {
+		if mf.supported(d.labels) {
+			samples = append(samples, d)
+		}
+	}
+	samples = mf.dedup(ctx, samples, ch)
+	if mf.pastDeadline(ctx, deadline, len(samples), len(samples), ch) {
+		return
+	}
+	validTotal := !math.IsNaN(total)
+	if mf.config.Summary() {
+		if !validTotal {
+			return
+		}
+		mf.collectSummary(ctx, samples, total, ch, extraLabels)
+		return
+	}
+	if mf.config.Histogram() {
+		if mf.config.Aggregation().Type() == config.AggregationTypeHistogram {
+			mf.collectBucketHistogram(ctx, samples, ch, extraLabels)
+		} else if validTotal {
+			mf.collectHistogram(ctx, samples, total, ch, extraLabels)
+		}
+		return
+	}
+	if mf.config.TopN > 0 {
+		samples = mf.topN(samples, mf.config.TopN)
+	}
+
+	for i, d := range samples {
+		if mf.pastDeadline(ctx, deadline, len(samples)-i, len(samples), ch) {
+			return
+		}
+		if !validTotal && mf.config.MetricValueType() == config.ValueTypePercentage {
+			continue
+		}
+		value, err := mf.calculateValue(d, total)
+		if err != nil {
+			send(ctx, ch, NewInvalidMetric(err))
+			continue
+		}
+		matches := mf.matches(value)
+		value, ok := mf.transform(value, d.labelString())
+		if !ok {
+			continue
+		}
+		value, ok = mf.sanitize(value)
+		if !ok {
+			continue
+		}
+		labels := joinLabels(d.labels, extraLabels)
+		if mf.deltas != nil {
+			// Keyed by all labels of the series, so that e.g. a change of node doesn't carry a counter over to another.
+			key := metricData{labels: labels}.labelString()
+			if value, ok = mf.deltas.update(key, value); !ok {
+				log.Warningf("[%s] Dropping sample %s, over %d delta series", mf.logContext, key, maxDeltaSeries)
+				continue
+			}
+		}
+		if !matches {
+			continue
+		}
+		send(ctx, ch, NewMetric(&mf, value, labels...))
+	}
+	if mf.config.TrackTotal && validTotal && !mf.pastDeadline(ctx, deadline, 1, 1, ch) {
+		if mf.config.TotalRelation {
+			extraLabels = joinLabels([]*labelPair{{key: config.TotalRelationLabel, value: relation}}, extraLabels)
+		}
+		matches := mf.matches(total)
+		total, ok := mf.transform(total, "total")
+		if ok {
+			total, ok = mf.sanitize(total)
+		}
+		if ok && mf.deltas != nil {
+			// Keyed apart from the samples, whose keys are label sets in curly braces.
+			total, ok = mf.deltas.update("total"+metricData{labels: extraLabels}.labelString(), total)
+		}
+		if ok && matches {
+			send(ctx, ch, NewMetric(&mf, total, extraLabels...))
+		}
+	}
 }
 
-func (mf MetricFamily) Collect(data []metricData, total float64, ch chan<- Metric) {
-	for _, d := range data {
-		labels := make([]*labelPair, 0, 1)
-		if d.hasLabels() && mf.supported(d.labelPair) {
-			labels = append(labels, d.labelPair)
+// matches returns true if the given value, as calculated from the response (i.e. before any transform or delta), meets
+// the metric's condition, if any. Samples failing it are not exported, but delta metrics keep counting their increases.
+func (mf MetricFamily) matches(value float64) bool {
+	return mf.config.Condition == nil || mf.config.Condition.Matches(value)
+}
+
+// pastDeadline returns true if the processing deadline (if any) has passed, after reporting the dropped samples.
+func (mf MetricFamily) pastDeadline(ctx context.Context, deadline time.Time, dropped, total int, ch chan<- Metric) bool {
+	if deadline.IsZero() || !time.Now().After(deadline) {
+		return false
+	}
+	send(ctx, ch, NewInvalidMetric(errors.Errorf(mf.logContext,
+		"processing timed out after %s, dropped %d of %d samples", mf.config.ProcessingTimeout, dropped, total)))
+	return true
+}
+
+// responseLabels returns the metric's response labels, valued from the given response. Labels whose path is missing
+// from the response are valued `unknown`.
+func (mf MetricFamily) responseLabels(response string) []*labelPair {
+	if len(mf.config.ResponseLabels) == 0 {
+		return nil
+	}
+	labels := make([]*labelPair, 0, len(mf.config.ResponseLabels))
+	for label, path := range mf.config.ResponseLabels {
+		value := gjson.Get(response, path)
+		if !value.Exists() {
+			labels = append(labels, &labelPair{key: label, value: unknownLabelValue})
+			continue
+		}
+		labels = append(labels, &labelPair{key: label, value: value.String()})
+	}
+	// Map iteration order is random, keep the order of the labels stable.
+	sort.Slice(labels, func(i, j int) bool { return labels[i].key < labels[j].key })
+	return labels
+}
+
+// joinLabels returns a new slice with the labels of both a and b.
+func joinLabels(a, b []*labelPair) []*labelPair {
+	if len(b) == 0 {
+		return a
+	}
+	labels := make([]*labelPair, 0, len(a)+len(b))
+	labels = append(labels, a...)
+	return append(labels, b...)
+}
+
+// collectSummary emits quantile samples as a single summary, with the total hits as sample count. ElasticSearch doesn't
+// return the sum of the values percentiles are calculated from, so the summary's sum is always 0.
+func (mf MetricFamily) collectSummary(
+	ctx context.Context, samples []metricData, total float64, ch chan<- Metric, extraLabels []*labelPair) {
+	quantiles, err := mf.quantiles(samples)
+	if err != nil {
+		send(ctx, ch, NewInvalidMetric(err))
+		return
+	}
+	send(ctx, ch, NewSummaryMetric(&mf, uint64(total), 0, quantiles, extraLabels...))
+}
+
+// collectHistogram emits quantile samples as a single histogram, for use with `histogram_quantile()`. The buckets are an
+// approximation: each percentile value becomes a bucket upper bound, holding the matching share of the total hits
+// (e.g. the 99th percentile bucket holds 99% of them). As with summaries, the histogram's sum is always 0.
+func (mf MetricFamily) collectHistogram(
+	ctx context.Context, samples []metricData, total float64, ch chan<- Metric, extraLabels []*labelPair) {
+	quantiles, err := mf.quantiles(samples)
+	if err != nil {
+		send(ctx, ch, NewInvalidMetric(err))
+		return
+	}
+
+	qs := make([]float64, 0, len(quantiles))
+	for q := range quantiles {
+		qs = append(qs, q)
+	}
+	sort.Float64s(qs)
+
+	// Percentile values are non-decreasing in theory, but approximations may not be. Keep both upper bounds and
+	// cumulative counts monotonic regardless.
+	buckets := make(map[float64]uint64, len(qs))
+	upperBound := math.Inf(-1)
+	for _, q := range qs {
+		if quantiles[q] > upperBound {
+			upperBound = quantiles[q]
+		}
+		buckets[upperBound] = uint64(q * total)
+	}
+	histogram, herr := prometheus.NewConstHistogram(
+		prometheus.NewDesc(mf.Name(), mf.Help(), nil, nil), uint64(total), 0, buckets)
+	if herr != nil {
+		send(ctx, ch, NewInvalidMetric(errors.Wrap(mf.logContext, herr)))
+		return
+	}
+	send(ctx, ch, NewHistogramMetric(&mf, histogram, extraLabels...))
+}
+
+// collectBucketHistogram emits the buckets of a histogram aggregation as a single, native histogram. Each aggregation
+// bucket holds the documents with values in [key, key + interval), so key + interval is taken as bucket upper bound. The
+// histogram's count is the sum of all doc counts and, as ElasticSearch doesn't return it, its sum is always 0.
+func (mf MetricFamily) collectBucketHistogram(
+	ctx context.Context, samples []metricData, ch chan<- Metric, extraLabels []*labelPair) {
+	name := mf.config.Aggregation().Name
+	counts := make(map[float64]float64, len(samples))
+	keys := make([]float64, 0, len(samples))
+	for _, d := range samples {
+		if len(d.labels) != 1 || d.labels[0].key != name {
+			send(ctx, ch, NewInvalidMetric(errors.Errorf(mf.logContext, "sample without bucket key: %s", d.labelString())))
+			return
+		}
+		key, err := strconv.ParseFloat(d.labels[0].value, 64)
+		if err != nil {
+			send(ctx, ch, NewInvalidMetric(errors.Wrapf(mf.logContext, err, "invalid bucket key %q", d.labels[0].value)))
+			return
+		}
+		if _, found := counts[key]; !found {
+			keys = append(keys, key)
+		}
+		counts[key] += d.value
+	}
+	sort.Float64s(keys)
+
+	interval := mf.config.Aggregation().Interval
+	buckets := make(map[float64]uint64, len(keys))
+	var cumulative float64
+	for _, key := range keys {
+		cumulative += counts[key]
+		buckets[key+interval] = uint64(cumulative)
+	}
+	histogram, err := prometheus.NewConstHistogram(
+		prometheus.NewDesc(mf.Name(), mf.Help(), nil, nil), uint64(cumulative), 0, buckets)
+	if err != nil {
+		send(ctx, ch, NewInvalidMetric(errors.Wrap(mf.logContext, err)))
+		return
+	}
+	send(ctx, ch, NewHistogramMetric(&mf, histogram, extraLabels...))
+}
+
+// quantiles returns the values of the given quantile samples, by quantile. Non-finite values are handled as configured
+// by non_finite.
+func (mf MetricFamily) quantiles(samples []metricData) (map[float64]float64, errors.WithContext) {
+	quantiles := make(map[float64]float64, len(samples))
+	for _, d := range samples {
+		if len(d.labels) != 1 || d.labels[0].key != quantileLabel {
+			return nil, errors.Errorf(mf.logContext, "sample without quantile: %s", d.labelString())
+		}
+		q, err := strconv.ParseFloat(d.labels[0].value, 64)
+		if err != nil {
+			return nil, errors.Wrapf(mf.logContext, err, "invalid quantile %q", d.labels[0].value)
+		}
+		value, ok := mf.sanitize(d.value)
+		if !ok {
+			continue
+		}
+		quantiles[q] = value
+	}
+	return quantiles, nil
+}
+
+// dedup resolves samples sharing the same labels according to the configured on_duplicate strategy, as Prometheus
+// rejects duplicate series. In error mode an invalid metric naming the conflicting labels is emitted and the first
+// sample is kept.
+func (mf MetricFamily) dedup(ctx context.Context, samples []metricData, ch chan<- Metric) []metricData {
+	result := make([]metricData, 0, len(samples))
+	seen := make(map[string]int, len(samples))
+	for _, d := range samples {
+		labels := d.labelString()
+		i, found := seen[labels]
+		if !found {
+			seen[labels] = len(result)
+			result = append(result, d)
+			continue
 		}
-		if !d.hasLabels() || len(labels) > 0 {
-			ch <- NewMetric(&mf, mf.calculateValue(d, total), labels...)
+
+		switch mf.config.OnDuplicate() {
+		case config.DuplicateKeepFirst:
+		case config.DuplicateKeepLast:
+			result[i] = d
+		case config.DuplicateKeepMax:
+			if d.value > result[i].value {
+				result[i] = d
+			}
+		default:
+			send(ctx, ch, NewInvalidMetric(errors.Errorf(mf.logContext, "duplicate sample for labels %s", labels)))
+		}
+	}
+	return result
+}
+
+// topN keeps the n highest labeled samples and sums up the remaining ones into a single sample labeled `other`.
+// Samples without labels are passed through as is. A sample actually labeled `other` is summed up along with the rest,
+// rather than exported alongside the synthesized one under the same labels.
+func (mf MetricFamily) topN(samples []metricData, n int) []metricData {
+	result := make([]metricData, 0, n+1)
+	labeled := make([]metricData, 0, len(samples))
+	for _, d := range samples {
+		if d.hasLabels() {
+			labeled = append(labeled, d)
+		} else {
+			result = append(result, d)
 		}
 	}
-	if mf.config.TrackTotal {
-		ch <- NewMetric(&mf, total)
+	if len(labeled) <= n {
+		return samples
+	}
+
+	sort.SliceStable(labeled, func(i, j int) bool {
+		return labeled[i].value > labeled[j].value
+	})
+	otherLabels := make([]*labelPair, 0, len(labeled[n].labels))
+	for _, l := range labeled[n].labels {
+		otherLabels = append(otherLabels, &labelPair{key: l.key, value: otherLabelValue})
+	}
+	otherData := metricData{labels: otherLabels}
+	otherKey := otherData.labelString()
+
+	kept := 0
+	for _, d := range labeled {
+		if kept < n && d.labelString() != otherKey {
+			result = append(result, d)
+			kept++
+			continue
+		}
+		otherData.value += d.value
 	}
+	return append(result, otherData)
 }
 
-func (mf MetricFamily) calculateValue(data metricData, total float64) float64 {
+// calculateValue returns the value of the sample, depending on the metric value type. Negative values are handled
+// according to negative_percentage when calculating percentages.
+func (mf MetricFamily) calculateValue(data metricData, total float64) (float64, errors.WithContext) {
 	var result float64
 	switch mf.config.MetricValueType() {
 	case config.ValueTypePercentage:
-		result = (data.value * 100) / total
+		value := data.value
+		if value < 0 {
+			switch mf.config.NegativePercentage() {
+			case config.NegativeClamp:
+				value = 0
+			case config.NegativeError:
+				return 0, errors.Errorf(mf.logContext, "negative value %v for sample %s in percent mode", value, data.labelString())
+			}
+		}
+		if total == 0 {
+			// No documents matched, rather than export +Inf or NaN call it 0%.
+			log.V(2).Infof("[%s] Zero total for sample %s in percent mode, exporting 0", mf.logContext, data.labelString())
+			return 0, nil
+		}
+		result = (value * 100) / total
 	case config.ValueTypeAbsolute:
 		result = data.value
 	}
 
-	return result
+	return result, nil
+}
+
+// transform applies the configured transform to value. Values outside of the transform's domain (non-positive for log
+// transforms, negative for sqrt) are dropped with a warning and it returns false.
+func (mf MetricFamily) transform(value float64, sample string) (float64, bool) {
+	if math.IsNaN(value) {
+		// Left to sanitize.
+		return value, true
+	}
+	var valid bool
+	switch mf.config.Transform() {
+	case config.TransformLog10:
+		valid, value = value > 0, math.Log10(value)
+	case config.TransformLn:
+		valid, value = value > 0, math.Log(value)
+	case config.TransformSqrt:
+		valid, value = value >= 0, math.Sqrt(value)
+	default:
+		return value, true
+	}
+	if !valid {
+		log.Warningf("[%s] Dropping sample %s, value out of the domain of %s", mf.logContext, sample, mf.config.Transform())
+	}
+	return value, valid
 }
 
-func (mf MetricFamily) supported(pair *labelPair) bool {
+// sanitize applies the configured non_finite handling to NaN and Inf values. It returns false if the value must be
+// dropped.
+func (mf MetricFamily) sanitize(value float64) (float64, bool) {
+	if !math.IsNaN(value) && !math.IsInf(value, 0) {
+		return value, true
+	}
+
+	switch mf.config.NonFinite() {
+	case config.NonFiniteZero:
+		log.Warningf("[%s] Replacing non-finite value %v with 0", mf.logContext, value)
+		return 0, true
+	default:
+		log.Warningf("[%s] Dropping non-finite value %v", mf.logContext, value)
+		return 0, false
+	}
+}
+
+// supported returns true if all the given labels are non-empty and pass the metric's filters.
+func (mf MetricFamily) supported(labels []*labelPair) bool {
+	for _, pair := range labels {
+		if !mf.supportedPair(pair) {
+			return false
+		}
+	}
+	return true
+}
+
+func (mf MetricFamily) supportedPair(pair *labelPair) bool {
 	valid := pair.key != "" && pair.value != ""
 	hasFilters := mf.config.Aggregation() != nil && len(mf.config.Filters) > 0
 	if valid && hasFilters && mf.config.Aggregation().Name == pair.key {
@@ -104,12 +571,12 @@ func (mf MetricFamily) supported(pair *labelPair) bool {
 
 // Name implements MetricDesc.
 func (mf MetricFamily) Name() string {
-	return mf.config.Name
+	return mf.name
 }
 
 // Help implements MetricDesc.
 func (mf MetricFamily) Help() string {
-	return mf.config.Help
+	return mf.help
 }
 
 // ValueType implements MetricDesc.
@@ -207,6 +674,83 @@ func NewMetric(desc MetricDesc, value float64, labelValues ...*labelPair) Metric
 	}
 }
 
+// NewSummaryMetric returns a summary metric with fixed sample count, sum and quantiles.
+func NewSummaryMetric(desc MetricDesc, count uint64, sum float64, quantiles map[float64]float64, labelValues ...*labelPair) Metric {
+	return &summaryMetric{
+		desc:       desc,
+		count:      count,
+		sum:        sum,
+		quantiles:  quantiles,
+		labelPairs: makeLabelPairs(desc, labelValues),
+	}
+}
+
+// summaryMetric is a summary metric with fixed values that cannot be changed.
+type summaryMetric struct {
+	desc       MetricDesc
+	count      uint64
+	sum        float64
+	quantiles  map[float64]float64
+	labelPairs []*dto.LabelPair
+}
+
+// Desc implements Metric.
+func (m *summaryMetric) Desc() MetricDesc {
+	return m.desc
+}
+
+// Write implements Metric.
+func (m *summaryMetric) Write(out *dto.Metric) errors.WithContext {
+	quantiles := make([]*dto.Quantile, 0, len(m.quantiles))
+	for q, v := range m.quantiles {
+		quantiles = append(quantiles, &dto.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(v)})
+	}
+	sort.Slice(quantiles, func(i, j int) bool {
+		return quantiles[i].GetQuantile() < quantiles[j].GetQuantile()
+	})
+
+	out.Label = m.labelPairs
+	out.Summary = &dto.Summary{
+		SampleCount: proto.Uint64(m.count),
+		SampleSum:   proto.Float64(m.sum),
+		Quantile:    quantiles,
+	}
+	return nil
+}
+
+// NewHistogramMetric returns a metric exporting the current state of the given histogram, e.g. a prometheus.Histogram
+// accumulating observations across scrapes or a constant histogram.
+func NewHistogramMetric(desc MetricDesc, histogram prometheus.Metric, labelValues ...*labelPair) Metric {
+	return &histogramMetric{
+		desc:       desc,
+		histogram:  histogram,
+		labelPairs: makeLabelPairs(desc, labelValues),
+	}
+}
+
+// histogramMetric is a metric exporting a histogram.
+type histogramMetric struct {
+	desc       MetricDesc
+	histogram  prometheus.Metric
+	labelPairs []*dto.LabelPair
+}
+
+// Desc implements Metric.
+func (m *histogramMetric) Desc() MetricDesc {
+	return m.desc
+}
+
+// Write implements Metric.
+func (m *histogramMetric) Write(out *dto.Metric) errors.WithContext {
+	var h dto.Metric
+	if err := m.histogram.Write(&h); err != nil {
+		return errors.Wrap(m.desc.LogContext(), err)
+	}
+	out.Label = m.labelPairs
+	out.Histogram = h.Histogram
+	return nil
+}
+
 // constMetric is a metric with one fixed value that cannot be changed.
 type constMetric struct {
 	desc       MetricDesc
@@ -0,0 +1,420 @@
+package elastic_exporter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const topNCollector = `
+collector_name: test
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host.
+    query: "*"
+    top_n: 2
+    aggregation:
+      name: host
+      type: terms
+      field: host
+`
+
+// hostData returns samples labeled by host, in the given order.
+func hostData(hostsAndValues ...interface{}) []metricData {
+	var data []metricData
+	for i := 0; i < len(hostsAndValues); i += 2 {
+		data = append(data, newLabeledMetricData(float64(hostsAndValues[i+1].(int)), "host", hostsAndValues[i].(string)))
+	}
+	return data
+}
+
+func TestMetricFamilyTopN(t *testing.T) {
+	mf := mustMetricFamily(t, topNCollector)
+	metrics := collectMetrics(func(ch chan<- Metric) {
+		mf.Collect(context.Background(), hostData("a", 5, "b", 10, "c", 3, "d", 1), 19, "eq", ch)
+	})
+	assertLines(t, formatMetrics(metrics),
+		`requests{host="b"} 10`,
+		`requests{host="a"} 5`,
+		`requests{host="other"} 4`,
+		`requests 19`)
+}
+
+func TestMetricFamilyTopNBelowLimit(t *testing.T) {
+	mf := mustMetricFamily(t, topNCollector)
+	metrics := collectMetrics(func(ch chan<- Metric) {
+		mf.Collect(context.Background(), hostData("a", 5, "b", 10), 15, "eq", ch)
+	})
+	assertLines(t, formatMetrics(metrics),
+		`requests{host="a"} 5`,
+		`requests{host="b"} 10`,
+		`requests 15`)
+}
+
+func TestMetricFamilyTopNFoldsActualOther(t *testing.T) {
+	mf := mustMetricFamily(t, topNCollector)
+	metrics := collectMetrics(func(ch chan<- Metric) {
+		mf.Collect(context.Background(), hostData("b", 10, "other", 7, "a", 5, "c", 3), 25, "eq", ch)
+	})
+	// A single `other` sample, rather than two with the same labels.
+	assertLines(t, formatMetrics(metrics),
+		`requests{host="b"} 10`,
+		`requests{host="a"} 5`,
+		`requests{host="other"} 10`,
+		`requests 25`)
+}
+
+func TestMetricFamilyNonFinite(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want []string
+	}{
+		{"drop", []string{`requests{host="c"} 1`}},
+		{"zero", []string{`requests{host="a"} 0`, `requests{host="b"} 0`, `requests{host="c"} 1`, `requests 0`}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			mf := mustMetricFamily(t, `
+collector_name: test
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host.
+    query: "*"
+    non_finite: `+tc.mode+`
+    aggregation:
+      name: host
+      type: terms
+      field: host
+`)
+			data := []metricData{
+				newLabeledMetricData(math.Inf(1), "host", "a"),
+				newLabeledMetricData(math.NaN(), "host", "b"),
+				newLabeledMetricData(1, "host", "c"),
+			}
+			metrics := collectMetrics(func(ch chan<- Metric) {
+				mf.Collect(context.Background(), data, math.Inf(1), "eq", ch)
+			})
+			assertLines(t, formatMetrics(metrics), tc.want...)
+		})
+	}
+}
+
+func TestMetricFamilyOnDuplicate(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want []string
+	}{
+		{"error", []string{`error: [test, metric="requests"] duplicate sample for labels {host="a"}`,
+			`error: [test, metric="requests"] duplicate sample for labels {host="a"}`, `requests{host="a"} 1`, `requests{host="b"} 2`}},
+		{"first", []string{`requests{host="a"} 1`, `requests{host="b"} 2`}},
+		{"last", []string{`requests{host="a"} 3`, `requests{host="b"} 2`}},
+		{"max", []string{`requests{host="a"} 5`, `requests{host="b"} 2`}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			mf := mustMetricFamily(t, `
+collector_name: test
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host.
+    query: "*"
+    on_duplicate: `+tc.mode+`
+    aggregation:
+      name: host
+      type: terms
+      field: host
+`)
+			metrics := collectMetrics(func(ch chan<- Metric) {
+				mf.Collect(context.Background(), hostData("a", 1, "a", 5, "b", 2, "a", 3), math.NaN(), "", ch)
+			})
+			assertLines(t, formatMetrics(metrics), tc.want...)
+		})
+	}
+}
+
+const deltaCollector = `
+collector_name: test
+metrics:
+  - metric_name: requests
+    type: counter
+    help: Requests by host.
+    query: "*"
+    delta: true
+    aggregation:
+      name: host
+      type: terms
+      field: host
+`
+
+func TestMetricFamilyDelta(t *testing.T) {
+	mf := mustMetricFamily(t, deltaCollector)
+	scrape := func(total float64, data ...interface{}) []string {
+		return formatMetrics(collectMetrics(func(ch chan<- Metric) {
+			mf.Collect(context.Background(), hostData(data...), total, "eq", ch)
+		}))
+	}
+
+	// The first scrape only sets the baseline.
+	assertLines(t, scrape(15, "a", 10, "b", 5),
+		`requests{host="a"} 0`,
+		`requests{host="b"} 0`,
+		`requests 0`)
+	assertLines(t, scrape(22, "a", 14, "b", 8),
+		`requests{host="a"} 4`,
+		`requests{host="b"} 3`,
+		`requests 7`)
+	// The values of b and the total went down, i.e. were reset: all of them is an increase.
+	assertLines(t, scrape(20, "a", 18, "b", 2),
+		`requests{host="a"} 8`,
+		`requests{host="b"} 5`,
+		`requests 27`)
+}
+
+func TestMetricFamilyDeltaExtraLabels(t *testing.T) {
+	mf := mustMetricFamily(t, deltaCollector)
+	scrape := func(node string, total float64, data ...interface{}) []string {
+		return formatMetrics(collectMetrics(func(ch chan<- Metric) {
+			mf.Collect(context.Background(), hostData(data...), total, "eq", ch, &labelPair{key: "node", value: node})
+		}))
+	}
+
+	assertLines(t, scrape("n1", 10, "a", 10),
+		`requests{host="a",node="n1"} 0`,
+		`requests{node="n1"} 0`)
+	assertLines(t, scrape("n1", 14, "a", 14),
+		`requests{host="a",node="n1"} 4`,
+		`requests{node="n1"} 4`)
+	// Another node answering makes for other series, with baselines of their own.
+	assertLines(t, scrape("n2", 100, "a", 100),
+		`requests{host="a",node="n2"} 0`,
+		`requests{node="n2"} 0`)
+	assertLines(t, scrape("n1", 20, "a", 20),
+		`requests{host="a",node="n1"} 10`,
+		`requests{node="n1"} 10`)
+}
+
+func TestMetricFamilyDeltaChurn(t *testing.T) {
+	mf := mustMetricFamily(t, deltaCollector)
+	scrape := func(data ...interface{}) []string {
+		return linesOf(formatMetrics(collectMetrics(func(ch chan<- Metric) {
+			mf.Collect(context.Background(), hostData(data...), math.NaN(), "", ch)
+		})), "requests")
+	}
+
+	assertLines(t, scrape("a", 1, "b", 1), `requests{host="a"} 0`, `requests{host="b"} 0`)
+	assertLines(t, scrape("a", 3, "b", 2), `requests{host="a"} 2`, `requests{host="b"} 1`)
+	// b rotates out, for long enough to be forgotten.
+	for i := 0; i <= deltaIdleScrapes; i++ {
+		scrape("a", 3)
+	}
+	if _, found := mf.deltas.previous[`{host="b"}`]; found {
+		t.Errorf("got b still tracked after %d scrapes without it", deltaIdleScrapes+1)
+	}
+	// Back, it starts afresh.
+	assertLines(t, scrape("a", 3, "b", 7), `requests{host="a"} 2`, `requests{host="b"} 0`)
+
+	// Rotating buckets don't fill up the state for good.
+	for i := 0; i < maxDeltaSeries; i++ {
+		mf.deltas.update(fmt.Sprintf(`{host="old%d"}`, i), 1)
+	}
+	assertLines(t, scrape("new", 1))
+	for i := 0; i <= deltaIdleScrapes; i++ {
+		scrape()
+	}
+	assertLines(t, scrape("new", 1), `requests{host="new"} 0`)
+}
+
+func TestMetricFamilyCondition(t *testing.T) {
+	for _, tc := range []struct {
+		condition string
+		want      []string
+	}{
+		{"", []string{`errors{host="a"} 0`, `errors{host="b"} 2`, `errors{host="c"} 5`}},
+		{"{operator: '>', threshold: 0}", []string{`errors{host="b"} 2`, `errors{host="c"} 5`}},
+		{"{operator: '>=', threshold: 2}", []string{`errors{host="b"} 2`, `errors{host="c"} 5`}},
+		{"{operator: '==', threshold: 5}", []string{`errors{host="c"} 5`}},
+	} {
+		t.Run(tc.condition, func(t *testing.T) {
+			text := `
+collector_name: test
+metrics:
+  - metric_name: errors
+    type: gauge
+    help: Errors by host.
+    query: "*"
+    aggregation:
+      name: host
+      type: terms
+      field: host
+`
+			if tc.condition != "" {
+				text += "    condition: " + tc.condition + "\n"
+			}
+			mf := mustMetricFamily(t, text)
+			metrics := collectMetrics(func(ch chan<- Metric) {
+				mf.Collect(context.Background(), hostData("a", 0, "b", 2, "c", 5), math.NaN(), "", ch)
+			})
+			assertLines(t, formatMetrics(metrics), tc.want...)
+		})
+	}
+}
+
+func TestMetricFamilyConditionDelta(t *testing.T) {
+	mf := mustMetricFamily(t, deltaCollector+"    condition: {operator: '>', threshold: 10}\n")
+	scrape := func(total float64, data ...interface{}) []string {
+		return formatMetrics(collectMetrics(func(ch chan<- Metric) {
+			mf.Collect(context.Background(), hostData(data...), total, "eq", ch)
+		}))
+	}
+
+	// The condition applies to the queried values, the total included, rather than to the counters.
+	assertLines(t, scrape(5, "a", 5, "b", 20),
+		`requests{host="b"} 0`)
+	assertLines(t, scrape(37, "a", 12, "b", 25),
+		`requests{host="a"} 7`,
+		`requests{host="b"} 5`,
+		`requests 32`)
+	// Hidden samples still count: a went down, i.e. was reset.
+	assertLines(t, scrape(40, "a", 10, "b", 30),
+		`requests{host="b"} 10`,
+		`requests 35`)
+	assertLines(t, scrape(45, "a", 15, "b", 30),
+		`requests{host="a"} 22`,
+		`requests{host="b"} 10`,
+		`requests 40`)
+}
+
+func TestMetricFamilyNegativePercentage(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want []string
+	}{
+		{"allow", []string{`requests{host="a"} -25`, `requests{host="b"} 50`, `requests 20`}},
+		{"clamp", []string{`requests{host="a"} 0`, `requests{host="b"} 50`, `requests 20`}},
+		{"error", []string{`error: [test, metric="requests"] negative value -5 for sample {host="a"} in percent mode`,
+			`requests{host="b"} 50`, `requests 20`}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			mf := mustMetricFamily(t, `
+collector_name: test
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Percentage of requests by host.
+    query: "*"
+    value_type: percent
+    negative_percentage: `+tc.mode+`
+    aggregation:
+      name: host
+      type: terms
+      field: host
+`)
+			metrics := collectMetrics(func(ch chan<- Metric) {
+				mf.Collect(context.Background(), hostData("a", -5, "b", 10), 20, "", ch)
+			})
+			assertLines(t, formatMetrics(metrics), tc.want...)
+		})
+	}
+}
+
+func TestMetricFamilyZeroTotal(t *testing.T) {
+	for _, tc := range []struct {
+		valueType string
+		want      []string
+	}{
+		// Rather than +Inf or NaN.
+		{"percent", []string{`requests{host="a"} 0`, `requests{host="b"} 0`, `requests 0`}},
+		{"absolute", []string{`requests{host="a"} 5`, `requests{host="b"} 10`, `requests 0`}},
+	} {
+		t.Run(tc.valueType, func(t *testing.T) {
+			mf := mustMetricFamily(t, `
+collector_name: test
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host.
+    query: "*"
+    value_type: `+tc.valueType+`
+    aggregation:
+      name: host
+      type: terms
+      field: host
+`)
+			metrics := collectMetrics(func(ch chan<- Metric) {
+				mf.Collect(context.Background(), hostData("a", 5, "b", 10), 0, "", ch)
+			})
+			assertLines(t, formatMetrics(metrics), tc.want...)
+		})
+	}
+}
+
+func TestMetricFamilyHelpTemplate(t *testing.T) {
+	mf := mustMetricFamily(t, `
+collector_name: test
+metrics:
+  - metric_name: latency
+    type: gauge
+    help: "Average of {{ .field }} ({{ .aggregation }} aggregation)."
+    query: "*"
+    aggregation:
+      name: avg_latency
+      type: avg
+      field: response.latency
+`)
+	if got, want := mf.Help(), "Average of response.latency (avg_latency aggregation)."; got != want {
+		t.Errorf("got help %q, want %q", got, want)
+	}
+}
+
+func TestMetricFamilyProcessingTimeout(t *testing.T) {
+	mf := mustMetricFamily(t, strings.Replace(topNCollector, "top_n: 2", "processing_timeout: 50ms", 1))
+	data := hostData("a", 1, "b", 2, "c", 3, "d", 4, "e", 5, "f", 6)
+
+	// A slow consumer stands for slow processing: every sample takes 20ms to go through.
+	ch := make(chan Metric)
+	done := make(chan struct{})
+	var lines []string
+	go func() {
+		for m := range ch {
+			time.Sleep(20 * time.Millisecond)
+			lines = append(lines, formatMetrics([]Metric{m})...)
+		}
+		close(done)
+	}()
+	mf.Collect(context.Background(), data, 21, "eq", ch)
+	close(ch)
+	<-done
+
+	errs := errorLines(lines)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0], `error: [test, metric="requests"] processing timed out after 50ms, dropped`) {
+		t.Fatalf("expected a single processing timeout error, got %q", errs)
+	}
+	if samples := linesOf(lines, "requests"); len(samples) == 0 || len(samples) >= len(data) {
+		t.Errorf("expected some but not all samples before the timeout, got %q", samples)
+	}
+}
+
+func TestMetricFamilyTransform(t *testing.T) {
+	for _, tc := range []struct {
+		transform string
+		want      []string
+	}{
+		{"none", []string{`requests{host="a"} 0`, `requests{host="b"} 100`, `requests{host="c"} -4`, `requests 100`}},
+		{"log10", []string{`requests{host="b"} 2`, `requests 2`}},
+		{"ln", []string{`requests{host="b"} 4.605170185988092`, `requests 4.605170185988092`}},
+		{"sqrt", []string{`requests{host="a"} 0`, `requests{host="b"} 10`, `requests 10`}},
+	} {
+		t.Run(tc.transform, func(t *testing.T) {
+			mf := mustMetricFamily(t, strings.Replace(topNCollector, "top_n: 2", "transform: "+tc.transform, 1))
+			metrics := collectMetrics(func(ch chan<- Metric) {
+				// Values out of the domain of the transform (0 for logs, negative ones for all) are dropped.
+				mf.Collect(context.Background(), hostData("a", 0, "b", 100, "c", -4), 100, "eq", ch)
+			})
+			assertLines(t, formatMetrics(metrics), tc.want...)
+		})
+	}
+}
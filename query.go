@@ -3,29 +3,135 @@ package elastic_exporter
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/elastic/go-elasticsearch/v7/esutil"
 	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/tidwall/gjson"
 	"io"
+	"io/ioutil"
 	"iss.digital/mt/elastic_exporter/config"
 	"iss.digital/mt/elastic_exporter/errors"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 )
 
+// allIndices is the index expression matching all indices of the cluster.
+const allIndices = "_all"
+
+const (
+	// nodeLabel is the label holding the node that served the query, if enabled.
+	nodeLabel = "node"
+	// unknownLabelValue is the value of labels whose actual value is not available.
+	unknownLabelValue = "unknown"
+)
+
+const (
+	durationName = "query_duration_seconds"
+	durationHelp = "Distribution of the time it took to run the query, as seen by the exporter"
+
+	lastDurationName = "query_last_duration_seconds"
+	lastDurationHelp = "Time it took to run the query on this scrape, whether it succeeded or not (e.g. timed out)"
+
+	serverDurationName       = "query_server_duration_seconds"
+	serverDurationMillisName = "query_server_duration_milliseconds"
+	serverDurationHelp       = "Time ElasticSearch spent executing the query, as reported in the response's `took`"
+
+	metricUpName = "metric_up"
+	metricUpHelp = "1 if the query populating the metric succeeded, 0 otherwise"
+
+	missingKeyName = "missing_key"
+	missingKeyHelp = "1 if an expected key of a terms aggregation has no bucket in the response, 0 otherwise"
+
+	termsTruncatedName = "terms_truncated"
+	termsTruncatedHelp = "1 if a terms aggregation left documents out of its buckets (sum_other_doc_count > 0), 0 otherwise"
+
+	docCountErrorName = "terms_doc_count_error"
+	docCountErrorHelp = "Upper bound of the error on the doc count of a terms aggregation bucket"
+
+	shardFailuresName = "query_shard_failures"
+	shardFailuresHelp = "Number of shards that failed to execute the query, whose results are missing from the response"
+
+	shardsSuccessfulName = "query_shards_successful"
+	shardsSuccessfulHelp = "Number of shards that successfully executed the query"
+
+	shardsTotalName = "query_shards_total"
+	shardsTotalHelp = "Number of shards the query was run against"
+
+	timedOutName = "query_timed_out"
+	timedOutHelp = "1 if the query hit its search_timeout and returned partial results, 0 otherwise"
+
+	aggregationsName = "query_aggregations"
+	aggregationsHelp = "Number of aggregations of the query, sub-aggregations included"
+
+	aggregationDepthName = "query_aggregation_depth"
+	aggregationDepthHelp = "Nesting depth of the aggregations of the query, 0 if it has none"
+)
+
+// queryRetries counts the query retries, by collector and query.
+var queryRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "elastic_exporter",
+	Name:      "query_retries_total",
+	Help:      "Number of times a query was retried after a transient failure, by collector and query.",
+}, []string{"collector", "query"})
+
+// queryErrors counts the failed query runs, by collector and query.
+var queryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "elastic_exporter",
+	Name:      "query_errors_total",
+	Help:      "Number of query runs that failed, timed out or returned partial results due to shard failures, by collector and query.",
+}, []string{"collector", "query"})
+
+func init() {
+	prometheus.MustRegister(queryRetries, queryErrors)
+}
+
 // Query wraps a elasticsearch query and all the metrics populated from it. It helps extract keys and values from result.
 type Query struct {
 	config              *config.QueryConfig
+	globalConfig        *config.GlobalConfig
 	metricFamilies      []*MetricFamily
 	aggregationHandlers map[string]AggregationHandler
+	labels              []*labelPair
+	routing             string
+	preference          string
+	termsTruncatedDesc  MetricDesc
+	serverDurationDesc  MetricDesc
+	missingKeyDesc      MetricDesc
+	docCountErrorDesc   MetricDesc
+	timedOutDesc        MetricDesc
+	shardFailuresDesc   MetricDesc
+	shardsSuccessDesc   MetricDesc
+	shardsTotalDesc     MetricDesc
+	metricUpDesc        MetricDesc
+	aggregationsDesc    MetricDesc
+	aggDepthDesc        MetricDesc
+	afterKeys           map[string]json.RawMessage // `after_key` of checkpointed composite aggregations, by name
+	afterKeysMu         sync.Mutex
+	durationDesc        MetricDesc
+	lastDurationDesc    MetricDesc
+	duration            prometheus.Histogram // accumulates query durations across scrapes
+	errorCount          prometheus.Counter   // queryErrors of this query
+	retryCount          prometheus.Counter   // queryRetries of this query
 	logContext          string
 
 	client *elasticsearch.Client
 }
 
 type searchRequest struct {
-	Query searchQuery            `json:"query"`
-	Aggs  map[string]interface{} `json:"aggs,omitempty"`
+	Query   interface{}            `json:"query"` // searchQuery or raw query DSL
+	Timeout string                 `json:"timeout,omitempty"`
+	Aggs    map[string]interface{} `json:"aggs,omitempty"`
+	Suggest map[string]interface{} `json:"suggest,omitempty"`
 }
 
 type searchQuery struct {
@@ -37,70 +143,489 @@ type queryString struct {
 }
 
 type metricData struct {
-	*labelPair
-	value float64
+	labels []*labelPair
+	value  float64
 }
 
 func (d metricData) hasLabels() bool {
-	return d.labelPair != nil
+	return len(d.labels) > 0
+}
+
+// labelString returns the labels of the data formatted like in the Prometheus exposition format.
+func (d metricData) labelString() string {
+	pairs := make([]string, 0, len(d.labels))
+	for _, l := range d.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l.key, l.value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
 }
 
-// NewQuery returns a new Query that will populate the given metric families.
-func NewQuery(logContext string, qc *config.QueryConfig, metricFamilies ...*MetricFamily) (*Query, errors.WithContext) {
+// NewQuery returns a new Query that will populate the given metric families. The query's own metrics (e.g.
+// `terms_truncated`) get the provided const labels applied, along with the collector and query names.
+func NewQuery(logContext, collectorName string, qc *config.QueryConfig, constLabels []*dto.LabelPair,
+	gc *config.GlobalConfig, metricFamilies ...*MetricFamily) (*Query, errors.WithContext) {
+
 	logContext = fmt.Sprintf("%s, query=%q", logContext, qc.Name)
-	handlers := make(map[string]AggregationHandler, len(qc.Aggregations))
-	for _, agg := range qc.Aggregations {
-		if handler, err := NewForType(agg.Type(), agg.Name); err != nil {
+
+	handlers := make(map[string]AggregationHandler, qc.AggregationCount())
+	for _, agg := range qc.AllAggregations() {
+		if handler, err := NewForType(agg); err != nil {
 			return nil, errors.Wrap(logContext, err)
 		} else {
 			handlers[agg.Name] = handler
 		}
 	}
 
+	// Resolve routing and preference against the target's labels.
+	targetLabels := make(map[string]string, len(constLabels))
+	for _, l := range constLabels {
+		targetLabels[l.GetName()] = l.GetValue()
+	}
+	routing, err := renderLabelTemplate("routing", qc.Routing, targetLabels)
+	if err != nil {
+		return nil, errors.Wrap(logContext, err)
+	}
+	preference, err := renderLabelTemplate("preference", qc.Preference, targetLabels)
+	if err != nil {
+		return nil, errors.Wrap(logContext, err)
+	}
+
+	durationBuckets := gc.DurationBuckets
+	if len(durationBuckets) == 0 {
+		durationBuckets = prometheus.DefBuckets
+	}
+	serverDurationName := serverDurationName
+	if gc.TookMillis {
+		serverDurationName = serverDurationMillisName
+	}
+
 	q := Query{
 		config:              qc,
+		globalConfig:        gc,
 		metricFamilies:      metricFamilies,
 		aggregationHandlers: handlers,
-		logContext:          logContext,
+		afterKeys:           make(map[string]json.RawMessage),
+		routing:             routing,
+		preference:          preference,
+		labels: []*labelPair{
+			{key: "collector", value: collectorName},
+			{key: "query", value: qc.Name},
+		},
+		termsTruncatedDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+termsTruncatedName, termsTruncatedHelp, prometheus.GaugeValue, constLabels, "collector", "query", "aggregation"),
+		serverDurationDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+serverDurationName, serverDurationHelp, prometheus.GaugeValue, constLabels, "collector", "query"),
+		docCountErrorDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+docCountErrorName, docCountErrorHelp, prometheus.GaugeValue, constLabels, "collector", "query", "aggregation", "key"),
+		timedOutDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+timedOutName, timedOutHelp, prometheus.GaugeValue, constLabels, "collector", "query"),
+		shardFailuresDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+shardFailuresName, shardFailuresHelp, prometheus.GaugeValue, constLabels, "collector", "query"),
+		shardsSuccessDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+shardsSuccessfulName, shardsSuccessfulHelp, prometheus.GaugeValue, constLabels, "collector", "query"),
+		shardsTotalDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+shardsTotalName, shardsTotalHelp, prometheus.GaugeValue, constLabels, "collector", "query"),
+		missingKeyDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+missingKeyName, missingKeyHelp, prometheus.GaugeValue, constLabels, "collector", "query", "aggregation", "key"),
+		durationDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+durationName, durationHelp, prometheus.UntypedValue, constLabels, "collector", "query"),
+		lastDurationDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+lastDurationName, lastDurationHelp, prometheus.GaugeValue, constLabels, "collector", "query"),
+		// Only used to accumulate observations, exported via durationDesc.
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    durationName,
+			Help:    durationHelp,
+			Buckets: durationBuckets,
+		}),
+		metricUpDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+metricUpName, metricUpHelp, prometheus.GaugeValue, constLabels, "collector", "query", "metric"),
+		aggregationsDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+aggregationsName, aggregationsHelp, prometheus.GaugeValue, constLabels, "collector", "query"),
+		aggDepthDesc: NewAutomaticMetricDesc(
+			logContext, gc.MetricPrefix+aggregationDepthName, aggregationDepthHelp, prometheus.GaugeValue, constLabels, "collector", "query"),
+		errorCount: queryErrors.WithLabelValues(collectorName, qc.Name),
+		retryCount: queryRetries.WithLabelValues(collectorName, qc.Name),
+		logContext: logContext,
 	}
 	return &q, nil
 }
 
 func (q *Query) Collect(ctx context.Context, client *elasticsearch.Client, ch chan<- Metric) {
+	// Known from the configuration alone, so exported whether the query succeeds or not.
+	send(ctx, ch, NewMetric(q.aggregationsDesc, float64(q.config.AggregationCount()), q.labels...))
+	send(ctx, ch, NewMetric(q.aggDepthDesc, float64(q.config.AggregationDepth()), q.labels...))
 	if ctx.Err() != nil {
-		ch <- NewInvalidMetric(errors.Wrap(q.logContext, ctx.Err()))
+		q.errorCount.Inc()
+		send(ctx, ch, NewInvalidMetric(errors.Wrap(q.logContext, ctx.Err())))
+		q.collectMetricUp(ctx, false, ch)
 		return
 	}
-	resp, err := q.run(ctx, client)
+	start := time.Now()
+	resp, header, err := q.runWithRetries(ctx, client)
+	// Failures included, as a slow query is most likely to be the one that timed out.
+	send(ctx, ch, NewMetric(q.lastDurationDesc, time.Since(start).Seconds(), q.labels...))
 	if err != nil {
-		ch <- NewInvalidMetric(err)
+		q.errorCount.Inc()
+		send(ctx, ch, NewInvalidMetric(err))
+		send(ctx, ch, NewHistogramMetric(q.durationDesc, q.duration, q.labels...))
+		q.collectMetricUp(ctx, false, ch)
 		return
 	}
+	// Only successful runs are observed, failures (e.g. timeouts) would skew the distribution.
+	q.duration.Observe(time.Since(start).Seconds())
+	send(ctx, ch, NewHistogramMetric(q.durationDesc, q.duration, q.labels...))
+	q.collectMetricUp(ctx, true, ch)
 
-	aggregations := gjson.Get(resp, "aggregations").Map()
+	if took := gjson.Get(resp, "took"); took.Exists() {
+		// ElasticSearch reports `took` in milliseconds.
+		duration := took.Float()
+		if !q.globalConfig.TookMillis {
+			duration /= 1000
+		}
+		send(ctx, ch, NewMetric(q.serverDurationDesc, duration, q.labels...))
+	}
+	q.collectShards(ctx, resp, ch)
+	if q.config.SearchTimeout > 0 {
+		timedOut := gjson.Get(resp, "timed_out").Bool()
+		if timedOut {
+			q.errorCount.Inc()
+			log.Warningf("[%s] Query timed out after %s, results are partial", q.logContext, q.config.SearchTimeout)
+		}
+		send(ctx, ch, NewMetric(q.timedOutDesc, boolToFloat64(timedOut), q.labels...))
+	}
+
+	aggregations, err := q.responseSection(resp, "aggregations")
+	if err != nil {
+		log.Warning(err)
+		send(ctx, ch, NewInvalidMetric(err))
+	}
+	suggestions, err := q.responseSection(resp, "suggest")
+	if err != nil {
+		log.Warning(err)
+		send(ctx, ch, NewInvalidMetric(err))
+	}
+	q.checkAggregations(ctx, aggregations, ch)
 
-	metricsData := make([]metricData, 0, len(aggregations))
-	total := gjson.Get(resp, "hits.total.value").Float()
+	// Keep the data of each aggregation apart, so that every metric family only gets the data of its own aggregation.
+	metricsData := make(map[string][]metricData, len(aggregations))
+	totalPath, relation := "hits.total.value", gjson.Get(resp, "hits.total.relation").String()
+	if q.config.Mode() == config.QueryModeCount {
+		// The count API returns an exact count.
+		totalPath, relation = "count", "eq"
+	}
+	if q.config.TotalPath != "" {
+		// Whether an arbitrary value is exact is anybody's guess.
+		totalPath, relation = q.config.TotalPath, unknownLabelValue
+	}
+	totalHits := gjson.Get(resp, totalPath)
+	total := totalHits.Float()
+	var totalErr errors.WithContext
+	if !totalHits.Exists() && q.config.TotalPath != "" {
+		totalErr = errors.Errorf(q.logContext, "total_path %s not found in response", totalPath)
+	} else if totalHits.Exists() && totalHits.Type != gjson.Number {
+		totalErr = errors.Errorf(q.logContext, "non-numeric %s %s", totalPath, totalHits.Raw)
+	}
+	if totalErr != nil {
+		log.Warning(totalErr)
+		send(ctx, ch, NewInvalidMetric(totalErr))
+		// Rather than 0, which would pass for an actual total.
+		total = math.NaN()
+	}
+	if relation == "" {
+		relation = unknownLabelValue
+	}
 
-	for name, aggregation := range aggregations {
-		if handler, ok := q.aggregationHandlers[name]; !ok {
-			log.Infof("handler for aggregation %s not found in query %s", name, q.config.Name)
+	// Walk the aggregations in configuration order rather than response map order, so that metrics are emitted in the
+	// same order as the buckets ElasticSearch returned.
+	for _, agg := range q.config.Aggregations {
+		results := aggregations
+		if agg.Type() == config.AggregationTypeSuggest {
+			results = suggestions
+		}
+		aggregation, found := results[agg.Name]
+		if !found {
+			log.V(2).Infof("[%s] Aggregation %s not found in response", q.logContext, agg.Name)
+			continue
+		}
+		if handler, ok := q.aggregationHandlers[agg.Name]; !ok {
+			log.Infof("handler for aggregation %s not found in query %s", agg.Name, q.config.Name)
 		} else {
-			metricsData = handler.Handle(aggregation, metricsData)
+			data, err := handler.Handle(aggregation, metricsData[agg.Name])
+			if err != nil {
+				log.Warningf("[%s] %s", q.logContext, err)
+				send(ctx, ch, NewInvalidMetric(errors.Wrap(q.logContext, err)))
+			}
+			metricsData[agg.Name] = data
+			aggregationsHandled.WithLabelValues(string(agg.Type())).Inc()
+			q.handleSubAggregations(ctx, agg, aggregation, nil, metricsData, ch)
+			if agg.Type() == config.AggregationTypeComposite && !agg.Checkpoint {
+				q.collectPages(ctx, client, agg, aggregation, metricsData, ch)
+			}
+		}
+		if agg.Type() == config.AggregationTypeTerms {
+			truncated := aggregation.Get("sum_other_doc_count").Float() > 0
+			send(ctx, ch, NewMetric(q.termsTruncatedDesc, boolToFloat64(truncated), q.metricLabels(agg.Name)...))
+		}
+		if agg.ShowDocCountError {
+			q.collectDocCountErrors(ctx, agg, aggregation, ch)
+		}
+		if agg.Checkpoint {
+			q.checkpoint(agg.Name, aggregation)
+		}
+		if agg.ReportMissingKeys {
+			keys := termsKeys(aggregation, agg.MapKey)
+			for _, key := range agg.ExpectedKeys {
+				if !keys[key] {
+					log.Warningf("[%s] Expected key %q missing from aggregation %s", q.logContext, key, agg.Name)
+				}
+				labels := append(q.metricLabels(agg.Name), &labelPair{key: "key", value: key})
+				send(ctx, ch, NewMetric(q.missingKeyDesc, boolToFloat64(!keys[key]), labels...))
+			}
+		}
+	}
+
+	var extraLabels []*labelPair
+	if q.config.NodeHeader != "" {
+		node := header.Get(q.config.NodeHeader)
+		if node == "" {
+			// Not all clusters (or proxies in front of them) send the header.
+			node = unknownLabelValue
+		}
+		extraLabels = append(extraLabels, &labelPair{key: nodeLabel, value: node})
+	}
+
+	for _, mf := range q.metricFamilies {
+		var data []metricData
+		if agg := mf.config.Aggregation(); agg != nil {
+			data = metricsData[agg.Name]
+		} else if derived := mf.config.Derived; derived != nil {
+			value, ok := derivedValue(derived, metricsData[derived.Left], metricsData[derived.Right])
+			if !ok {
+				log.V(1).Infof("[%s] Missing aggregation values for derived metric %s", q.logContext, mf.Name())
+				continue
+			}
+			data = []metricData{newMetricData(value)}
+		} else if field := mf.config.SourceField; field != "" {
+			var err errors.WithContext
+			if data, err = q.sourceData(resp, field); err != nil {
+				log.Warning(err)
+				send(ctx, ch, NewInvalidMetric(err))
+			}
 		}
+		mf.Collect(ctx, data, total, relation, ch, joinLabels(extraLabels, mf.responseLabels(resp))...)
+	}
+}
+
+// sourceData returns the values of the given `_source` field of the hits in the response, in hit order. Hits without
+// the field are skipped, as are those with a non-numeric value, which is an error.
+func (q *Query) sourceData(resp, field string) ([]metricData, errors.WithContext) {
+	var (
+		data []metricData
+		err  errors.WithContext
+	)
+	for _, hit := range gjson.Get(resp, "hits.hits").Array() {
+		value := hit.Get("_source").Get(field)
+		if !value.Exists() {
+			continue
+		}
+		if v, ok := sourceValue(value); ok {
+			data = append(data, newMetricData(v))
+		} else {
+			err = errors.Errorf(q.logContext, "non-numeric value %s of field %s in hit %s", value.Raw, field, hit.Get("_id"))
+		}
+	}
+	return data, err
+}
+
+// responseSection returns the results by name in the given section of the response, e.g. `aggregations`. It's an error
+// for the section to be anything but an object (or missing), e.g. an array as some proxies reshape responses to, which
+// would otherwise silently yield no results.
+func (q *Query) responseSection(resp, section string) (map[string]gjson.Result, errors.WithContext) {
+	result := gjson.Get(resp, section)
+	if result.Exists() && !result.IsObject() {
+		raw := result.Raw
+		if len(raw) > 50 {
+			raw = raw[:50] + "..."
+		}
+		return nil, errors.Errorf(q.logContext, "expected an object in the %s section of the response, got %s", section, raw)
+	}
+	return result.Map(), nil
+}
+
+// collectDocCountErrors emits the `doc_count_error_upper_bound` of each bucket of a terms aggregation, labeled with the
+// (mapped) bucket key. The error bounds of keys mapped to the same label add up, like their doc counts.
+func (q *Query) collectDocCountErrors(ctx context.Context, agg *config.AggregationConfig, result gjson.Result, ch chan<- Metric) {
+	var keys []string
+	bounds := make(map[string]float64)
+	for _, b := range result.Get("buckets").Array() {
+		bound := b.Get("doc_count_error_upper_bound")
+		if !bound.Exists() {
+			continue
+		}
+		key := agg.MapKey(b.Get("key").String())
+		if _, found := bounds[key]; !found {
+			keys = append(keys, key)
+		}
+		bounds[key] += bound.Float()
+	}
+	for _, key := range keys {
+		labels := append(q.metricLabels(agg.Name), &labelPair{key: "key", value: key})
+		send(ctx, ch, NewMetric(q.docCountErrorDesc, bounds[key], labels...))
+	}
+}
+
+// handleSubAggregations runs the handlers of the sub-aggregations of agg (if any) on each bucket of its result,
+// recursively. The data of sub-aggregations is labeled with the labels of all the buckets it's nested in, e.g. a `latency`
+// average nested in a `status` terms aggregation yields one sample per status, labeled `status`.
+func (q *Query) handleSubAggregations(ctx context.Context, agg *config.AggregationConfig, result gjson.Result,
+	parentLabels []*labelPair, metricsData map[string][]metricData, ch chan<- Metric) {
+	if len(agg.Aggregations) == 0 {
+		return
+	}
+	handler, ok := q.aggregationHandlers[agg.Name].(BucketAggregationHandler)
+	if !ok {
+		return
+	}
+
+	for _, b := range handler.Buckets(result) {
+		labels := joinLabels(parentLabels, b.labels)
+		for _, sub := range agg.Aggregations {
+			subResult := b.result.Get(sub.Name)
+			if !subResult.Exists() {
+				continue
+			}
+			data, err := q.aggregationHandlers[sub.Name].Handle(subResult, nil)
+			if err != nil {
+				log.Warningf("[%s] %s", q.logContext, err)
+				send(ctx, ch, NewInvalidMetric(errors.Wrap(q.logContext, err)))
+			}
+			for _, d := range data {
+				metricsData[sub.Name] = append(metricsData[sub.Name], metricData{labels: joinLabels(labels, d.labels), value: d.value})
+			}
+			aggregationsHandled.WithLabelValues(string(sub.Type())).Inc()
+			q.handleSubAggregations(ctx, sub, subResult, labels, metricsData, ch)
+		}
+	}
+}
+
+// checkAggregations compares the aggregations in the response against the expected ones, reacting to unexpected and
+// missing ones as configured.
+func (q *Query) checkAggregations(ctx context.Context, aggregations map[string]gjson.Result, ch chan<- Metric) {
+	onUnexpected, onMissing := q.config.OnUnexpectedAggregation(), q.config.OnMissingAggregation()
+	if onUnexpected == config.StrictnessIgnore && onMissing == config.StrictnessIgnore {
+		return
+	}
+
+	expected := make(map[string]bool)
+	for _, name := range q.config.ExpectedAggregationNames() {
+		expected[name] = true
+		if _, found := aggregations[name]; !found {
+			q.aggregationMismatch(ctx, onMissing, "missing", name, ch)
+		}
+	}
+	for name := range aggregations {
+		if !expected[name] {
+			q.aggregationMismatch(ctx, onUnexpected, "unexpected", name, ch)
+		}
+	}
+}
+
+func (q *Query) aggregationMismatch(
+	ctx context.Context, strictness config.Strictness, kind, aggregation string, ch chan<- Metric) {
+	switch strictness {
+	case config.StrictnessWarn:
+		aggregationMismatches.WithLabelValues(kind).Inc()
+		log.Warningf("[%s] Aggregation %s %s in response", q.logContext, aggregation, kind)
+	case config.StrictnessError:
+		aggregationMismatches.WithLabelValues(kind).Inc()
+		send(ctx, ch, NewInvalidMetric(errors.Errorf(q.logContext, "aggregation %s %s in response", aggregation, kind)))
 	}
+}
+
+// afterKey returns the stored `after_key` of the named composite aggregation, nil if it should start from the beginning.
+func (q *Query) afterKey(aggregation string) json.RawMessage {
+	q.afterKeysMu.Lock()
+	defer q.afterKeysMu.Unlock()
+	return q.afterKeys[aggregation]
+}
 
+// checkpoint stores the `after_key` of a composite aggregation result, to resume from it on the next scrape. Once there
+// are no more buckets, e.g. because the last page was reached or the index was reset or shrunk in the meantime, the
+// next scrape starts over from the beginning.
+func (q *Query) checkpoint(aggregation string, result gjson.Result) {
+	q.afterKeysMu.Lock()
+	defer q.afterKeysMu.Unlock()
+
+	after := result.Get("after_key")
+	if !after.Exists() || len(result.Get("buckets").Array()) == 0 {
+		delete(q.afterKeys, aggregation)
+		return
+	}
+	q.afterKeys[aggregation] = json.RawMessage(after.Raw)
+}
+
+// collectMetricUp emits the `metric_up` gauge of every metric family populated by the query, if enabled. Unlike the
+// invalid metric signalling a failed query, it makes the failure explicit for each individual metric.
+func (q *Query) collectMetricUp(ctx context.Context, up bool, ch chan<- Metric) {
+	if !q.globalConfig.MetricUp {
+		return
+	}
 	for _, mf := range q.metricFamilies {
-		mf.Collect(metricsData, total, ch)
+		labels := append(q.labels[:len(q.labels):len(q.labels)], &labelPair{key: "metric", value: mf.Name()})
+		send(ctx, ch, NewMetric(q.metricUpDesc, boolToFloat64(up), labels...))
 	}
 }
 
+// derivedValue computes a derived metric value from the unlabeled samples of its two aggregations. It returns false if
+// either of them has no unlabeled sample. A ratio with a zero right hand side is NaN, handled as configured by
+// non_finite.
+func derivedValue(dc *config.DerivedConfig, left, right []metricData) (float64, bool) {
+	l, ok := singleValue(left)
+	if !ok {
+		return 0, false
+	}
+	r, ok := singleValue(right)
+	if !ok {
+		return 0, false
+	}
+
+	var value float64
+	switch dc.Operation() {
+	case config.DerivedRatio:
+		if r == 0 {
+			return math.NaN(), true
+		}
+		value = l / r
+	case config.DerivedDifference:
+		value = l - r
+	case config.DerivedSum:
+		value = l + r
+	}
+	return value * dc.Scale, true
+}
+
+// singleValue returns the value of the first unlabeled sample, as produced by single-value aggregations.
+func singleValue(data []metricData) (float64, bool) {
+	for _, d := range data {
+		if !d.hasLabels() {
+			return d.value, true
+		}
+	}
+	return 0, false
+}
+
+// metricLabels returns the labels of the query's own metrics, for the given aggregation.
+func (q *Query) metricLabels(aggregation string) []*labelPair {
+	labels := make([]*labelPair, 0, len(q.labels)+1)
+	labels = append(labels, q.labels...)
+	return append(labels, &labelPair{key: "aggregation", value: aggregation})
+}
+
 func newLabeledMetricData(value float64, labelKey string, labelValue string) metricData {
 	return metricData{
 		value: value,
-		labelPair: &labelPair{
-			key:   labelKey,
-			value: labelValue,
+		labels: []*labelPair{
+			{key: labelKey, value: labelValue},
 		},
 	}
 }
@@ -111,40 +636,335 @@ func newMetricData(value float64) metricData {
 	}
 }
 
+// retryBudgetKey is the context key of the retry budget shared by all queries of a scrape.
+type retryBudgetKey struct{}
+
+// withRetryBudget returns a copy of ctx carrying a budget of n retries, shared by all queries run with it. A zero n means
+// unlimited retries.
+func withRetryBudget(ctx context.Context, n int) context.Context {
+	if n == 0 {
+		return ctx
+	}
+	budget := int32(n)
+	return context.WithValue(ctx, retryBudgetKey{}, &budget)
+}
+
+// takeRetry takes one retry from the budget of ctx, returning false if it's exhausted.
+func takeRetry(ctx context.Context) bool {
+	budget, ok := ctx.Value(retryBudgetKey{}).(*int32)
+	if !ok {
+		return true
+	}
+	for {
+		n := atomic.LoadInt32(budget)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(budget, n, n-1) {
+			return true
+		}
+	}
+}
+
+// retryableError is a WithContext marking a transient failure, worth retrying.
+type retryableError struct {
+	errors.WithContext
+}
+
+// isRetryableStatus returns true for the statuses of an overloaded or temporarily unavailable cluster (or proxy).
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// runWithRetries runs the query, retrying transient failures up to query_retries times as long as the scrape's retry
+// budget allows. Retries are spaced by retry_backoff, doubled on each attempt, and not attempted if the backoff would
+// outlast the context.
+func (q *Query) runWithRetries(ctx context.Context, client *elasticsearch.Client) (string, http.Header, errors.WithContext) {
+	backoff := time.Duration(q.globalConfig.RetryBackoff)
+	for attempt := 0; ; attempt++ {
+		resp, header, err := q.run(ctx, client)
+		if err == nil || attempt >= q.globalConfig.QueryRetries || ctx.Err() != nil {
+			return resp, header, err
+		}
+		if _, ok := err.(retryableError); !ok {
+			return resp, header, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			log.V(1).Infof("[%s] No time left to retry, not retrying: %s", q.logContext, err)
+			return resp, header, err
+		}
+		if !takeRetry(ctx) {
+			log.V(1).Infof("[%s] Retry budget exhausted, not retrying: %s", q.logContext, err)
+			return resp, header, err
+		}
+		log.V(1).Infof("[%s] Retrying query in %s (attempt %d): %s", q.logContext, backoff, attempt+2, err)
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return resp, header, err
+			}
+			backoff *= 2
+		}
+		q.retryCount.Inc()
+	}
+}
+
+// collectShards exports the shard counts of the response's `_shards` section, if any. Failed shards mean the
+// aggregations are silently partial, so they are also logged.
+func (q *Query) collectShards(ctx context.Context, resp string, ch chan<- Metric) {
+	shards := gjson.Get(resp, "_shards")
+	if !shards.IsObject() {
+		return
+	}
+	failed := shards.Get("failed").Float()
+	if failed > 0 {
+		q.errorCount.Inc()
+		log.Warningf("[%s] Query failed on %v of %v shards, results are partial: %s", q.logContext, failed,
+			shards.Get("total").Float(), shards.Get("failures.0.reason.reason").String())
+	}
+	send(ctx, ch, NewMetric(q.shardFailuresDesc, failed, q.labels...))
+	send(ctx, ch, NewMetric(q.shardsSuccessDesc, shards.Get("successful").Float(), q.labels...))
+	send(ctx, ch, NewMetric(q.shardsTotalDesc, shards.Get("total").Float(), q.labels...))
+}
+
+// collectPages fetches and handles the pages of a composite aggregation following the first one, until a page has no
+// buckets or `max_pages` is reached. Only the composite aggregation itself is requested for the following pages.
+func (q *Query) collectPages(ctx context.Context, client *elasticsearch.Client, agg *config.AggregationConfig,
+	result gjson.Result, metricsData map[string][]metricData, ch chan<- Metric) {
+	handler := q.aggregationHandlers[agg.Name]
+	for page := 1; agg.MaxPages == 0 || page < agg.MaxPages; page++ {
+		after := result.Get("after_key")
+		if !after.Exists() || len(result.Get("buckets").Array()) == 0 {
+			return
+		}
+		req := searchRequest{
+			Query: q.searchQuery(),
+			Aggs:  map[string]interface{}{agg.Name: agg.CompositeBody(json.RawMessage(after.Raw))},
+		}
+		resp, _, err := q.search(ctx, client, req)
+		if err != nil {
+			send(ctx, ch, NewInvalidMetric(errors.Wrapf(q.logContext, err, "failed to fetch page %d of aggregation %s", page+1, agg.Name)))
+			return
+		}
+		result = gjson.Get(resp, "aggregations").Map()[agg.Name]
+
+		data, herr := handler.Handle(result, metricsData[agg.Name])
+		if herr != nil {
+			log.Warningf("[%s] %s", q.logContext, herr)
+			send(ctx, ch, NewInvalidMetric(errors.Wrap(q.logContext, herr)))
+		}
+		metricsData[agg.Name] = data
+		q.handleSubAggregations(ctx, agg, result, nil, metricsData, ch)
+	}
+	log.V(1).Infof("[%s] Stopped paging aggregation %s after %d pages", q.logContext, agg.Name, agg.MaxPages)
+}
+
+// searchQuery returns the query part of the search request: the configured raw query DSL if any, else the Lucene query.
+func (q *Query) searchQuery() interface{} {
+	if raw := q.config.RawQueryBody(); raw != nil {
+		return raw
+	}
+	return searchQuery{queryString{Query: q.config.Query}}
+}
+
 // run executes the query on the provided database, in the provided context.
-func (q *Query) run(ctx context.Context, client *elasticsearch.Client) (string, errors.WithContext) {
+// It returns the response body along with the response headers.
+func (q *Query) run(ctx context.Context, client *elasticsearch.Client) (string, http.Header, errors.WithContext) {
 	req := searchRequest{
-		Query: searchQuery{queryString{Query: q.config.Query}},
+		Query: q.searchQuery(),
 	}
-	if len(q.config.Aggregations) > 0 {
-		req.Aggs = make(map[string]interface{})
-		for _, agg := range q.config.Aggregations {
-			req.Aggs[agg.Name] = agg.ParsedBody
+	for _, agg := range q.config.Aggregations {
+		if agg.Type() == config.AggregationTypeSuggest {
+			if req.Suggest == nil {
+				req.Suggest = make(map[string]interface{})
+			}
+			req.Suggest[agg.Name] = agg.SuggestBody()
+			continue
 		}
+		if req.Aggs == nil {
+			req.Aggs = make(map[string]interface{})
+		}
+		if agg.Checkpoint {
+			req.Aggs[agg.Name] = agg.CompositeBody(q.afterKey(agg.Name))
+			continue
+		}
+		req.Aggs[agg.Name] = agg.ParsedBody
+	}
+	return q.search(ctx, client, req)
+}
+
+// search runs the given search request, against the query's indices and with the query's search options.
+func (q *Query) search(ctx context.Context, client *elasticsearch.Client, req searchRequest) (
+	string, http.Header, errors.WithContext) {
+	// A slow query fails on its own rather than use up the whole scrape timeout and starve its siblings.
+	scrapeCtx := ctx
+	if timeout := time.Duration(q.config.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if timeout := time.Duration(q.config.SearchTimeout); timeout > 0 {
+		// ElasticSearch time units don't include Go's compound durations (e.g. `1m30s`).
+		req.Timeout = fmt.Sprintf("%dms", timeout.Milliseconds())
 	}
 	query := esutil.NewJSONReader(req)
-	search := client.Search
-	var response string
+	indices := []string{allIndices}
+	if q.config.IndexWindow != nil {
+		indices = q.config.IndexWindow.Indices(time.Now())
+	} else if len(q.config.Indices()) > 0 {
+		indices = q.config.Indices()
+	}
+	var (
+		response string
+		header   http.Header
+		result   *esapi.Response
+		err      error
+	)
 
-	result, err := search(search.WithBody(query), search.WithContext(ctx), search.WithTrackTotalHits(true), search.WithSize(0))
+	switch q.config.Mode() {
+	case config.QueryModeRollupSearch:
+		// Rollup search returns the same response shape, so aggregations are handled as usual.
+		rollupSearch := client.Rollup.Search
+		result, err = rollupSearch(indices, query, rollupSearch.WithContext(ctx))
+	case config.QueryModeCount:
+		// Only the query is sent, the count API doesn't run aggregations.
+		count := client.Count
+		opts := []func(*esapi.CountRequest){count.WithBody(query), count.WithContext(ctx)}
+		if q.routing != "" {
+			opts = append(opts, count.WithRouting(q.routing))
+		}
+		if q.preference != "" {
+			opts = append(opts, count.WithPreference(q.preference))
+		}
+		if q.config.IndexWindow != nil {
+			opts = append(opts, count.WithIndex(indices...), count.WithIgnoreUnavailable(true))
+		} else if len(q.config.Indices()) > 0 {
+			opts = append(opts, count.WithIndex(indices...))
+		}
+		result, err = count(opts...)
+	default:
+		search := client.Search
+		opts := []func(*esapi.SearchRequest){
+			search.WithBody(query), search.WithContext(ctx), search.WithTrackTotalHits(true), search.WithSize(q.config.Size),
+		}
+		if q.routing != "" {
+			opts = append(opts, search.WithRouting(q.routing))
+		}
+		if q.preference != "" {
+			opts = append(opts, search.WithPreference(q.preference))
+		}
+		if q.config.IndexWindow != nil {
+			// Older indices of the window may well not exist (yet or anymore).
+			opts = append(opts, search.WithIndex(indices...), search.WithIgnoreUnavailable(true))
+		} else if len(q.config.Indices()) > 0 {
+			opts = append(opts, search.WithIndex(indices...))
+		}
+		if q.config.SearchType != "" {
+			opts = append(opts, search.WithSearchType(q.config.SearchType))
+		}
+		result, err = search(opts...)
+	}
 	if result != nil && result.Body != nil {
 		defer result.Body.Close()
+		header = result.Header
 
 		if result.IsError() {
-			err = errors.Wrapf(q.logContext, err, "Request failed with status code %d", result.StatusCode)
+			err = statusError(result)
 		} else {
-			response = q.read(result.Body)
+			response, err = q.read(result.Body)
+		}
+	}
+	if err != nil && ctx.Err() != nil && scrapeCtx.Err() == nil {
+		return "", header, errors.Errorf(q.logContext, "query timed out after %s", q.config.Timeout)
+	}
+	// Connection errors (no response at all) and overload statuses are likely to go away on their own.
+	if err != nil && ctx.Err() == nil && (result == nil || isRetryableStatus(result.StatusCode)) {
+		return "", header, retryableError{errors.Wrap(q.logContext, err)}
+	}
+
+	return response, header, errors.Wrap(q.logContext, err)
+}
+
+const (
+	// errorBodyLimit is the number of bytes of a failed response's body read to find the reason of the failure.
+	errorBodyLimit = 4096
+	// errorBodyExcerpt is the number of bytes of a failed response's body included in the error, if it has no reason.
+	errorBodyExcerpt = 200
+)
+
+// statusError returns an error describing a failed response, with hints on the likely cause of auth and redirect
+// statuses, which usually come from a proxy in front of ElasticSearch rather than ElasticSearch itself. The body of
+// those is typically the proxy's HTML page, so it's left out. For other statuses it includes the reason ElasticSearch
+// gave, or else (the start of) the body.
+func statusError(result *esapi.Response) error {
+	switch code := result.StatusCode; code {
+	case http.StatusUnauthorized:
+		if challenge := result.Header.Get("WWW-Authenticate"); challenge != "" {
+			return fmt.Errorf("authentication failed with status code %d, challenge %q: check the credentials", code, challenge)
+		}
+		return fmt.Errorf("authentication failed with status code %d: check the credentials", code)
+	case http.StatusForbidden:
+		return fmt.Errorf("access denied with status code %d: check the privileges of the user or API key", code)
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+		return fmt.Errorf("unexpected redirect with status code %d to %q: check the target URL", code, result.Header.Get("Location"))
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(result.Body, errorBodyLimit))
+		if reason := gjson.GetBytes(body, "error.reason"); reason.Exists() {
+			return fmt.Errorf("request failed with status code %d, %s: %s", code, gjson.GetBytes(body, "error.type"), reason)
+		}
+		if len(body) > errorBodyExcerpt {
+			body = append(body[:errorBodyExcerpt], "..."...)
 		}
+		if excerpt := strings.TrimSpace(string(body)); excerpt != "" {
+			return fmt.Errorf("request failed with status code %d: %s", code, excerpt)
+		}
+		return fmt.Errorf("request failed with status code %d", code)
 	}
+}
 
-	return response, errors.Wrap(q.logContext, err)
+// renderLabelTemplate executes the given template text against the target labels. An empty text renders to an empty
+// string, a non-empty one must not render to an empty string nor reference undefined labels.
+func renderLabelTemplate(name, text string, labels map[string]string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, labels); err != nil {
+		return "", err
+	}
+	result := strings.TrimSpace(b.String())
+	if result == "" {
+		return "", fmt.Errorf("%s %q resolved to an empty value", name, text)
+	}
+	return result, nil
 }
 
-func (q *Query) read(r io.Reader) string {
+// read reads the response body, failing if it's larger than max_response_bytes rather than returning truncated JSON.
+func (q *Query) read(r io.Reader) (string, errors.WithContext) {
+	limit := q.globalConfig.MaxResponse
+	if limit > 0 {
+		// Read one extra byte to tell a response of exactly the limit size from a larger one.
+		r = io.LimitReader(r, limit+1)
+	}
 	var b bytes.Buffer
 	_, err := b.ReadFrom(r)
 	if err != nil {
-		return ""
+		return "", errors.Wrapf(q.logContext, err, "failed to read response")
+	}
+	if limit > 0 && int64(b.Len()) > limit {
+		return "", errors.Errorf(q.logContext, "response exceeds max_response_bytes (%d)", limit)
 	}
-	return b.String()
+	return b.String(), nil
 }
@@ -0,0 +1,1388 @@
+package elastic_exporter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"iss.digital/mt/elastic_exporter/config"
+)
+
+// runCollector collects the collector defined by text from a fake ElasticSearch answering with handler. It returns the
+// formatted metrics along with the fake ElasticSearch.
+func runCollector(t *testing.T, text string, gc *config.GlobalConfig, handler http.HandlerFunc) ([]string, *testServer) {
+	t.Helper()
+	if gc == nil {
+		gc = mustGlobalConfig(t, "")
+	}
+	c := mustCollector(t, text, gc)
+	server := newTestServer(t, handler)
+	client := server.esClient(t)
+	metrics := collectMetrics(func(ch chan<- Metric) {
+		c.Collect(context.Background(), client, ch)
+	})
+	return formatMetrics(metrics), server
+}
+
+const hostsResponse = `{
+  "took": 3,
+  "hits": {"total": {"value": 15, "relation": "eq"}},
+  "aggregations": {"host": {"buckets": [{"key": "a", "doc_count": 10}, {"key": "b", "doc_count": 5}]}}
+}`
+
+// rollupResponse is a rollup search response, whose hits are always 0.
+const rollupResponse = `{
+  "took": 3,
+  "timed_out": false,
+  "terminated_early": false,
+  "_shards": {"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+  "hits": {"total": {"value": 0, "relation": "eq"}, "max_score": 0, "hits": []},
+  "aggregations": {
+    "all": {"value": 20},
+    "host": {"buckets": [{"key": "a", "doc_count": 10}, {"key": "b", "doc_count": 5}]}
+  }
+}`
+
+func TestQueryRollupSearch(t *testing.T) {
+	const collector = `
+collector_name: test
+queries:
+  - query_name: rollup
+    query: "*"
+    index: rollup-logs
+    mode: rollup_search
+    aggregations:
+      - name: host
+        type: terms
+        field: host
+      - name: all
+        type: sum
+        field: requests
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host.
+    query_ref: rollup
+    aggregation_ref: host
+`
+	lines, server := runCollector(t, collector, nil, respondJSON(rollupResponse))
+
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Path != "/rollup-logs/_rollup_search" {
+		t.Fatalf("expected a single request to /rollup-logs/_rollup_search, got %+v", requests)
+	}
+	// Without the meaningless total of 0.
+	assertLines(t, linesOf(lines, "requests"),
+		`requests{host="a"} 10`,
+		`requests{host="b"} 5`)
+	assertLines(t, errorLines(lines))
+
+	// Unless the total is read from an aggregation.
+	text := strings.Replace(collector, "mode: rollup_search", "mode: rollup_search\n    total_path: aggregations.all.value", 1) +
+		"    value_type: percent\n"
+	lines, _ = runCollector(t, text, nil, respondJSON(rollupResponse))
+	assertLines(t, linesOf(lines, "requests"),
+		`requests{host="a"} 50`,
+		`requests{host="b"} 25`,
+		`requests 20`)
+	assertLines(t, errorLines(lines))
+}
+
+func TestQueryPreservesBucketOrder(t *testing.T) {
+	const collector = `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: host
+        type: terms
+        field: host
+      - name: status
+        type: terms
+        field: status
+metrics:
+  - metric_name: requests_by_host
+    type: gauge
+    help: Requests by host.
+    query_ref: requests
+    aggregation_ref: host
+  - metric_name: requests_by_status
+    type: gauge
+    help: Requests by status.
+    query_ref: requests
+    aggregation_ref: status
+`
+	// Ordered by a sub-aggregation rather than by key or doc count.
+	const response = `{
+  "hits": {"total": {"value": 33}},
+  "aggregations": {
+    "status": {"buckets": [{"key": "500", "doc_count": 3}, {"key": "200", "doc_count": 30}]},
+    "host": {"buckets": [{"key": "z", "doc_count": 1}, {"key": "a", "doc_count": 30}, {"key": "m", "doc_count": 2}]}
+  }
+}`
+	// Over several runs, as map iteration order is random.
+	for i := 0; i < 10; i++ {
+		lines, _ := runCollector(t, collector, nil, respondJSON(response))
+		assertLines(t, append(linesOf(lines, "requests_by_host"), linesOf(lines, "requests_by_status")...),
+			`requests_by_host{host="z"} 1`,
+			`requests_by_host{host="a"} 30`,
+			`requests_by_host{host="m"} 2`,
+			`requests_by_host 33`,
+			`requests_by_status{status="500"} 3`,
+			`requests_by_status{status="200"} 30`,
+			`requests_by_status 33`)
+	}
+}
+
+func TestQueryTermsTruncated(t *testing.T) {
+	const collector = `
+collector_name: test
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host.
+    query: "*"
+    aggregation:
+      name: host
+      type: terms
+      field: host
+`
+	for _, tc := range []struct {
+		otherDocCount int
+		want          string
+	}{
+		{0, `terms_truncated{aggregation="host",collector="test",query="requests"} 0`},
+		{7, `terms_truncated{aggregation="host",collector="test",query="requests"} 1`},
+	} {
+		response := fmt.Sprintf(`{
+  "hits": {"total": {"value": 10}},
+  "aggregations": {"host": {"sum_other_doc_count": %d, "buckets": [{"key": "a", "doc_count": 3}]}}
+}`, tc.otherDocCount)
+		lines, _ := runCollector(t, collector, nil, respondJSON(response))
+		assertLines(t, linesOf(lines, "terms_truncated"), tc.want)
+	}
+}
+
+func TestQueryDocCountErrors(t *testing.T) {
+	lines, server := runCollector(t, `
+collector_name: test
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host.
+    query: "*"
+    aggregation:
+      name: host
+      type: terms
+      field: host
+      show_doc_count_error: true
+`, nil, respondJSON(`{
+  "hits": {"total": {"value": 10}},
+  "aggregations": {"host": {"buckets": [
+    {"key": "a", "doc_count": 6, "doc_count_error_upper_bound": 2},
+    {"key": "b", "doc_count": 4, "doc_count_error_upper_bound": 0}
+  ]}}
+}`))
+	assertLines(t, errorLines(lines))
+	assertLines(t, linesOf(lines, "terms_doc_count_error"),
+		`terms_doc_count_error{aggregation="host",collector="test",key="a",query="requests"} 2`,
+		`terms_doc_count_error{aggregation="host",collector="test",key="b",query="requests"} 0`)
+	if body := server.Requests()[0].Body; !strings.Contains(body, `"show_term_doc_count_error":true`) {
+		t.Errorf("got request body %s, want show_term_doc_count_error", body)
+	}
+}
+
+func TestQueryArrayAggregations(t *testing.T) {
+	lines, _ := runCollector(t, `
+collector_name: test
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host.
+    query: "*"
+    aggregation:
+      name: host
+      type: terms
+      field: host
+`, nil, respondJSON(`{
+  "hits": {"total": {"value": 10}},
+  "aggregations": [{"host": {"buckets": [{"key": "a", "doc_count": 10}]}}]
+}`))
+	want := `error: [test, collector="test", query="requests"] expected an object in the aggregations section of the response, ` +
+		`got [{"host": {"buckets": [{"key": "a", "doc_count": 1...`
+	var found bool
+	for _, l := range errorLines(lines) {
+		found = found || l == want
+	}
+	if !found {
+		t.Errorf("got errors:\n  %s\nwant:\n  %s", strings.Join(errorLines(lines), "\n  "), want)
+	}
+}
+
+func TestQueryTemplatedRouting(t *testing.T) {
+	const collector = `
+collector_name: test
+queries:
+  - query_name: hits
+    query: "*"
+    routing: "{{ .tenant }}"
+    preference: "_local_{{ .instance }}"
+metrics:
+  - metric_name: hits
+    type: gauge
+    help: Hits.
+    query_ref: hits
+    track_total: true
+`
+	labels := []*dto.LabelPair{
+		{Name: proto.String("instance"), Value: proto.String("es1")},
+		{Name: proto.String("tenant"), Value: proto.String("acme")},
+	}
+	c, err := NewCollector("test", mustCollectorConfig(t, collector), labels, mustGlobalConfig(t, ""))
+	if err != nil {
+		t.Fatalf("NewCollector: %s", err)
+	}
+	server := newTestServer(t, respondJSON(`{"hits": {"total": {"value": 1}}}`))
+	client := server.esClient(t)
+	collectMetrics(func(ch chan<- Metric) {
+		c.Collect(context.Background(), client, ch)
+	})
+
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected a single request, got %d", len(requests))
+	}
+	if got := requests[0].Query.Get("routing"); got != "acme" {
+		t.Errorf("got routing %q, want %q", got, "acme")
+	}
+	if got := requests[0].Query.Get("preference"); got != "_local_es1" {
+		t.Errorf("got preference %q, want %q", got, "_local_es1")
+	}
+
+	// Undefined labels are an error, rather than an empty routing value.
+	if _, err := NewCollector("test", mustCollectorConfig(t, collector), labels[:1], mustGlobalConfig(t, "")); err == nil {
+		t.Error("expected an error for an undefined routing label")
+	}
+}
+
+func TestQueryMaxResponseBytes(t *testing.T) {
+	gc := mustGlobalConfig(t, "max_response_bytes: 100")
+
+	lines, _ := runCollector(t, hitsCollector, gc, respondJSON(`{"hits": {"total": {"value": 1}}}`))
+	assertLines(t, linesOf(lines, "hits"), `hits 1`)
+
+	oversized := `{"hits": {"total": {"value": 1}}, "padding": "` + strings.Repeat("x", 100) + `"}`
+	lines, _ = runCollector(t, hitsCollector, gc, respondJSON(oversized))
+	assertLines(t, linesOf(lines, "hits"))
+	if errs := errorLines(lines); len(errs) != 1 || !strings.Contains(errs[0], "response exceeds max_response_bytes (100)") {
+		t.Errorf("expected a max_response_bytes error, got %v", errs)
+	}
+}
+
+func TestQueryAggregationGauges(t *testing.T) {
+	lines, _ := runCollector(t, `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: host
+        type: terms
+        field: host
+        aggregations:
+          - name: latency
+            type: avg
+            field: latency
+      - name: max_latency
+        type: max
+        field: latency
+metrics:
+  - metric_name: latency
+    type: gauge
+    help: Average latency by host.
+    query_ref: requests
+    aggregation_ref: latency
+`, nil, func(w http.ResponseWriter, r *http.Request) {
+		// Known from the configuration, so exported even if the query fails.
+		http.Error(w, "unavailable", http.StatusBadRequest)
+	})
+	assertLines(t, linesOf(lines, "query_aggregations"), `query_aggregations{collector="test",query="requests"} 3`)
+	assertLines(t, linesOf(lines, "query_aggregation_depth"), `query_aggregation_depth{collector="test",query="requests"} 2`)
+}
+
+func TestQueryPercentilesSummaries(t *testing.T) {
+	lines, _ := runCollector(t, `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: latency_percentiles
+        type: percentiles
+        field: latency
+        percents: [50, 99]
+      - name: size_percentiles
+        type: percentiles
+        field: size
+        percents: [50, 99]
+metrics:
+  - metric_name: latency_seconds
+    type: summary
+    help: Request latency.
+    query_ref: requests
+    aggregation_ref: latency_percentiles
+  - metric_name: size_bytes
+    type: summary
+    help: Response size.
+    query_ref: requests
+    aggregation_ref: size_percentiles
+`, nil, respondJSON(`{
+  "hits": {"total": {"value": 100}},
+  "aggregations": {
+    "latency_percentiles": {"values": {"50.0": 0.2, "99.0": 1.5}},
+    "size_percentiles": {"values": {"50.0": 512, "99.0": 4096}}
+  }
+}`))
+	assertLines(t, errorLines(lines))
+	assertLines(t, linesOf(lines, "latency_seconds"), `latency_seconds summary count=100 quantiles=0.5:0.2,0.99:1.5`)
+	assertLines(t, linesOf(lines, "size_bytes"), `size_bytes summary count=100 quantiles=0.5:512,0.99:4096`)
+}
+
+const hitsCollector = `
+collector_name: test
+queries:
+  - query_name: hits
+    query: "*"
+metrics:
+  - metric_name: hits
+    type: gauge
+    help: Hits.
+    query_ref: hits
+    track_total: true
+`
+
+func TestQueryResponseLabels(t *testing.T) {
+	text := strings.Replace(hitsCollector, "track_total: true", `track_total: true
+    static_labels:
+      env: prod
+    response_labels:
+      shards: _shards.total
+      generation: _meta.generation`, 1)
+	lines, _ := runCollector(t, text, nil, respondJSON(`{"_shards": {"total": 5}, "hits": {"total": {"value": 10}}}`))
+	assertLines(t, errorLines(lines))
+	// Missing paths are valued `unknown`, static labels still apply.
+	assertLines(t, linesOf(lines, "hits"), `hits{env="prod",generation="unknown",shards="5"} 10`)
+}
+
+func TestQueryRawQuery(t *testing.T) {
+	text := strings.Replace(hitsCollector, `query: "*"`,
+		`raw_query: '{"bool": {"filter": [{"term": {"level": "error"}}, {"range": {"@timestamp": {"gte": "now-5m"}}}]}}'`, 1)
+	lines, server := runCollector(t, text, nil, respondJSON(`{"hits": {"total": {"value": 3}}}`))
+	assertLines(t, linesOf(lines, "hits"), `hits 3`)
+
+	body := server.Requests()[0].Body
+	// Compacted, but otherwise as is.
+	want := `{"query":{"bool":{"filter":[{"term":{"level":"error"}},{"range":{"@timestamp":{"gte":"now-5m"}}}]}}}`
+	if strings.TrimSpace(body) != want {
+		t.Errorf("got request body %s, want the raw query %s", body, want)
+	}
+}
+
+func TestQueryIndex(t *testing.T) {
+	for _, tc := range []struct {
+		index    string
+		wantPath string
+	}{
+		{"", "/_search"},
+		{"logs", "/logs/_search"},
+		{"logs-*", "/logs-*/_search"},
+		{"logs-*, metrics", "/logs-*,metrics/_search"},
+	} {
+		text := strings.Replace(hitsCollector, `query: "*"`, `query: "*"
+    index: "`+tc.index+`"`, 1)
+		_, server := runCollector(t, text, nil, respondJSON(`{"hits": {"total": {"value": 3}}}`))
+		if requests := server.Requests(); len(requests) != 1 || requests[0].Path != tc.wantPath {
+			t.Errorf("index %q: got requests %+v, want a single one to %s", tc.index, requests, tc.wantPath)
+		}
+	}
+}
+
+func TestQuerySourceField(t *testing.T) {
+	lines, server := runCollector(t, `
+collector_name: test
+queries:
+  - query_name: latest
+    query: "type:reading"
+    size: 1
+metrics:
+  - metric_name: temperature
+    type: gauge
+    help: Latest temperature.
+    query_ref: latest
+    source_field: sensor.temperature
+`, nil, respondJSON(`{"hits": {"total": {"value": 40}, "hits": [
+  {"_id": "1", "_source": {"sensor": {"temperature": 21.5}}}
+]}}`))
+	assertLines(t, errorLines(lines))
+	assertLines(t, linesOf(lines, "temperature"), `temperature 21.5`)
+	if size := server.Requests()[0].Query.Get("size"); size != "1" {
+		t.Errorf("got size %q, want 1", size)
+	}
+
+	// Only counts by default.
+	_, server = runCollector(t, hitsCollector, nil, respondJSON(`{"hits": {"total": {"value": 40}}}`))
+	if size := server.Requests()[0].Query.Get("size"); size != "0" {
+		t.Errorf("got size %q, want 0", size)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	c := mustCollector(t, `
+collector_name: test
+queries:
+  - query_name: slow
+    query: "*"
+    index: slow
+    timeout: 50ms
+  - query_name: fast
+    query: "*"
+    index: fast
+metrics:
+  - metric_name: slow_hits
+    type: gauge
+    help: Hits.
+    query_ref: slow
+    track_total: true
+  - metric_name: fast_hits
+    type: gauge
+    help: Hits.
+    query_ref: fast
+    track_total: true
+`, mustGlobalConfig(t, ""))
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slow/") {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		respondJSON(`{"hits": {"total": {"value": 7}}}`)(w, r)
+	})
+	client := server.esClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	lines := formatMetrics(collectMetrics(func(ch chan<- Metric) {
+		c.Collect(ctx, client, ch)
+	}))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("collect took %s, want the slow query to time out after 50ms", elapsed)
+	}
+	assertLines(t, errorLines(lines), `error: [test, collector="test", query="slow"] query timed out after 50ms`)
+	assertLines(t, linesOf(lines, "slow_hits"))
+	assertLines(t, linesOf(lines, "fast_hits"), `fast_hits 7`)
+}
+
+func TestQueryRetries(t *testing.T) {
+	gc := mustGlobalConfig(t, "query_retries: 3\nretry_backoff: 20ms")
+	for _, tc := range []struct {
+		name        string
+		status      int
+		failures    int32
+		wantErr     bool
+		wantRetries float64
+	}{
+		{"transient", http.StatusTooManyRequests, 2, false, 2},
+		{"bad request", http.StatusBadRequest, 2, true, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			retriesBefore := testutil.ToFloat64(queryRetries.WithLabelValues("test", "hits"))
+			start := time.Now()
+			lines, _ := runCollector(t, hitsCollector, gc, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= tc.failures {
+					http.Error(w, `{"error": "failed"}`, tc.status)
+					return
+				}
+				respondJSON(`{"hits": {"total": {"value": 3}}}`)(w, r)
+			})
+
+			if tc.wantErr {
+				assertLines(t, linesOf(lines, "hits"))
+				if requests != 1 {
+					t.Errorf("got %d requests, want the query to fail fast", requests)
+				}
+			} else {
+				assertLines(t, errorLines(lines))
+				assertLines(t, linesOf(lines, "hits"), `hits 3`)
+				// Backing off 20ms, then 40ms.
+				if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+					t.Errorf("retried within %s, want a backoff of at least 60ms", elapsed)
+				}
+			}
+			if got := testutil.ToFloat64(queryRetries.WithLabelValues("test", "hits")) - retriesBefore; got != tc.wantRetries {
+				t.Errorf("got %v retries, want %v", got, tc.wantRetries)
+			}
+		})
+	}
+}
+
+func TestQuerySearchTimeout(t *testing.T) {
+	text := strings.Replace(hitsCollector, `query: "*"`, `query: "*"
+    search_timeout: 5s`, 1)
+	for _, timedOut := range []bool{false, true} {
+		response := fmt.Sprintf(`{"timed_out": %t, "hits": {"total": {"value": 3}}}`, timedOut)
+		lines, server := runCollector(t, text, nil, respondJSON(response))
+		assertLines(t, linesOf(lines, "query_timed_out"),
+			`query_timed_out{collector="test",query="hits"} `+formatFloat(boolToFloat64(timedOut)))
+		// Partial results are exported nonetheless.
+		assertLines(t, linesOf(lines, "hits"), `hits 3`)
+		if body := server.Requests()[0].Body; !strings.Contains(body, `"timeout":"5000ms"`) {
+			t.Errorf("got request body %s, want a 5000ms timeout", body)
+		}
+	}
+
+	// Neither sent nor reported by default.
+	lines, server := runCollector(t, hitsCollector, nil, respondJSON(`{"timed_out": false, "hits": {"total": {"value": 3}}}`))
+	assertLines(t, linesOf(lines, "query_timed_out"))
+	if body := server.Requests()[0].Body; strings.Contains(body, `"timeout"`) {
+		t.Errorf("got request body %s, want no timeout", body)
+	}
+}
+
+func TestQueryShards(t *testing.T) {
+	lines, _ := runCollector(t, hitsCollector, nil, respondJSON(`{
+  "_shards": {"total": 5, "successful": 3, "skipped": 0, "failed": 2, "failures": [{"reason": {"reason": "boom"}}]},
+  "hits": {"total": {"value": 3}}
+}`))
+	assertLines(t, linesOf(lines, "query_shard_failures"), `query_shard_failures{collector="test",query="hits"} 2`)
+	assertLines(t, linesOf(lines, "query_shards_successful"), `query_shards_successful{collector="test",query="hits"} 3`)
+	assertLines(t, linesOf(lines, "query_shards_total"), `query_shards_total{collector="test",query="hits"} 5`)
+	// Partial results are exported nonetheless.
+	assertLines(t, linesOf(lines, "hits"), `hits 3`)
+
+	// Nothing without a _shards section, e.g. from a proxy.
+	lines, _ = runCollector(t, hitsCollector, nil, respondJSON(`{"hits": {"total": {"value": 3}}}`))
+	assertLines(t, linesOf(lines, "query_shard_failures"))
+}
+
+func TestQueryErrors(t *testing.T) {
+	text := strings.Replace(hitsCollector, `query: "*"`, `query: "*"
+    search_timeout: 5s`, 1)
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		want    float64
+	}{
+		{"ok", respondJSON(`{"timed_out": false, "hits": {"total": {"value": 3}}}`), 0},
+		{"error", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"error": "failed"}`, http.StatusBadRequest)
+		}, 1},
+		{"timed out", respondJSON(`{"timed_out": true, "hits": {"total": {"value": 3}}}`), 1},
+		{"shard failures", respondJSON(`{
+  "timed_out": false,
+  "_shards": {"total": 5, "successful": 3, "skipped": 0, "failed": 2, "failures": [{"reason": {"reason": "boom"}}]},
+  "hits": {"total": {"value": 3}}
+}`), 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := testutil.ToFloat64(queryErrors.WithLabelValues("test", "hits"))
+			runCollector(t, text, nil, tc.handler)
+			if got := testutil.ToFloat64(queryErrors.WithLabelValues("test", "hits")) - before; got != tc.want {
+				t.Errorf("got %v errors, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestQueryCountMode(t *testing.T) {
+	text := strings.Replace(hitsCollector, `query: "*"`, `query: "level:error"
+    index: logs
+    mode: count`, 1)
+	lines, server := runCollector(t, text, nil, respondJSON(`{"count": 42, "_shards": {"total": 1, "successful": 1, "failed": 0}}`))
+	assertLines(t, errorLines(lines))
+	assertLines(t, linesOf(lines, "hits"), `hits 42`)
+
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Path != "/logs/_count" {
+		t.Fatalf("got requests %+v, want a single one to /logs/_count", requests)
+	}
+	if body := requests[0].Body; !strings.Contains(body, `"query_string":{"query":"level:error"}`) || strings.Contains(body, "aggs") {
+		t.Errorf("got request body %s, want only the query", body)
+	}
+}
+
+func TestQueryTotalPath(t *testing.T) {
+	const collector = `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    total_path: aggregations.all.doc_count
+    aggregations:
+      - name: status
+        type: terms
+        field: status
+metrics:
+  - metric_name: requests_percent
+    type: gauge
+    help: Share of requests by status.
+    query_ref: requests
+    aggregation_ref: status
+    value_type: percent
+`
+	lines, _ := runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 10}},
+  "aggregations": {
+    "all": {"doc_count": 200},
+    "status": {"buckets": [{"key": "200", "doc_count": 150}, {"key": "500", "doc_count": 10}]}
+  }
+}`))
+	assertLines(t, errorLines(lines))
+	assertLines(t, linesOf(lines, "requests_percent"),
+		`requests_percent{status="200"} 75`,
+		`requests_percent{status="500"} 5`,
+		`requests_percent 200`)
+
+	// A missing total is an error, rather than a total of 0 (and percentages of 0).
+	lines, _ = runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 10}},
+  "aggregations": {"status": {"buckets": [{"key": "200", "doc_count": 150}]}}
+}`))
+	assertLines(t, errorLines(lines),
+		`error: [test, collector="test", query="requests"] total_path aggregations.all.doc_count not found in response`)
+	assertLines(t, linesOf(lines, "requests_percent"))
+}
+
+func TestQueryServerDuration(t *testing.T) {
+	const response = `{"took": 250, "hits": {"total": {"value": 1}}}`
+
+	lines, _ := runCollector(t, hitsCollector, nil, respondJSON(response))
+	assertLines(t, linesOf(lines, "query_server_duration_seconds"),
+		`query_server_duration_seconds{collector="test",query="hits"} 0.25`)
+
+	lines, _ = runCollector(t, hitsCollector, mustGlobalConfig(t, "took_milliseconds: true"), respondJSON(response))
+	assertLines(t, linesOf(lines, "query_server_duration_seconds"))
+	assertLines(t, linesOf(lines, "query_server_duration_milliseconds"),
+		`query_server_duration_milliseconds{collector="test",query="hits"} 250`)
+}
+
+func TestQueryExpectedKeys(t *testing.T) {
+	lines, _ := runCollector(t, `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: status
+        type: terms
+        field: status
+        expected_keys: ["200", "500"]
+        report_missing_keys: true
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by status.
+    query_ref: requests
+    aggregation_ref: status
+`, nil, respondJSON(`{
+  "hits": {"total": {"value": 10}},
+  "aggregations": {"status": {"buckets": [{"key": "200", "doc_count": 10}]}}
+}`))
+	assertLines(t, linesOf(lines, "requests"),
+		`requests{status="200"} 10`,
+		`requests{status="500"} 0`,
+		`requests 10`)
+	assertLines(t, linesOf(lines, "missing_key"),
+		`missing_key{aggregation="status",collector="test",key="200",query="requests"} 0`,
+		`missing_key{aggregation="status",collector="test",key="500",query="requests"} 1`)
+}
+
+func TestQueryMetricUp(t *testing.T) {
+	const collector = `
+collector_name: test
+queries:
+  - query_name: hosts
+    query: "*"
+    aggregations:
+      - name: host
+        type: terms
+        field: host
+      - name: status
+        type: terms
+        field: status
+metrics:
+  - metric_name: statuses
+    type: gauge
+    help: Hits by status.
+    query_ref: hosts
+    aggregation_ref: status
+  - metric_name: hosts
+    type: gauge
+    help: Hits by host.
+    query_ref: hosts
+    aggregation_ref: host
+`
+	gc := mustGlobalConfig(t, "metric_up: true")
+	fail := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "boom"}`, http.StatusInternalServerError)
+	}
+
+	lines, _ := runCollector(t, collector, gc, fail)
+	assertLines(t, linesOf(lines, "metric_up"),
+		`metric_up{collector="test",metric="statuses",query="hosts"} 0`,
+		`metric_up{collector="test",metric="hosts",query="hosts"} 0`)
+	if len(errorLines(lines)) != 1 {
+		t.Errorf("got %d invalid metrics, want 1", len(errorLines(lines)))
+	}
+
+	lines, _ = runCollector(t, collector, gc, respondJSON(hostsResponse))
+	assertLines(t, linesOf(lines, "metric_up"),
+		`metric_up{collector="test",metric="statuses",query="hosts"} 1`,
+		`metric_up{collector="test",metric="hosts",query="hosts"} 1`)
+
+	lines, _ = runCollector(t, collector, nil, fail)
+	assertLines(t, linesOf(lines, "metric_up"))
+}
+
+func TestQuerySearchType(t *testing.T) {
+	_, server := runCollector(t, hitsCollector, nil, respondJSON(`{"hits": {"total": {"value": 1}}}`))
+	if st, ok := server.Requests()[0].Query["search_type"]; ok {
+		t.Errorf("got search_type %q, want none", st)
+	}
+
+	text := strings.Replace(hitsCollector, `query: "*"`, `query: "*"
+    search_type: dfs_query_then_fetch`, 1)
+	_, server = runCollector(t, text, nil, respondJSON(`{"hits": {"total": {"value": 1}}}`))
+	if st := server.Requests()[0].Query.Get("search_type"); st != "dfs_query_then_fetch" {
+		t.Errorf("got search_type %q, want dfs_query_then_fetch", st)
+	}
+}
+
+func TestQuerySuggest(t *testing.T) {
+	const collector = `
+collector_name: test
+queries:
+  - query_name: spelling
+    query: "*"
+    aggregations:
+      - name: spelling
+        type: suggest
+        field: message
+        text: eror
+metrics:
+  - metric_name: suggestion_score
+    type: gauge
+    help: Suggestion scores.
+    query_ref: spelling
+    aggregation_ref: spelling
+`
+	lines, server := runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 0}},
+  "suggest": {"spelling": [{"text": "eror", "options": [
+    {"text": "error", "score": 0.8, "freq": 12},
+    {"text": "errors", "score": 0.5, "freq": 3}
+  ]}]}
+}`))
+	assertLines(t, linesOf(lines, "suggestion_score"),
+		`suggestion_score{spelling="error"} 0.8`,
+		`suggestion_score{spelling="errors"} 0.5`,
+		`suggestion_score 0`)
+	if body := server.Requests()[0].Body; !strings.Contains(body, `"suggest":{"spelling":`) {
+		t.Errorf("got request body %s, want a spelling suggester", body)
+	}
+
+	lines, _ = runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 0}},
+  "suggest": {"spelling": [{"text": "eror", "options": []}]}
+}`))
+	assertLines(t, linesOf(lines, "suggestion_score"), `suggestion_score 0`)
+	assertLines(t, errorLines(lines))
+
+	// Options without the value are an error, rather than exported as 0.
+	lines, _ = runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 0}},
+  "suggest": {"spelling": [{"text": "eror", "options": [
+    {"text": "error", "score": 0.8},
+    {"text": "errors", "freq": 3},
+    {"text": "errata", "score": "high"}
+  ]}]}
+}`))
+	assertLines(t, linesOf(lines, "suggestion_score"),
+		`suggestion_score{spelling="error"} 0.8`,
+		`suggestion_score 0`)
+	// The last error is reported.
+	assertLines(t, errorLines(lines),
+		`error: [test, collector="test", query="spelling"] non-numeric score "high" for option "errata" of suggester spelling`)
+
+	lines, _ = runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 0}},
+  "suggest": {"spelling": [{"text": "eror", "options": [{"text": "errors", "freq": 3}]}]}
+}`))
+	assertLines(t, errorLines(lines),
+		`error: [test, collector="test", query="spelling"] missing score for option "errors" of suggester spelling`)
+}
+
+func TestQueryDerivedMetric(t *testing.T) {
+	const collector = `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: errors
+        type: sum
+        field: errors
+      - name: total
+        type: sum
+        field: requests
+metrics:
+  - metric_name: error_ratio
+    type: gauge
+    help: Percentage of failed requests.
+    query_ref: requests
+    derived:
+      operation: ratio
+      left: errors
+      right: total
+      scale: 100
+  - metric_name: successes
+    type: gauge
+    help: Successful requests.
+    query_ref: requests
+    derived:
+      operation: difference
+      left: total
+      right: errors
+`
+	lines, _ := runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 10}},
+  "aggregations": {"errors": {"value": 5}, "total": {"value": 200}}
+}`))
+	assertLines(t, linesOf(lines, "error_ratio"), `error_ratio 2.5`)
+	assertLines(t, linesOf(lines, "successes"), `successes 195`)
+
+	// A zero right hand side doesn't make for an infinite ratio.
+	lines, _ = runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 0}},
+  "aggregations": {"errors": {"value": 0}, "total": {"value": 0}}
+}`))
+	assertLines(t, linesOf(lines, "error_ratio"))
+	assertLines(t, linesOf(lines, "successes"), `successes 0`)
+}
+
+func TestQueryDurationHistogram(t *testing.T) {
+	c := mustCollector(t, hitsCollector, mustGlobalConfig(t, "query_duration_buckets: [0.05, 10]"))
+	slow := make(chan bool, 1)
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if <-slow {
+			time.Sleep(100 * time.Millisecond)
+		}
+		respondJSON(`{"hits": {"total": {"value": 1}}}`)(w, r)
+	})
+	client := server.esClient(t)
+
+	var lines []string
+	for _, s := range []bool{false, true, false} {
+		slow <- s
+		lines = formatMetrics(collectMetrics(func(ch chan<- Metric) {
+			c.Collect(context.Background(), client, ch)
+		}))
+	}
+	assertLines(t, linesOf(lines, "query_duration_seconds"),
+		`query_duration_seconds{collector="test",query="hits"} histogram count=3 buckets=0.05:2,10:3`)
+}
+
+func TestQueryLastDuration(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout string
+		min     float64
+	}{
+		{"succeeded", "", 0.1},
+		// Reported on failure too, with the time it took to give up.
+		{"timed out", "\n    timeout: 50ms", 0.05},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			text := strings.Replace(hitsCollector, `query: "*"`, `query: "*"`+tc.timeout, 1)
+			lines, _ := runCollector(t, text, nil, func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(100 * time.Millisecond):
+				}
+				respondJSON(`{"hits": {"total": {"value": 1}}}`)(w, r)
+			})
+			got := linesOf(lines, "query_last_duration_seconds")
+			if len(got) != 1 {
+				t.Fatalf("got %q, want a single query_last_duration_seconds sample", got)
+			}
+			prefix := `query_last_duration_seconds{collector="test",query="hits"} `
+			duration, err := strconv.ParseFloat(strings.TrimPrefix(got[0], prefix), 64)
+			if err != nil || !strings.HasPrefix(got[0], prefix) {
+				t.Fatalf("got %q, want %s<duration>", got[0], prefix)
+			}
+			if duration < tc.min || duration > 5 {
+				t.Errorf("got a duration of %vs, want between %vs and 5s", duration, tc.min)
+			}
+		})
+	}
+}
+
+func TestQueryNonNumericTotal(t *testing.T) {
+	lines, _ := runCollector(t, hitsCollector, nil, respondJSON(`{"hits": {"total": {"value": "many"}}}`))
+	// Rather than a made up 0.
+	assertLines(t, linesOf(lines, "hits"))
+	assertLines(t, errorLines(lines), `error: [test, collector="test", query="hits"] non-numeric hits.total.value "many"`)
+}
+
+func TestQueryCompositeCheckpoint(t *testing.T) {
+	c := mustCollector(t, `
+collector_name: test
+queries:
+  - query_name: hosts
+    query: "*"
+    aggregations:
+      - name: hosts
+        type: composite
+        size: 2
+        checkpoint: true
+        sources:
+          - name: host
+            field: host
+metrics:
+  - metric_name: hosts
+    type: gauge
+    help: Hits by host.
+    query_ref: hosts
+    aggregation_ref: hosts
+`, mustGlobalConfig(t, ""))
+	responses := []string{
+		`{"hits": {"total": {"value": 9}}, "aggregations": {"hosts": {"after_key": {"host": "b"}, "buckets": [
+  {"key": {"host": "a"}, "doc_count": 2}, {"key": {"host": "b"}, "doc_count": 3}
+]}}}`,
+		`{"hits": {"total": {"value": 9}}, "aggregations": {"hosts": {"after_key": {"host": "c"}, "buckets": [
+  {"key": {"host": "c"}, "doc_count": 4}
+]}}}`,
+		// Past the last page, e.g. as the index shrunk.
+		`{"hits": {"total": {"value": 9}}, "aggregations": {"hosts": {"buckets": []}}}`,
+		`{"hits": {"total": {"value": 9}}, "aggregations": {"hosts": {"after_key": {"host": "b"}, "buckets": [
+  {"key": {"host": "a"}, "doc_count": 2}, {"key": {"host": "b"}, "doc_count": 3}
+]}}}`,
+	}
+	var scrape int
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(responses[scrape])(w, r)
+	})
+	client := server.esClient(t)
+
+	wantAfter := []string{"", `"after":{"host":"b"}`, `"after":{"host":"c"}`, ""}
+	for ; scrape < len(responses); scrape++ {
+		lines := formatMetrics(collectMetrics(func(ch chan<- Metric) {
+			c.Collect(context.Background(), client, ch)
+		}))
+		if scrape == 1 {
+			assertLines(t, linesOf(lines, "hosts"), `hosts{host="c"} 4`, `hosts 9`)
+		}
+
+		body := server.Requests()[scrape].Body
+		if wantAfter[scrape] == "" && strings.Contains(body, `"after"`) {
+			t.Errorf("scrape %d: got request body %s, want no after key", scrape, body)
+		} else if !strings.Contains(body, wantAfter[scrape]) {
+			t.Errorf("scrape %d: got request body %s, want %s", scrape, body, wantAfter[scrape])
+		}
+	}
+}
+
+const compositeCollector = `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: requests
+        type: composite
+        size: 2
+        max_pages: %d
+        sources:
+          - name: host
+            field: host
+          - name: status
+            field: status
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host and status.
+    query_ref: requests
+    aggregation_ref: requests
+`
+
+func TestQueryCompositePages(t *testing.T) {
+	pages := []string{
+		`{"hits": {"total": {"value": 10}}, "aggregations": {"requests": {"after_key": {"host": "a", "status": "500"}, "buckets": [
+  {"key": {"host": "a", "status": "200"}, "doc_count": 5}, {"key": {"host": "a", "status": "500"}, "doc_count": 1}
+]}}}`,
+		`{"hits": {"total": {"value": 10}}, "aggregations": {"requests": {"after_key": {"host": "b", "status": "200"}, "buckets": [
+  {"key": {"host": "b", "status": "200"}, "doc_count": 4}
+]}}}`,
+		`{"hits": {"total": {"value": 10}}, "aggregations": {"requests": {"buckets": []}}}`,
+	}
+	for _, tc := range []struct {
+		maxPages int
+		requests int
+		want     []string
+	}{
+		{0, 3, []string{
+			`requests{host="a",status="200"} 5`, `requests{host="a",status="500"} 1`, `requests{host="b",status="200"} 4`,
+			`requests 10`,
+		}},
+		{1, 1, []string{`requests{host="a",status="200"} 5`, `requests{host="a",status="500"} 1`, `requests 10`}},
+	} {
+		t.Run(fmt.Sprint(tc.maxPages), func(t *testing.T) {
+			var page int32
+			server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				respondJSON(pages[atomic.AddInt32(&page, 1)-1])(w, r)
+			})
+			c := mustCollector(t, fmt.Sprintf(compositeCollector, tc.maxPages), mustGlobalConfig(t, ""))
+			lines := formatMetrics(collectMetrics(func(ch chan<- Metric) {
+				c.Collect(context.Background(), server.esClient(t), ch)
+			}))
+			assertSortedLines(t, linesOf(lines, "requests"), tc.want...)
+			assertLines(t, errorLines(lines))
+
+			requests := server.Requests()
+			if len(requests) != tc.requests {
+				t.Fatalf("got %d requests, want %d", len(requests), tc.requests)
+			}
+			if strings.Contains(requests[0].Body, `"after"`) {
+				t.Errorf("got first request body %s, want no after key", requests[0].Body)
+			}
+			for i, after := range []string{`"after":{"host":"a","status":"500"}`, `"after":{"host":"b","status":"200"}`} {
+				if i+1 < len(requests) && !strings.Contains(requests[i+1].Body, after) {
+					t.Errorf("got request %d body %s, want %s", i+1, requests[i+1].Body, after)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryNodeHeader(t *testing.T) {
+	text := strings.Replace(hitsCollector, `query: "*"`, `query: "*"
+    node_header: X-Found-Handling-Instance`, 1)
+	c := mustCollector(t, text, mustGlobalConfig(t, ""))
+
+	for _, tc := range []struct {
+		node, want string
+	}{
+		{"instance-0000000001", `hits{node="instance-0000000001"} 1`},
+		{"", `hits{node="unknown"} 1`},
+	} {
+		transport := &recordingTransport{handler: func(w http.ResponseWriter, r *http.Request) {
+			if tc.node != "" {
+				w.Header().Set("X-Found-Handling-Instance", tc.node)
+			}
+			respondJSON(`{"hits": {"total": {"value": 1}}}`)(w, r)
+		}}
+		client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{"http://es:9200"}, Transport: transport})
+		if err != nil {
+			t.Fatalf("NewClient: %s", err)
+		}
+		lines := formatMetrics(collectMetrics(func(ch chan<- Metric) {
+			c.Collect(context.Background(), client, ch)
+		}))
+		assertLines(t, linesOf(lines, "hits"), tc.want)
+	}
+}
+
+func TestQueryAggregationStrictness(t *testing.T) {
+	const collector = `
+collector_name: test
+queries:
+  - query_name: hosts
+    query: "*"
+    on_unexpected_aggregation: %s
+    on_missing_aggregation: %s
+    aggregations:
+      - name: host
+        type: terms
+        field: host
+metrics:
+  - metric_name: hosts
+    type: gauge
+    help: Hits by host.
+    query_ref: hosts
+    aggregation_ref: host
+`
+	const (
+		extra   = `{"hits": {"total": {"value": 1}}, "aggregations": {"host": {"buckets": []}, "extra": {"value": 1}}}`
+		missing = `{"hits": {"total": {"value": 1}}, "aggregations": {}}`
+	)
+	for _, tc := range []struct {
+		onUnexpected, onMissing, response string
+		wantErrors                        []string
+		wantUnexpected, wantMissing       float64
+	}{
+		{"warn", "error", extra, nil, 1, 0},
+		{"warn", "error", missing, []string{`error: [test, collector="test", query="hosts"] aggregation host missing in response`}, 0, 1},
+		{"error", "warn", extra, []string{`error: [test, collector="test", query="hosts"] aggregation extra unexpected in response`}, 1, 0},
+		{"error", "warn", missing, nil, 0, 1},
+		{"ignore", "ignore", extra, nil, 0, 0},
+	} {
+		unexpectedBefore := testutil.ToFloat64(aggregationMismatches.WithLabelValues("unexpected"))
+		missingBefore := testutil.ToFloat64(aggregationMismatches.WithLabelValues("missing"))
+
+		lines, _ := runCollector(t, fmt.Sprintf(collector, tc.onUnexpected, tc.onMissing), nil, respondJSON(tc.response))
+		assertLines(t, errorLines(lines), tc.wantErrors...)
+		if got := testutil.ToFloat64(aggregationMismatches.WithLabelValues("unexpected")) - unexpectedBefore; got != tc.wantUnexpected {
+			t.Errorf("unexpected %s, missing %s: got %g unexpected aggregations, want %g", tc.onUnexpected, tc.onMissing, got, tc.wantUnexpected)
+		}
+		if got := testutil.ToFloat64(aggregationMismatches.WithLabelValues("missing")) - missingBefore; got != tc.wantMissing {
+			t.Errorf("unexpected %s, missing %s: got %g missing aggregations, want %g", tc.onUnexpected, tc.onMissing, got, tc.wantMissing)
+		}
+	}
+}
+
+func TestQueryPercentilesHistogram(t *testing.T) {
+	const collector = `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: latency_percentiles
+        type: percentiles
+        field: latency
+        percents: [50, 90, 99]
+metrics:
+  - metric_name: latency_seconds
+    type: histogram
+    help: Request latency.
+    query_ref: requests
+    aggregation_ref: latency_percentiles
+`
+	lines, _ := runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 200}},
+  "aggregations": {"latency_percentiles": {"values": {"50.0": 0.2, "90.0": 0.8, "99.0": 1.5}}}
+}`))
+	assertLines(t, errorLines(lines))
+	assertLines(t, linesOf(lines, "latency_seconds"), `latency_seconds histogram count=200 buckets=0.2:100,0.8:180,1.5:198`)
+
+	// Approximate percentiles may decrease, buckets don't.
+	lines, _ = runCollector(t, collector, nil, respondJSON(`{
+  "hits": {"total": {"value": 200}},
+  "aggregations": {"latency_percentiles": {"values": {"50.0": 0.2, "90.0": 0.15, "99.0": 1.5}}}
+}`))
+	assertLines(t, linesOf(lines, "latency_seconds"), `latency_seconds histogram count=200 buckets=0.2:180,1.5:198`)
+}
+
+func TestQueryBucketHistogram(t *testing.T) {
+	lines, _ := runCollector(t, `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: size
+        type: histogram
+        field: size
+        interval: 100
+metrics:
+  - metric_name: response_size_bytes
+    type: histogram
+    help: Response size.
+    query_ref: requests
+    aggregation_ref: size
+`, nil, respondJSON(`{
+  "hits": {"total": {"value": 10}},
+  "aggregations": {"size": {"buckets": [
+    {"key": 0, "doc_count": 1}, {"key": 100, "doc_count": 4}, {"key": 200, "doc_count": 0},
+    {"key": 300, "doc_count": 2}, {"key": 400, "doc_count": 3}
+  ]}}
+}`))
+	assertLines(t, errorLines(lines))
+	// Each bucket's upper bound holds the doc counts of all buckets up to it.
+	assertLines(t, linesOf(lines, "response_size_bytes"),
+		`response_size_bytes histogram count=10 buckets=100:1,200:5,300:5,400:7,500:10`)
+}
+
+func TestQueryTotalRelationLabel(t *testing.T) {
+	text := strings.Replace(hitsCollector, "track_total: true", "track_total: true\n    total_relation_label: true", 1)
+	for _, tc := range []struct {
+		response, want string
+	}{
+		{`{"hits": {"total": {"value": 10000, "relation": "gte"}}}`, `hits{relation="gte"} 10000`},
+		{`{"hits": {"total": {"value": 12, "relation": "eq"}}}`, `hits{relation="eq"} 12`},
+		{`{"hits": {"total": {"value": 12}}}`, `hits{relation="unknown"} 12`},
+	} {
+		lines, _ := runCollector(t, text, nil, respondJSON(tc.response))
+		assertLines(t, linesOf(lines, "hits"), tc.want)
+	}
+
+	lines, _ := runCollector(t, hitsCollector, nil, respondJSON(`{"hits": {"total": {"value": 10000, "relation": "gte"}}}`))
+	assertLines(t, linesOf(lines, "hits"), `hits 10000`)
+}
+
+func TestQuerySubAggregations(t *testing.T) {
+	lines, _ := runCollector(t, `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: host
+        type: terms
+        field: host
+        aggregations:
+          - name: status
+            type: terms
+            field: status
+            aggregations:
+              - name: latency
+                type: avg
+                field: latency
+metrics:
+  - metric_name: requests
+    type: gauge
+    help: Requests by host and status.
+    query_ref: requests
+    aggregation_ref: status
+  - metric_name: latency
+    type: gauge
+    help: Average latency by host and status.
+    query_ref: requests
+    aggregation_ref: latency
+`, nil, respondJSON(`{
+  "hits": {"total": {"value": 13}},
+  "aggregations": {"host": {"buckets": [
+    {"key": "a", "doc_count": 12, "status": {"buckets": [
+      {"key": "200", "doc_count": 10, "latency": {"value": 3.2}},
+      {"key": "500", "doc_count": 2, "latency": {"value": 7.5}}
+    ]}},
+    {"key": "b", "doc_count": 1, "status": {"buckets": [
+      {"key": "200", "doc_count": 1, "latency": {"value": 1}}
+    ]}}
+  ]}}
+}`))
+	assertLines(t, errorLines(lines))
+	assertLines(t, linesOf(lines, "latency"),
+		`latency{host="a",status="200"} 3.2`,
+		`latency{host="a",status="500"} 7.5`,
+		`latency{host="b",status="200"} 1`,
+		`latency 13`)
+	assertLines(t, linesOf(lines, "requests"),
+		`requests{host="a",status="200"} 10`,
+		`requests{host="a",status="500"} 2`,
+		`requests{host="b",status="200"} 1`,
+		`requests 13`)
+}
+
+func TestQueryPipelineAggregations(t *testing.T) {
+	lines, server := runCollector(t, `
+collector_name: test
+queries:
+  - query_name: requests
+    query: "*"
+    aggregations:
+      - name: hour
+        type: date_histogram
+        field: "@timestamp"
+        fixed_interval: 1h
+        aggregations:
+          - name: errors
+            type: sum
+            field: errors
+          - name: growth
+            type: derivative
+            buckets_path: _count
+          - name: error_ratio
+            type: bucket_script
+            buckets_path_vars:
+              errors: errors
+              total: _count
+            script: params.errors / params.total
+metrics:
+  - metric_name: requests_growth
+    type: gauge
+    help: Growth of requests per hour.
+    query_ref: requests
+    aggregation_ref: growth
+  - metric_name: error_ratio
+    type: gauge
+    help: Ratio of errors per hour.
+    query_ref: requests
+    aggregation_ref: error_ratio
+`, nil, respondJSON(`{
+  "hits": {"total": {"value": 30}},
+  "aggregations": {"hour": {"buckets": [
+    {"key_as_string": "10:00", "key": 1, "doc_count": 10, "errors": {"value": 1}, "error_ratio": {"value": 0.1}},
+    {"key_as_string": "11:00", "key": 2, "doc_count": 20, "errors": {"value": 5}, "growth": {"value": 10},
+      "error_ratio": {"value": 0.25}}
+  ]}}
+}`))
+	assertLines(t, errorLines(lines))
+	// The first bucket has no derivative, rather than a 0 one.
+	assertLines(t, linesOf(lines, "requests_growth"), `requests_growth{hour="11:00"} 10`, `requests_growth 30`)
+	assertLines(t, linesOf(lines, "error_ratio"), `error_ratio{hour="10:00"} 0.1`, `error_ratio{hour="11:00"} 0.25`, `error_ratio 30`)
+
+	body := server.Requests()[0].Body
+	for _, want := range []string{
+		`"growth":{"derivative":{"buckets_path":"_count"}}`,
+		`"script":"params.errors / params.total"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("got request body %s, want %s", body, want)
+		}
+	}
+}
+
+func TestQueryAuthError(t *testing.T) {
+	lines, _ := runCollector(t, hitsCollector, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="proxy"`)
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "<html><body>Unauthorized</body></html>")
+	})
+	assertLines(t, errorLines(lines), `error: [test, collector="test", query="hits"] authentication failed with status code 401, `+
+		`challenge "Basic realm=\"proxy\"": check the credentials`)
+}
+
+func TestStatusError(t *testing.T) {
+	for _, tc := range []struct {
+		code   int
+		header http.Header
+		body   string
+		want   string
+	}{
+		{http.StatusUnauthorized, nil, "", "authentication failed with status code 401: check the credentials"},
+		{http.StatusForbidden, nil, "<html></html>", "access denied with status code 403: check the privileges of the user or API key"},
+		{http.StatusFound, http.Header{"Location": {"https://sso.example.com/login"}}, "<html></html>",
+			`unexpected redirect with status code 302 to "https://sso.example.com/login": check the target URL`},
+		{http.StatusBadRequest, nil, `{"error": {"type": "parsing_exception", "reason": "unknown query [foo]"}}`,
+			"request failed with status code 400, parsing_exception: unknown query [foo]"},
+		{http.StatusInternalServerError, nil, strings.Repeat("x", 300),
+			"request failed with status code 500: " + strings.Repeat("x", 200) + "..."},
+		{http.StatusBadGateway, nil, "", "request failed with status code 502"},
+	} {
+		err := statusError(&esapi.Response{
+			StatusCode: tc.code,
+			Header:     tc.header,
+			Body:       ioutil.NopCloser(strings.NewReader(tc.body)),
+		})
+		if err.Error() != tc.want {
+			t.Errorf("status %d: got error %q, want %q", tc.code, err, tc.want)
+		}
+	}
+}
@@ -4,25 +4,42 @@ import (
 	"context"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	log "github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"github.com/tidwall/gjson"
 	"iss.digital/mt/elastic_exporter/config"
 	"iss.digital/mt/elastic_exporter/errors"
 )
 
 const (
-	// Capacity for the channel to collect metrics.
-	capMetricChan = 1000
-
-	upMetricName       = "up"
-	upMetricHelp       = "1 if the target is reachable, or 0 if the scrape failed"
-	scrapeDurationName = "scrape_duration_seconds"
-	scrapeDurationHelp = "How long it took to scrape the target in seconds"
+	upMetricName         = "up"
+	upMetricHelp         = "1 if the target is reachable, or 0 if the scrape failed"
+	scrapeDurationName   = "scrape_duration_seconds"
+	scrapeDurationHelp   = "How long it took to scrape the target in seconds"
+	collectorsFailedName = "collectors_failed"
+	collectorsFailedHelp = "Number of collectors that failed to collect some of their metrics during the scrape"
+	clusterStatusName    = "cluster_status"
+	clusterStatusHelp    = "1 for the current cluster health status of the target, 0 for the others"
+	clusterInfoName      = "cluster_info"
+	clusterInfoHelp      = "Always 1, labeled with the target's cluster name and ElasticSearch version"
+	inFlightName         = "scrapes_in_flight"
+	dataSourceLabel      = "data_source"
+	inFlightHelp         = "Number of scrapes of the target running concurrently, this one included"
+	scrapeResultName     = "scrape_result"
+	scrapeResultHelp     = "1 for the result of the scrape, success if the target was up and all collectors succeeded, 0 for the other"
 )
 
 // Target collects ElasticSearch metrics from a single target. It aggregates one or more Collectors and it looks much
@@ -30,29 +47,44 @@ const (
 type Target interface {
 	// Collect is the equivalent of prometheus.Collector.Collect(), but takes a context to run in.
 	Collect(ctx context.Context, ch chan<- Metric)
+	// Warmup establishes the connection to the target and checks whether it's up ahead of the first scrape.
+	Warmup(ctx context.Context) errors.WithContext
 }
 
 // target implements Target. It wraps a elasticsearch.Client, which is initially nil but never changes once instantianted.
 type target struct {
-	name               string
-	dsn                string
-	username           string
-	password           string
-	collectors         []Collector
-	constLabels        prometheus.Labels
-	globalConfig       *config.GlobalConfig
-	upDesc             MetricDesc
-	scrapeDurationDesc MetricDesc
-	logContext         string
+	name                 string
+	dataSource           *config.DataSourceConfig
+	apiKeyFile           *apiKeyFile
+	collectors           []Collector
+	constLabels          prometheus.Labels
+	globalConfig         *config.GlobalConfig
+	upDesc               MetricDesc
+	scrapeDurationDesc   MetricDesc
+	collectorsFailedDesc MetricDesc
+	clusterStatusDesc    MetricDesc
+	clusterInfoDesc      MetricDesc
+	clusterInfo          *clusterInfoCache
+	userAgent            string
+	transport            http.RoundTripper // base transport of the client, with the data source's TLS settings
+	healthIndices        []string          // indices the health check is restricted to, all if empty
+	inFlightDesc         MetricDesc
+	scrapeResultDesc     MetricDesc
+	inFlight             int32 // number of Collect calls in progress, accessed atomically
+	logContext           string
+
+	mu           sync.Mutex    // guards activeURL, client and clientAPIKey
+	activeURL    config.Secret // the URL of the data source the client is connected to
+	clientAPIKey string        // the API key the client authenticates with
 
 	client *elasticsearch.Client
 }
 
-// NewTarget returns a new Target with the given instance name, data source name, collectors and constant filters.
+// NewTarget returns a new Target with the given instance name, data source, collectors and constant filters.
 // An empty target name means the exporter is running in single target mode: no synthetic metrics will be exported.
 func NewTarget(
-	logContext, name, dsn, username, password string, ccs []*config.CollectorConfig, constLabels prometheus.Labels, gc *config.GlobalConfig) (
-	Target, errors.WithContext) {
+	logContext, name string, dsc *config.DataSourceConfig, ccs []*config.CollectorConfig, constLabels prometheus.Labels,
+	gc *config.GlobalConfig) (Target, errors.WithContext) {
 
 	if name != "" {
 		logContext = fmt.Sprintf("%s, target=%q", logContext, name)
@@ -69,28 +101,74 @@ func NewTarget(
 
 	collectors := make([]Collector, 0, len(ccs))
 	for _, cc := range ccs {
-		c, err := NewCollector(logContext, cc, constLabelPairs)
+		c, err := NewCollector(logContext, cc, constLabelPairs, gc)
 		if err != nil {
 			return nil, err
 		}
 		collectors = append(collectors, c)
 	}
 
-	upDesc := NewAutomaticMetricDesc(logContext, upMetricName, upMetricHelp, prometheus.GaugeValue, constLabelPairs)
+	var upLabels []string
+	if len(dsc.FallbackURLs) > 0 {
+		// Only labeled with the active data source if there's more than one, so the series don't change otherwise.
+		upLabels = append(upLabels, dataSourceLabel)
+	}
+	upDesc := NewAutomaticMetricDesc(logContext, gc.MetricPrefix+upMetricName, upMetricHelp, prometheus.GaugeValue, constLabelPairs, upLabels...)
 	scrapeDurationDesc :=
-		NewAutomaticMetricDesc(logContext, scrapeDurationName, scrapeDurationHelp, prometheus.GaugeValue, constLabelPairs)
+		NewAutomaticMetricDesc(logContext, gc.MetricPrefix+scrapeDurationName, scrapeDurationHelp, prometheus.GaugeValue, constLabelPairs)
+	collectorsFailedDesc :=
+		NewAutomaticMetricDesc(logContext, gc.MetricPrefix+collectorsFailedName, collectorsFailedHelp, prometheus.GaugeValue, constLabelPairs)
+	clusterStatusDesc :=
+		NewAutomaticMetricDesc(logContext, gc.MetricPrefix+clusterStatusName, clusterStatusHelp, prometheus.GaugeValue, constLabelPairs, "status")
+	clusterInfoDesc := NewAutomaticMetricDesc(
+		logContext, gc.MetricPrefix+clusterInfoName, clusterInfoHelp, prometheus.GaugeValue, constLabelPairs, "cluster_name", "version")
+
+	inFlightDesc := NewAutomaticMetricDesc(logContext, gc.MetricPrefix+inFlightName, inFlightHelp, prometheus.GaugeValue, constLabelPairs)
+	scrapeResultDesc := NewAutomaticMetricDesc(
+		logContext, gc.MetricPrefix+scrapeResultName, scrapeResultHelp, prometheus.GaugeValue, constLabelPairs, "status")
+
+	userAgent, err := renderLabelTemplate("user_agent", gc.UserAgent, map[string]string{
+		"target":  name,
+		"version": version.Version,
+	})
+	if err != nil {
+		return nil, errors.Wrap(logContext, err)
+	}
+
+	transport, err := newHTTPTransport(gc, dsc)
+	if err != nil {
+		return nil, errors.Wrap(logContext, err)
+	}
+
+	var healthIndices []string
+	if gc.HealthScope == "indices" {
+		if healthIndices = queriedIndices(ccs); healthIndices == nil {
+			log.V(1).Infof("[%s] Some queries run against all indices, checking the health of the whole cluster", logContext)
+		}
+	}
 
 	t := target{
-		name:               name,
-		dsn:                dsn,
-		username:           username,
-		password:           password,
-		collectors:         collectors,
-		constLabels:        constLabels,
-		globalConfig:       gc,
-		upDesc:             upDesc,
-		scrapeDurationDesc: scrapeDurationDesc,
-		logContext:         logContext,
+		name:                 name,
+		dataSource:           dsc,
+		collectors:           collectors,
+		constLabels:          constLabels,
+		globalConfig:         gc,
+		upDesc:               upDesc,
+		scrapeDurationDesc:   scrapeDurationDesc,
+		collectorsFailedDesc: collectorsFailedDesc,
+		clusterStatusDesc:    clusterStatusDesc,
+		clusterInfoDesc:      clusterInfoDesc,
+		clusterInfo:          newClusterInfoCache(time.Duration(gc.InfoTTL)),
+		userAgent:            userAgent,
+		transport:            transport,
+		healthIndices:        healthIndices,
+		inFlightDesc:         inFlightDesc,
+		scrapeResultDesc:     scrapeResultDesc,
+		logContext:           logContext,
+		activeURL:            dsc.URL,
+	}
+	if dsc.APIKeyFile != "" {
+		t.apiKeyFile = newAPIKeyFile(dsc.APIKeyFile)
 	}
 
 	return &t, nil
@@ -101,73 +179,358 @@ func (t *target) Collect(ctx context.Context, ch chan<- Metric) {
 	var (
 		scrapeStart = time.Now()
 		targetUp    = true
+		inFlight    = atomic.AddInt32(&t.inFlight, 1)
 	)
+	defer atomic.AddInt32(&t.inFlight, -1)
+	if t.name != "" {
+		// Anything above 1 means scrapes overlap, i.e. the target is slower than the scrape interval.
+		send(ctx, ch, NewMetric(t.inFlightDesc, float64(inFlight)))
+	}
 
-	err := t.ensureUp(ctx)
+	// All queries of the scrape share the retry budget.
+	ctx = withRetryBudget(ctx, t.globalConfig.RetryBudget)
+
+	status, err := t.ensureUp(ctx)
 	if err != nil {
-		ch <- NewInvalidMetric(errors.Wrap(t.logContext, err))
+		send(ctx, ch, NewInvalidMetric(errors.Wrap(t.logContext, err)))
 		targetUp = false
 	}
+	client, activeURL := t.activeClient()
 	if t.name != "" {
 		// Export the target's `up` metric as early as we know what it should be.
-		ch <- NewMetric(t.upDesc, boolToFloat64(targetUp))
+		var upLabels []*labelPair
+		if len(t.dataSource.FallbackURLs) > 0 {
+			upLabels = append(upLabels, &labelPair{key: dataSourceLabel, value: redactURL(string(activeURL))})
+		}
+		send(ctx, ch, NewMetric(t.upDesc, boolToFloat64(targetUp), upLabels...))
+		if status != "" {
+			for _, s := range config.ClusterStatuses {
+				send(ctx, ch, NewMetric(t.clusterStatusDesc, boolToFloat64(s == status), &labelPair{key: "status", value: string(s)}))
+			}
+		}
+		if targetUp {
+			if info, err := t.clusterInfo.Get(ctx, client); err != nil {
+				log.Warningf("[%s] Failed to get cluster info: %s", t.logContext, err)
+			} else {
+				send(ctx, ch, NewMetric(t.clusterInfoDesc, 1,
+					&labelPair{key: "cluster_name", value: info.clusterName}, &labelPair{key: "version", value: info.version}))
+			}
+		}
 	}
 
-	var wg sync.WaitGroup
+	var (
+		wg               sync.WaitGroup
+		collectorsFailed int32
+	)
 	// Don't bother with the collectors if target is down.
 	if targetUp {
 		wg.Add(len(t.collectors))
 		for _, c := range t.collectors {
 			go func(collector Collector) {
 				defer wg.Done()
-				collector.Collect(ctx, t.client, ch)
+				if !t.collect(ctx, client, collector, ch) {
+					atomic.AddInt32(&collectorsFailed, 1)
+				}
 			}(c)
 		}
 	}
 	// Wait for all collectors (if any) to complete.
 	wg.Wait()
 
+	if t.name != "" && targetUp {
+		send(ctx, ch, NewMetric(t.collectorsFailedDesc, float64(collectorsFailed)))
+	}
+	if t.name != "" && t.globalConfig.ScrapeResult {
+		success := targetUp && collectorsFailed == 0
+		send(ctx, ch, NewMetric(t.scrapeResultDesc, boolToFloat64(success), &labelPair{key: "status", value: "success"}))
+		send(ctx, ch, NewMetric(t.scrapeResultDesc, boolToFloat64(!success), &labelPair{key: "status", value: "failure"}))
+	}
 	if t.name != "" {
 		// And export a `scrape duration` metric once we're done scraping.
-		ch <- NewMetric(t.scrapeDurationDesc, float64(time.Since(scrapeStart))*1e-9)
+		send(ctx, ch, NewMetric(t.scrapeDurationDesc, float64(time.Since(scrapeStart))*1e-9))
 	}
 }
 
-func (t *target) ensureUp(ctx context.Context) errors.WithContext {
-	if t.client == nil {
-		cfg := elasticsearch.Config{
-			Addresses: []string{
-				t.dsn,
-			},
-			Username: t.username,
-			Password: t.password,
+// Warmup implements Target.
+func (t *target) Warmup(ctx context.Context) errors.WithContext {
+	_, err := t.ensureUp(ctx)
+	return err
+}
+
+// collect runs the collector and forwards the metrics it produces to ch. It returns false if any of them is invalid,
+// i.e. the collector failed to collect some of its metrics.
+func (t *target) collect(ctx context.Context, client *elasticsearch.Client, collector Collector, ch chan<- Metric) bool {
+	collectorChan := make(chan Metric, t.globalConfig.MetricChanCap)
+	go func() {
+		collector.Collect(ctx, client, collectorChan)
+		close(collectorChan)
+	}()
+
+	// Keep draining collectorChan even once ctx is done and metrics are dropped, so the collector can always complete.
+	ok := true
+	for metric := range collectorChan {
+		if _, invalid := metric.(invalidMetric); invalid {
+			ok = false
 		}
-		client, err := elasticsearch.NewClient(cfg)
+		send(ctx, ch, metric)
+	}
+	return ok
+}
+
+// activeClient returns the client along with the URL of the data source it's connected to.
+func (t *target) activeClient() (*elasticsearch.Client, config.Secret) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.client, t.activeURL
+}
+
+// ensureUp checks the cluster health, creating a client first if needed. It returns the cluster health status, if
+// known, and an error if the target is not to be considered up. If the active data source is down, it fails over to the
+// others in configured order, the URL first. Health checks run without t.mu held, so that a hung one doesn't hold up
+// other scrapes of the target: only the client they end up with is swapped in.
+func (t *target) ensureUp(ctx context.Context) (config.ClusterStatus, errors.WithContext) {
+	apiKey := string(t.dataSource.APIKey)
+	if t.apiKeyFile != nil {
+		key, changed, err := t.apiKeyFile.Get()
 		if err != nil {
-			if err != ctx.Err() {
-				return errors.Wrap(t.logContext, err)
+			return "", errors.Wrapf(t.logContext, err, "failed to read API key")
+		}
+		if changed {
+			// Credentials are fixed at client creation, so the client has to be recreated to pick up the new key.
+			log.Infof("[%s] API key changed, recreating client", t.logContext)
+		}
+		apiKey = key
+	}
+
+	if t.dataSource.CloudID != "" {
+		// Elastic Cloud resolves the deployment's endpoint, there's nothing to fail over to.
+		return t.checkUp(ctx, "", apiKey, nil)
+	}
+	var (
+		status config.ClusterStatus
+		err    errors.WithContext
+	)
+	for _, u := range t.dataSourceURLs() {
+		status, err = t.checkUp(ctx, u, apiKey, err)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return status, err
+}
+
+// queriedIndices returns the indices (or patterns) queried by the metrics of the given collectors, nil if any query runs
+// against all indices or against an index window, whose indices change over time. Queries no metric references are
+// never run, so they don't count.
+func queriedIndices(ccs []*config.CollectorConfig) []string {
+	var indices []string
+	seen := make(map[string]bool)
+	queries := make(map[*config.QueryConfig]bool)
+	for _, cc := range ccs {
+		for _, mc := range cc.Metrics {
+			qc := mc.Query()
+			if queries[qc] {
+				continue
+			}
+			queries[qc] = true
+			if len(qc.Indices()) == 0 {
+				return nil
 			}
-			// if err == ctx.Err() fall through
-		} else {
-			t.client = client
+			for _, index := range qc.Indices() {
+				if !seen[index] {
+					seen[index] = true
+					indices = append(indices, index)
+				}
+			}
+		}
+	}
+	return indices
+}
+
+// dataSourceURLs returns the URLs of the target's data source in the order to try them: the active one first, then the
+// URL and fallback URLs in configured order.
+func (t *target) dataSourceURLs() []config.Secret {
+	t.mu.Lock()
+	activeURL := t.activeURL
+	t.mu.Unlock()
+
+	urls := make([]config.Secret, 0, 1+len(t.dataSource.FallbackURLs))
+	if activeURL != "" {
+		urls = append(urls, activeURL)
+	}
+	for _, u := range append([]config.Secret{t.dataSource.URL}, t.dataSource.FallbackURLs...) {
+		if u != activeURL {
+			urls = append(urls, u)
 		}
 	}
+	return urls
+}
 
-	// If we have a handle and the context is not closed, test whether the cluster is up.
-	if t.client != nil && ctx.Err() == nil {
-		var err error
+// checkUp checks the cluster health through the data source URL u (empty for the Cloud ID), with the active client if
+// connected to u with apiKey or else a new one. If the cluster is up the client becomes the active one, failing over
+// from the previously active URL (if any) because of cause.
+func (t *target) checkUp(ctx context.Context, u config.Secret, apiKey string, cause error) (config.ClusterStatus, errors.WithContext) {
+	t.mu.Lock()
+	client := t.client
+	if u != t.activeURL || apiKey != t.clientAPIKey {
+		client = nil
+	}
+	t.mu.Unlock()
 
-		health, err := t.client.Cluster.Health()
+	if client == nil {
+		var err errors.WithContext
+		if client, err = t.newClient(u, apiKey); err != nil {
+			return "", err
+		}
+	}
+
+	status, err := t.checkHealth(ctx, client)
+	if err != nil {
+		return status, err
+	}
 
-		if err != nil || health.IsError() {
-			return errors.Wrap(t.logContext, err)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u != t.activeURL && t.activeURL != "" {
+		log.Warningf("[%s] Failed over from %s to %s: %s", t.logContext, redactURL(string(t.activeURL)), redactURL(string(u)), cause)
+	}
+	if client != t.client {
+		t.clusterInfo.Reset()
+	}
+	t.activeURL, t.client, t.clientAPIKey = u, client, apiKey
+	return status, nil
+}
+
+// newClient creates a client connected to the data source URL u, or the Cloud ID if u is empty.
+func (t *target) newClient(u config.Secret, apiKey string) (*elasticsearch.Client, errors.WithContext) {
+	cfg := elasticsearch.Config{
+		Username:     string(t.dataSource.Username),
+		Password:     string(t.dataSource.Password),
+		APIKey:       apiKey,
+		ServiceToken: string(t.dataSource.ServiceToken),
+	}
+	if len(t.dataSource.Headers) > 0 {
+		cfg.Header = make(http.Header, len(t.dataSource.Headers))
+		for name, value := range t.dataSource.Headers {
+			cfg.Header.Set(name, value)
 		}
 	}
+	if t.dataSource.CloudID != "" {
+		cfg.CloudID = string(t.dataSource.CloudID)
+	} else {
+		// The client balances requests across the nodes, retrying failed ones on the others.
+		cfg.Addresses = config.SplitURLs(u)
+	}
+	transport := t.transport
+	if t.globalConfig.CompressRequestBody {
+		transport = newCompressionTransport(t.globalConfig.CompressionLevel, transport)
+	}
+	if t.userAgent != "" {
+		transport = newUserAgentTransport(t.userAgent, transport)
+	}
+	cfg.Transport = transport
+	client, err := elasticsearch.NewClient(cfg)
+	if err != nil {
+		return nil, errors.Wrap(t.logContext, err)
+	}
+	return client, nil
+}
+
+// checkHealth checks the cluster health through client. It returns the cluster health status, if known, and an error
+// if the target is not to be considered up.
+func (t *target) checkHealth(ctx context.Context, client *elasticsearch.Client) (config.ClusterStatus, errors.WithContext) {
+	if ctx.Err() != nil {
+		return "", errors.Wrap(t.logContext, ctx.Err())
+	}
 
+	// A hung health check fails fast rather than use up the whole scrape timeout.
+	healthCtx := ctx
+	if timeout := time.Duration(t.globalConfig.HealthTimeout); timeout > 0 {
+		var cancel context.CancelFunc
+		healthCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	clusterHealth := client.Cluster.Health
+	opts := []func(*esapi.ClusterHealthRequest){clusterHealth.WithContext(healthCtx)}
+	if waitFor := t.globalConfig.HealthWaitForStatus(); waitFor != "" {
+		// Have ElasticSearch give up waiting (and respond) before the request times out. Configuration ensures there
+		// is a health_timeout.
+		opts = append(opts, clusterHealth.WithWaitForStatus(string(waitFor)),
+			clusterHealth.WithTimeout(time.Duration(t.globalConfig.HealthTimeout)*9/10))
+	}
+	if len(t.healthIndices) > 0 {
+		opts = append(opts, clusterHealth.WithIndex(t.healthIndices...))
+	}
+	if t.globalConfig.HealthLevel != "" {
+		opts = append(opts, clusterHealth.WithLevel(t.globalConfig.HealthLevel))
+	}
+	health, err := clusterHealth(opts...)
+	if health != nil && health.Body != nil {
+		defer health.Body.Close()
+	}
+
+	if err != nil && healthCtx.Err() != nil && ctx.Err() == nil {
+		return "", errors.Errorf(t.logContext, "cluster health check timed out after %s", t.globalConfig.HealthTimeout)
+	}
+	if err != nil {
+		return "", errors.Wrap(t.logContext, err)
+	}
+	body, err := ioutil.ReadAll(health.Body)
+	if err != nil {
+		return "", errors.Wrapf(t.logContext, err, "failed to read cluster health")
+	}
+	status := config.ClusterStatus(gjson.GetBytes(body, "status").String())
+	if health.IsError() {
+		// ElasticSearch responds 408 if it gave up waiting for health_wait_for_status, with the current health
+		// nonetheless. Anything else (or a 408 without health, e.g. from a proxy) is a failure.
+		if health.StatusCode != http.StatusRequestTimeout || status == "" {
+			return "", t.healthError(health.StatusCode, body)
+		}
+		log.V(1).Infof("[%s] Cluster status is %s, timed out waiting for %s", t.logContext, status, t.globalConfig.HealthWaitForStatus())
+	}
+	if minStatus := t.globalConfig.MinClusterStatus(); !status.Satisfies(minStatus) {
+		return status, errors.Errorf(t.logContext, "cluster status is %s, expected at least %s", status, minStatus)
+	}
 	if ctx.Err() != nil {
-		return errors.Wrap(t.logContext, ctx.Err())
+		return status, errors.Wrap(t.logContext, ctx.Err())
+	}
+	return status, nil
+}
+
+// healthError returns an error describing a failed cluster health response, including (the start of) its body for
+// operators to see why.
+func (t *target) healthError(code int, body []byte) errors.WithContext {
+	if len(body) > errorBodyExcerpt {
+		body = append(body[:errorBodyExcerpt], "..."...)
+	}
+	return errors.Errorf(t.logContext, "cluster health check failed with status code %d: %s", code,
+		strings.TrimSpace(string(body)))
+}
+
+// redactURL returns the URL (or comma separated URLs) without user info, if any, for use in logs and labels.
+func redactURL(rawURL string) string {
+	nodes := config.SplitURLs(config.Secret(rawURL))
+	for i, node := range nodes {
+		u, err := url.Parse(node)
+		if err != nil {
+			nodes[i] = "<invalid URL>"
+			continue
+		}
+		u.User = nil
+		nodes[i] = u.String()
+	}
+	return strings.Join(nodes, ",")
+}
+
+// send forwards metric to ch, unless ctx is done first. It returns false if the metric was dropped, so that goroutines
+// never block on a channel nobody reads from anymore after a scrape was abandoned.
+func send(ctx context.Context, ch chan<- Metric, metric Metric) bool {
+	select {
+	case ch <- metric:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-	return nil
 }
 
 // boolToFloat64 converts a boolean flag to a float64 value (0.0 or 1.0).
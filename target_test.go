@@ -0,0 +1,544 @@
+package elastic_exporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/version"
+	"iss.digital/mt/elastic_exporter/config"
+)
+
+const greenHealth = `{"cluster_name": "test", "status": "green"}`
+
+// newTestTarget returns a named target connected to a fake ElasticSearch answering with handler, running the given
+// collectors.
+func newTestTarget(t *testing.T, gc *config.GlobalConfig, handler http.HandlerFunc, collectors ...string) (*target, *testServer) {
+	t.Helper()
+	server := newTestServer(t, handler)
+	return newTestTargetFor(t, gc, &config.DataSourceConfig{URL: config.Secret(server.URL)}, collectors...), server
+}
+
+// newTestTargetFor returns a named target for the given data source, running the given collectors.
+func newTestTargetFor(t *testing.T, gc *config.GlobalConfig, dsc *config.DataSourceConfig, collectors ...string) *target {
+	t.Helper()
+	if gc == nil {
+		gc = mustGlobalConfig(t, "")
+	}
+	ccs := make([]*config.CollectorConfig, 0, len(collectors))
+	for _, text := range collectors {
+		ccs = append(ccs, mustCollectorConfig(t, text))
+	}
+	tt, err := NewTarget("test", "es", dsc, ccs, nil, gc)
+	if err != nil {
+		t.Fatalf("NewTarget: %s", err)
+	}
+	return tt.(*target)
+}
+
+// collectTarget collects the target's metrics and returns them formatted.
+func collectTarget(ctx context.Context, tt Target) []string {
+	return formatMetrics(collectMetrics(func(ch chan<- Metric) {
+		tt.Collect(ctx, ch)
+	}))
+}
+
+func TestTargetWarmup(t *testing.T) {
+	tt, server := newTestTarget(t, nil, respondRoutes(map[string]string{"/_cluster/health": greenHealth}))
+	if client, _ := tt.activeClient(); client != nil {
+		t.Fatal("expected no client before warmup")
+	}
+
+	if err := tt.Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup: %s", err)
+	}
+	if client, _ := tt.activeClient(); client == nil {
+		t.Fatal("expected a client after warmup")
+	}
+	if requests := server.Requests(); len(requests) != 1 || requests[0].Path != "/_cluster/health" {
+		t.Errorf("expected a single health check, got %+v", requests)
+	}
+}
+
+func TestTargetWarmupFailure(t *testing.T) {
+	tt, _ := newTestTarget(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+
+	// Not fatal, the target is still scraped (and retried) as usual.
+	if err := tt.Warmup(context.Background()); err == nil {
+		t.Fatal("expected warmup to fail")
+	}
+	if client, _ := tt.activeClient(); client != nil {
+		t.Error("expected no client after failed warmup")
+	}
+}
+
+func TestTargetHealthTimeout(t *testing.T) {
+	gc := mustGlobalConfig(t, "health_timeout: 50ms")
+	tt, _ := newTestTarget(t, gc, func(w http.ResponseWriter, r *http.Request) {
+		// A hung health check.
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}, indexCollector("test", "logs"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	lines := collectTarget(ctx, tt)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("scrape took %s, want the health check to time out after 50ms", elapsed)
+	}
+	assertLines(t, linesOf(lines, "up"), `up 0`)
+	if errs := errorLines(lines); len(errs) != 1 || !strings.Contains(errs[0], "cluster health check timed out after 50ms") {
+		t.Errorf("got errors %q, want a health check timeout", errs)
+	}
+	if ctx.Err() != nil {
+		t.Error("expected the scrape context to be left alone")
+	}
+}
+
+// switchableHandler answers like handler while up, 500 otherwise.
+func switchableHandler(up *int32, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(up) == 0 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func TestTargetFailover(t *testing.T) {
+	var primaryUp, secondaryUp int32 = 0, 1
+	routes := respondRoutes(map[string]string{"/_cluster/health": greenHealth, "/_search": hitsResponse})
+	primary := newTestServer(t, switchableHandler(&primaryUp, routes))
+	secondary := newTestServer(t, switchableHandler(&secondaryUp, routes))
+	tt := newTestTargetFor(t, nil, &config.DataSourceConfig{
+		URL:          config.Secret(primary.URL),
+		FallbackURLs: []config.Secret{config.Secret(secondary.URL)},
+	}, indexCollector("test", "logs"))
+
+	lines := collectTarget(context.Background(), tt)
+	assertLines(t, linesOf(lines, "up"), `up{data_source="`+secondary.URL+`"} 1`)
+	assertLines(t, linesOf(lines, "test_hits"), `test_hits 42`)
+
+	// No failing back while the secondary is up.
+	atomic.StoreInt32(&primaryUp, 1)
+	lines = collectTarget(context.Background(), tt)
+	assertLines(t, linesOf(lines, "up"), `up{data_source="`+secondary.URL+`"} 1`)
+
+	atomic.StoreInt32(&secondaryUp, 0)
+	lines = collectTarget(context.Background(), tt)
+	assertLines(t, linesOf(lines, "up"), `up{data_source="`+primary.URL+`"} 1`)
+	assertLines(t, linesOf(lines, "test_hits"), `test_hits 42`)
+
+	// Both down, the last active one is reported.
+	atomic.StoreInt32(&primaryUp, 0)
+	lines = collectTarget(context.Background(), tt)
+	assertLines(t, linesOf(lines, "up"), `up{data_source="`+primary.URL+`"} 0`)
+}
+
+func TestTargetHealthCancelled(t *testing.T) {
+	tt, _ := newTestTarget(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := tt.ensureUp(ctx); err == nil {
+		t.Error("expected the health check to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("health check took %s, want it cancelled with the context after 50ms", elapsed)
+	}
+}
+
+func TestTargetHealthWaitForStatus(t *testing.T) {
+	gc := mustGlobalConfig(t, "health_timeout: 10s\nhealth_wait_for_status: green\nhealth_level: indices")
+	for _, tc := range []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+		up      string
+	}{
+		{"green", http.StatusOK, greenHealth, "", "up 1"},
+		// Timed out waiting, but the cluster is there nonetheless.
+		{"yellow", http.StatusRequestTimeout, `{"status": "yellow", "timed_out": true}`, "", "up 1"},
+		{"proxy timeout", http.StatusRequestTimeout, `timeout`, "408", "up 0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tt, server := newTestTarget(t, gc, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			})
+			lines := collectTarget(context.Background(), tt)
+			assertLines(t, linesOf(lines, "up"), tc.up)
+			if errs := errorLines(lines); tc.wantErr == "" && len(errs) > 0 ||
+				tc.wantErr != "" && (len(errs) != 1 || !strings.Contains(errs[0], tc.wantErr)) {
+				t.Errorf("got errors %q, want %q", errs, tc.wantErr)
+			}
+
+			query := server.Requests()[0].Query
+			if query.Get("wait_for_status") != "green" || query.Get("timeout") != "9000ms" || query.Get("level") != "indices" {
+				t.Errorf("got health check parameters %v", query)
+			}
+		})
+	}
+}
+
+func TestTargetHealthError(t *testing.T) {
+	for _, tc := range []struct {
+		body, want string
+	}{
+		{`{"error": "master_not_discovered_exception"}`,
+			`cluster health check failed with status code 503: {"error": "master_not_discovered_exception"}`},
+		// Large bodies are cut short.
+		{strings.Repeat("x", 2*errorBodyExcerpt),
+			"cluster health check failed with status code 503: " + strings.Repeat("x", errorBodyExcerpt) + "..."},
+	} {
+		tt, _ := newTestTarget(t, nil, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, tc.body, http.StatusServiceUnavailable)
+		})
+		_, err := tt.ensureUp(context.Background())
+		if err == nil || !strings.HasSuffix(err.Error(), tc.want) {
+			t.Errorf("got error %v, want %q", err, tc.want)
+		}
+	}
+}
+
+func TestTargetHealthScope(t *testing.T) {
+	gc := mustGlobalConfig(t, "min_cluster_status: yellow\nhealth_scope: indices")
+	handler := respondRoutes(map[string]string{
+		"/_cluster/health":              `{"status": "red"}`,
+		"/_cluster/health/logs,metrics": `{"status": "green"}`,
+		"/_search":                      hitsResponse,
+	})
+	for _, tc := range []struct {
+		name     string
+		indices  []string
+		wantPath string
+		wantUp   string
+	}{
+		// A green index in a red cluster.
+		{"indices", []string{"logs", "metrics"}, "/_cluster/health/logs,metrics", "up 1"},
+		{"all indices", []string{"logs", ""}, "/_cluster/health", "up 0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var collectors []string
+			for i, index := range tc.indices {
+				collectors = append(collectors, indexCollector(fmt.Sprintf("c%d", i), index))
+			}
+			tt, server := newTestTarget(t, gc, handler, collectors...)
+			assertLines(t, linesOf(collectTarget(context.Background(), tt), "up"), tc.wantUp)
+			if got := server.Requests()[0].Path; got != tc.wantPath {
+				t.Errorf("got health check path %s, want %s", got, tc.wantPath)
+			}
+		})
+	}
+}
+
+// indexCollector returns a collector counting the hits of the given index.
+func indexCollector(name, index string) string {
+	return `
+collector_name: ` + name + `
+queries:
+  - query_name: hits
+    query: "*"
+    index: ` + index + `
+metrics:
+  - metric_name: ` + name + `_hits
+    type: gauge
+    help: Hits.
+    query_ref: hits
+    track_total: true
+`
+}
+
+const hitsResponse = `{"hits": {"total": {"value": 42, "relation": "eq"}}}`
+
+func TestTargetCollectorsFailed(t *testing.T) {
+	tt, _ := newTestTarget(t, nil, respondRoutes(map[string]string{
+		"/_cluster/health": greenHealth,
+		"/good/_search":    hitsResponse,
+		// Anything else is a 404.
+	}), indexCollector("good", "good"), indexCollector("bad", "bad"))
+
+	lines := collectTarget(context.Background(), tt)
+	assertLines(t, linesOf(lines, "up"), `up 1`)
+	assertLines(t, linesOf(lines, "good_hits"), `good_hits 42`)
+	assertLines(t, linesOf(lines, "collectors_failed"), `collectors_failed 1`)
+}
+
+func TestTargetScrapeResult(t *testing.T) {
+	gc := mustGlobalConfig(t, "scrape_result: true")
+	for _, tc := range []struct {
+		index string
+		want  []string
+	}{
+		{"good", []string{`scrape_result{status="success"} 1`, `scrape_result{status="failure"} 0`}},
+		{"bad", []string{`scrape_result{status="success"} 0`, `scrape_result{status="failure"} 1`}},
+	} {
+		t.Run(tc.index, func(t *testing.T) {
+			tt, _ := newTestTarget(t, gc, respondRoutes(map[string]string{
+				"/_cluster/health": greenHealth,
+				"/good/_search":    hitsResponse,
+			}), indexCollector("test", tc.index))
+
+			lines := collectTarget(context.Background(), tt)
+			assertLines(t, linesOf(lines, "scrape_result"), tc.want...)
+			// The classic up metric is still there.
+			assertLines(t, linesOf(lines, "up"), `up 1`)
+		})
+	}
+
+	// Not exported unless enabled.
+	tt, _ := newTestTarget(t, nil, respondRoutes(map[string]string{"/_cluster/health": greenHealth}))
+	assertLines(t, linesOf(collectTarget(context.Background(), tt), "scrape_result"))
+}
+
+func TestTargetMinClusterStatus(t *testing.T) {
+	for _, tc := range []struct {
+		minStatus, status string
+		up                string
+	}{
+		{"green", "yellow", "0"},
+		{"green", "red", "0"},
+		{"yellow", "yellow", "1"},
+		{"yellow", "red", "0"},
+		{"red", "yellow", "1"},
+		{"red", "red", "1"},
+	} {
+		t.Run(tc.minStatus+"/"+tc.status, func(t *testing.T) {
+			gc := mustGlobalConfig(t, "min_cluster_status: "+tc.minStatus)
+			tt, _ := newTestTarget(t, gc, respondRoutes(map[string]string{
+				"/_cluster/health": `{"status": "` + tc.status + `"}`,
+				"/_search":         hitsResponse,
+			}), indexCollector("test", "logs"))
+
+			lines := collectTarget(context.Background(), tt)
+			assertLines(t, linesOf(lines, "up"), "up "+tc.up)
+			var want []string
+			for _, s := range config.ClusterStatuses {
+				value := "0"
+				if string(s) == tc.status {
+					value = "1"
+				}
+				want = append(want, `cluster_status{status="`+string(s)+`"} `+value)
+			}
+			assertLines(t, linesOf(lines, "cluster_status"), want...)
+		})
+	}
+}
+
+func TestTargetMetricPrefix(t *testing.T) {
+	gc := mustGlobalConfig(t, "metric_prefix: myapp_")
+	tt, _ := newTestTarget(t, gc, respondRoutes(map[string]string{
+		"/_cluster/health": greenHealth,
+		"/_search":         hitsResponse,
+		"/":                `{"cluster_name": "test", "version": {"number": "7.10.2"}}`,
+	}), indexCollector("test", "logs"))
+
+	lines := collectTarget(context.Background(), tt)
+	assertLines(t, errorLines(lines))
+	for _, name := range []string{"myapp_up", "myapp_scrape_duration_seconds", "myapp_test_hits"} {
+		if len(linesOf(lines, name)) == 0 {
+			t.Errorf("%s missing", name)
+		}
+	}
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "myapp_") {
+			t.Errorf("metric without prefix: %s", l)
+		}
+	}
+}
+
+func TestTargetCollectAbandoned(t *testing.T) {
+	gc := mustGlobalConfig(t, "metric_channel_capacity: 1")
+	tt, _ := newTestTarget(t, gc, respondRoutes(map[string]string{
+		"/_cluster/health": greenHealth,
+		"/_search":         hitsResponse,
+	}), indexCollector("first", "logs"), indexCollector("second", "logs"), indexCollector("third", "logs"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// Nobody reads from the channel past the first metric, so all senders end up blocked until ctx is cancelled.
+	ch := make(chan Metric, 1)
+	done := make(chan struct{})
+	go func() {
+		tt.Collect(ctx, ch)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Collect didn't return after the context was cancelled")
+	}
+}
+
+func TestTargetUserAgent(t *testing.T) {
+	for _, tc := range []struct {
+		globals, want string
+	}{
+		{"", "elastic_exporter/" + version.Version},
+		{`user_agent: "monitoring ({{ .target }})"`, "monitoring (es)"},
+	} {
+		transport := &recordingTransport{handler: respondRoutes(map[string]string{"/_cluster/health": greenHealth})}
+		tt := newTestTargetFor(t, mustGlobalConfig(t, tc.globals), &config.DataSourceConfig{URL: "http://es:9200"})
+		tt.transport = transport
+
+		if _, err := tt.ensureUp(context.Background()); err != nil {
+			t.Fatalf("ensureUp: %s", err)
+		}
+		if got := transport.Requests()[0].Header.Get("User-Agent"); got != tc.want {
+			t.Errorf("got User-Agent %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestTargetCloudID(t *testing.T) {
+	transport := &recordingTransport{handler: respondRoutes(map[string]string{"/_cluster/health": greenHealth})}
+	// Deployment `abc123` on `es.example.com`.
+	tt := newTestTargetFor(t, nil, &config.DataSourceConfig{CloudID: "test:ZXMuZXhhbXBsZS5jb20kYWJjMTIzJGtpYg=="})
+	tt.transport = transport
+
+	if _, err := tt.ensureUp(context.Background()); err != nil {
+		t.Fatalf("ensureUp: %s", err)
+	}
+	if got := transport.Requests()[0].Host; got != "abc123.es.example.com" {
+		t.Errorf("got host %q, want abc123.es.example.com", got)
+	}
+}
+
+func TestTargetServiceToken(t *testing.T) {
+	transport := &recordingTransport{handler: respondRoutes(map[string]string{
+		"/_cluster/health": greenHealth,
+		"/_search":         hitsResponse,
+	})}
+	tt := newTestTargetFor(t, nil, &config.DataSourceConfig{URL: "http://es:9200", ServiceToken: "AAEAAWVsYXN0aWM"},
+		indexCollector("logs", "logs"))
+	tt.transport = transport
+
+	lines := collectTarget(context.Background(), tt)
+	assertLines(t, linesOf(lines, "logs_hits"), `logs_hits 42`)
+	// The health check and cluster info requests included.
+	for _, r := range transport.Requests() {
+		if got := r.Header.Get("Authorization"); got != "Bearer AAEAAWVsYXN0aWM" {
+			t.Errorf("%s: got Authorization %q, want the bearer token", r.Path, got)
+		}
+	}
+}
+
+func TestTargetNodeURLs(t *testing.T) {
+	transport := &recordingTransport{handler: respondRoutes(map[string]string{"/_cluster/health": greenHealth})}
+	tt := newTestTargetFor(t, nil, &config.DataSourceConfig{URL: "http://es1:9200, http://es2:9200,http://es3:9200"})
+	tt.transport = transport
+
+	if _, err := tt.ensureUp(context.Background()); err != nil {
+		t.Fatalf("ensureUp: %s", err)
+	}
+	client, _ := tt.activeClient()
+	var urls []string
+	for _, u := range client.Transport.(interface{ URLs() []*url.URL }).URLs() {
+		urls = append(urls, u.String())
+	}
+	assertLines(t, urls, "http://es1:9200", "http://es2:9200", "http://es3:9200")
+}
+
+func TestTargetHeaders(t *testing.T) {
+	transport := &recordingTransport{handler: respondRoutes(map[string]string{
+		"/_cluster/health": greenHealth,
+		"/_search":         hitsResponse,
+	})}
+	tt := newTestTargetFor(t, nil, &config.DataSourceConfig{
+		URL:      "http://es:9200",
+		Username: "exporter",
+		Password: "secret",
+		Headers:  map[string]string{"X-Tenant-ID": "acme"},
+	}, indexCollector("logs", "logs"))
+	tt.transport = transport
+
+	lines := collectTarget(context.Background(), tt)
+	assertLines(t, linesOf(lines, "logs_hits"), `logs_hits 42`)
+	for _, r := range transport.Requests() {
+		// Along with the credentials, not instead.
+		if got := r.Header.Get("X-Tenant-ID"); got != "acme" {
+			t.Errorf("%s: got X-Tenant-ID %q, want acme", r.Path, got)
+		}
+		if _, _, ok := (&http.Request{Header: r.Header}).BasicAuth(); !ok {
+			t.Errorf("%s: got no basic auth credentials", r.Path)
+		}
+	}
+}
+
+func TestTargetScrapesInFlight(t *testing.T) {
+	release := make(chan struct{})
+	tt, _ := newTestTarget(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		respondRoutes(map[string]string{"/_cluster/health": greenHealth, "/_search": hitsResponse})(w, r)
+	}, indexCollector("logs", "logs"))
+
+	results := make(chan []string, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			results <- linesOf(collectTarget(context.Background(), tt), "scrapes_in_flight")
+		}()
+	}
+	// Let the scrapes overlap.
+	for atomic.LoadInt32(&tt.inFlight) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, <-results...)
+	}
+	assertSortedLines(t, got, `scrapes_in_flight 1`, `scrapes_in_flight 2`, `scrapes_in_flight 3`)
+
+	assertLines(t, linesOf(collectTarget(context.Background(), tt), "scrapes_in_flight"), `scrapes_in_flight 1`)
+}
+
+func TestTargetRetryBudget(t *testing.T) {
+	for _, tc := range []struct {
+		globals string
+		want    int
+	}{
+		// 3 queries and at most 2 retries each, 6 retries in total without a budget.
+		{"query_retries: 2", 9},
+		{"query_retries: 2\nretry_budget: 4", 7},
+	} {
+		tt, server := newTestTarget(t, mustGlobalConfig(t, tc.globals), func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/_search") {
+				http.Error(w, `{"error": "too many requests"}`, http.StatusTooManyRequests)
+				return
+			}
+			respondJSON(greenHealth)(w, r)
+		}, indexCollector("first", "logs"), indexCollector("second", "logs"), indexCollector("third", "logs"))
+
+		collectTarget(context.Background(), tt)
+		var searches int
+		for _, r := range server.Requests() {
+			if strings.HasSuffix(r.Path, "/_search") {
+				searches++
+			}
+		}
+		if searches != tc.want {
+			t.Errorf("%q: got %d search requests, want %d", tc.globals, searches, tc.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package elastic_exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"iss.digital/mt/elastic_exporter/config"
+)
+
+// newHTTPTransport returns the base transport of a target's client, tuned as per the global config and with the data
+// source's TLS and proxy settings (if any). It returns http.DefaultTransport, shared by all targets, if there's nothing
+// to change.
+func newHTTPTransport(gc *config.GlobalConfig, dsc *config.DataSourceConfig) (http.RoundTripper, error) {
+	tc := dsc.TLS
+	if tc == nil && dsc.Proxy() == nil && gc.MaxIdleConns == 0 && gc.MaxIdleConnsPerHost == 0 && gc.IdleConnTimeout == 0 &&
+		gc.ResponseHeaderTimeout == 0 && gc.DialTimeout == 0 {
+		return http.DefaultTransport, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tc != nil {
+		tlsConfig, err := newTLSConfig(tc)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if proxy := dsc.Proxy(); proxy != nil {
+		// Replaces http.ProxyFromEnvironment, NO_PROXY included.
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if gc.MaxIdleConns > 0 {
+		transport.MaxIdleConns = gc.MaxIdleConns
+		// Most targets are a single node, which the Go default of 2 idle connections per host would hold back to.
+		transport.MaxIdleConnsPerHost = gc.MaxIdleConns
+	}
+	if gc.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = gc.MaxIdleConnsPerHost
+	}
+	if gc.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(gc.IdleConnTimeout)
+	}
+	if gc.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(gc.ResponseHeaderTimeout)
+	}
+	if gc.DialTimeout > 0 {
+		// Same keep-alive as http.DefaultTransport's dialer.
+		transport.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(gc.DialTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	return transport, nil
+}
+
+// newTLSConfig returns a tls.Config with the given settings, loading the CA and client certificates from their files.
+func newTLSConfig(tc *config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         tc.ServerName,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+	if tc.CAFile != "" {
+		pem, err := ioutil.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", tc.CAFile)
+		}
+	}
+	if tc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// userAgentTransport is a http.RoundTripper setting the User-Agent header of all requests, replacing the one set by
+// the ElasticSearch client.
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+// newUserAgentTransport returns a userAgentTransport wrapping next.
+func newUserAgentTransport(userAgent string, next http.RoundTripper) http.RoundTripper {
+	return &userAgentTransport{userAgent: userAgent, next: next}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request, so work on a copy.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(req)
+}
+
+// compressionTransport is a http.RoundTripper gzipping the body of all requests. Large aggregation queries compress
+// well, which matters when targets are reached over slow or metered links.
+type compressionTransport struct {
+	writers sync.Pool // *gzip.Writer instances of the configured level, reused across requests
+	next    http.RoundTripper
+}
+
+// newCompressionTransport returns a compressionTransport wrapping next, compressing at the given gzip level (0 for the
+// gzip default).
+func newCompressionTransport(level int, next http.RoundTripper) http.RoundTripper {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	t := &compressionTransport{next: next}
+	t.writers.New = func() interface{} {
+		// The level is validated by the config, so this can't fail.
+		w, _ := gzip.NewWriterLevel(ioutil.Discard, level)
+		return w
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *compressionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return t.next.RoundTrip(req)
+	}
+
+	var buf bytes.Buffer
+	w := t.writers.Get().(*gzip.Writer)
+	defer t.writers.Put(w)
+	w.Reset(&buf)
+	_, err := io.Copy(w, req.Body)
+	req.Body.Close()
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the request, so work on a copy.
+	body := buf.Bytes()
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Encoding", "gzip")
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,204 @@
+package elastic_exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	"iss.digital/mt/elastic_exporter/config"
+)
+
+func TestCompressionTransport(t *testing.T) {
+	body := `{"query": {"bool": {"filter": [` + strings.Repeat(`{"term": {"host": "a"}},`, 5000) + `]}}}`
+	for _, compress := range []bool{false, true} {
+		recorder := &recordingTransport{handler: respondJSON(`{}`)}
+		var transport http.RoundTripper = recorder
+		if compress {
+			transport = newCompressionTransport(9, recorder)
+		}
+		req, _ := http.NewRequest(http.MethodPost, "http://es:9200/_search", strings.NewReader(body))
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip: %s", err)
+		}
+		resp.Body.Close()
+
+		sent := recorder.Requests()[0]
+		if !compress {
+			if sent.Header.Get("Content-Encoding") != "" || sent.Body != body {
+				t.Errorf("expected the body sent as is without compression, got %d bytes", len(sent.Body))
+			}
+			continue
+		}
+		if got := sent.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("got Content-Encoding %q, want gzip", got)
+		}
+		if len(sent.Body) >= len(body)/10 {
+			t.Errorf("expected the %d bytes body to compress well, got %d bytes", len(body), len(sent.Body))
+		}
+		r, err := gzip.NewReader(bytes.NewReader([]byte(sent.Body)))
+		if err != nil {
+			t.Fatalf("gzip.NewReader: %s", err)
+		}
+		if decompressed, _ := ioutil.ReadAll(r); string(decompressed) != body {
+			t.Errorf("decompressed body doesn't match the original one")
+		}
+	}
+}
+
+func TestTargetCompressRequestBody(t *testing.T) {
+	// A large response, gzipped by the fake ElasticSearch if the client accepts it.
+	response := `{"hits": {"total": {"value": 3}}, "padding": "` + strings.Repeat("x", 1<<20) + `"}`
+	for _, compress := range []bool{false, true} {
+		globals := ""
+		if compress {
+			globals = "compress_request_body: true"
+		}
+		tt, server := newTestTarget(t, mustGlobalConfig(t, globals), func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/_search") {
+				respondJSON(greenHealth)(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Write([]byte(response))
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			gw.Write([]byte(response))
+			gw.Close()
+		}, indexCollector("logs", "logs"))
+
+		lines := collectTarget(context.Background(), tt)
+		assertLines(t, errorLines(lines))
+		assertLines(t, linesOf(lines, "logs_hits"), `logs_hits 3`)
+
+		for _, r := range server.Requests() {
+			if !strings.HasSuffix(r.Path, "/_search") {
+				continue
+			}
+			if got, want := r.Header.Get("Content-Encoding") == "gzip", compress; got != want {
+				t.Errorf("compress_request_body %t: got a gzipped request body %t", compress, got)
+			}
+		}
+	}
+}
+
+// writeCAFile writes the certificate of the given TLS server to a PEM file, returning its path.
+func writeCAFile(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	return path
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(respondJSON(greenHealth))
+	defer server.Close()
+
+	tlsConfig, err := newTLSConfig(&config.TLSConfig{CAFile: writeCAFile(t, server), ServerName: "es.example.com"})
+	if err != nil {
+		t.Fatalf("newTLSConfig: %s", err)
+	}
+	if tlsConfig.RootCAs == nil || tlsConfig.ServerName != "es.example.com" {
+		t.Errorf("got %+v, want the test CA and server name", tlsConfig)
+	}
+	// The pool holds the test CA, i.e. it verifies the server certificate.
+	if _, err := server.Certificate().Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs}); err != nil {
+		t.Errorf("expected the server certificate to verify against RootCAs: %s", err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	ioutil.WriteFile(empty, nil, 0600)
+	for _, tc := range []struct {
+		tc   *config.TLSConfig
+		want string
+	}{
+		{&config.TLSConfig{CAFile: "/nonexistent/ca.pem"}, "failed to read CA file"},
+		{&config.TLSConfig{CAFile: empty}, "no certificates found in CA file"},
+		{&config.TLSConfig{CertFile: empty, KeyFile: empty}, "failed to load client certificate"},
+	} {
+		if _, err := newTLSConfig(tc.tc); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%+v: got error %v, want %q", tc.tc, err, tc.want)
+		}
+	}
+}
+
+func TestTargetTLS(t *testing.T) {
+	server := httptest.NewTLSServer(respondRoutes(map[string]string{"/_cluster/health": greenHealth}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name string
+		tls  *config.TLSConfig
+		up   string
+	}{
+		{"system CAs", nil, "up 0"},
+		{"test CA", &config.TLSConfig{CAFile: writeCAFile(t, server)}, "up 1"},
+		{"insecure", &config.TLSConfig{InsecureSkipVerify: true}, "up 1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := newTestTargetFor(t, nil, &config.DataSourceConfig{URL: config.Secret(server.URL), TLS: tc.tls})
+			assertLines(t, linesOf(collectTarget(context.Background(), tt), "up"), tc.up)
+		})
+	}
+}
+
+func TestNewHTTPTransport(t *testing.T) {
+	dsc := &config.DataSourceConfig{URL: "http://es:9200"}
+	if transport, err := newHTTPTransport(mustGlobalConfig(t, ""), dsc); err != nil || transport != http.DefaultTransport {
+		t.Errorf("got %v, %v; want the shared default transport", transport, err)
+	}
+
+	for _, tc := range []struct {
+		globals                           string
+		maxIdleConns, maxIdleConnsPerHost int
+	}{
+		// A single node target uses up to max_idle_conns connections, rather than the Go default of 2.
+		{"max_idle_conns: 50", 50, 50},
+		{"max_idle_conns: 50\nmax_idle_conns_per_host: 10", 50, 10},
+	} {
+		gc := mustGlobalConfig(t, tc.globals+"\nidle_conn_timeout: 30s\nresponse_header_timeout: 5s\ndial_timeout: 2s")
+		rt, err := newHTTPTransport(gc, dsc)
+		if err != nil {
+			t.Fatalf("newHTTPTransport: %s", err)
+		}
+		transport := rt.(*http.Transport)
+		if transport.MaxIdleConns != tc.maxIdleConns || transport.MaxIdleConnsPerHost != tc.maxIdleConnsPerHost ||
+			transport.IdleConnTimeout != 30*time.Second || transport.ResponseHeaderTimeout != 5*time.Second {
+			t.Errorf("%q: got MaxIdleConns %d, MaxIdleConnsPerHost %d, IdleConnTimeout %s, ResponseHeaderTimeout %s",
+				tc.globals, transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout,
+				transport.ResponseHeaderTimeout)
+		}
+	}
+}
+
+func TestTargetProxy(t *testing.T) {
+	proxy := newTestServer(t, respondRoutes(map[string]string{"/_cluster/health": greenHealth}))
+	var tc config.TargetConfig
+	if err := yaml.Unmarshal([]byte("url: http://es.internal:9200\nproxy_url: "+proxy.URL+"\ncollectors: [test]"), &tc); err != nil {
+		t.Fatalf("invalid target config: %s", err)
+	}
+	tt := newTestTargetFor(t, nil, &tc.DataSourceConfig)
+
+	if _, err := tt.ensureUp(context.Background()); err != nil {
+		t.Fatalf("ensureUp: %s", err)
+	}
+	if requests := proxy.Requests(); len(requests) != 1 || requests[0].Host != "es.internal:9200" {
+		t.Errorf("got proxied requests %+v, want one to es.internal:9200", requests)
+	}
+}